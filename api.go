@@ -0,0 +1,560 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxAPIBody = 64 << 10 // Bytes of the API request bodies.
+
+	apiPending = "pending" // Status of the changes waiting for their email confirmation.
+	apiApplied = "applied" // Status of the changes made through an API token.
+)
+
+var (
+	errUnauthorized = errors.New("Error: Missing or invalid API token.")
+	errInvalidJSON  = errors.New("Error: The request body is not a valid JSON document.")
+	errInvalidLimit = errors.New("Error: The limit must be a number between 1 and 200.")
+	errNoSuchPath   = errors.New("Error: No such API endpoint.")
+	errForbidden    = errors.New("Error: The API token lacks the scope needed.")
+)
+
+// apiCode is the HTTP status and error code of the API errors.
+type apiCode struct {
+	status int
+	code   string
+}
+
+// apiCodes maps the errMessage errors to their API status and code. Any other
+// errMessage is an invalid_request, and errInternal an internal_error.
+var apiCodes = map[error]apiCode{
+	errUnauthorized:    {http.StatusUnauthorized, "unauthorized"},
+	errForbidden:       {http.StatusForbidden, "forbidden"},
+	errNoSuchPath:      {http.StatusNotFound, "not_found"},
+	errNotFound:        {http.StatusNotFound, "not_found"},
+	errRuleNotFound:    {http.StatusNotFound, "rule_not_found"},
+	errLastRule:        {http.StatusConflict, "last_rule"},
+	errTooManyRules:    {http.StatusConflict, "too_many_rules"},
+	errChannelNotFound: {http.StatusNotFound, "channel_not_found"},
+	errChannelExists:   {http.StatusConflict, "channel_exists"},
+	errTooManyChannels: {http.StatusConflict, "too_many_channels"},
+	errInvalidChannel:  {http.StatusBadRequest, "invalid_channel"},
+	errTokenNotFound:   {http.StatusNotFound, "token_not_found"},
+	errInvalidJSON:     {http.StatusBadRequest, "invalid_json"},
+	errInvalidEmail:    {http.StatusBadRequest, "invalid_email"},
+	errInvalidRule:     {http.StatusBadRequest, "invalid_rule"},
+	errInvalidDelivery: {http.StatusBadRequest, "invalid_delivery"},
+	errInvalidLimit:    {http.StatusBadRequest, "invalid_limit"},
+}
+
+// setupAPIHandlers registers the handlers of the JSON API, versioned under the given router.
+// Handlers on the subscription of a user require the given token scope.
+func setupAPIHandlers(router *mux.Router) {
+	router.HandleFunc("/subscriptions", apiHandler(APISubscribeHandler)).
+		Methods("POST")
+	router.HandleFunc("/subscription", requireScope(scopeReadSettings, apiHandler(APISubscriptionHandler))).
+		Methods("GET")
+	router.HandleFunc("/subscription", requireScope(scopeWriteSettings, apiHandler(APISubscriptionHandler))).
+		Methods("DELETE")
+	router.HandleFunc("/subscription/rules/{rule}", requireScope(scopeWriteSettings, apiHandler(APIRuleHandler))).
+		Methods("PUT", "DELETE")
+	router.HandleFunc("/subscription/channels", requireScope(scopeChannels, apiHandler(APIChannelHandler))).
+		Methods("POST")
+	router.HandleFunc("/subscription/channels/{channel}", requireScope(scopeChannels, apiHandler(APIChannelHandler))).
+		Methods("DELETE")
+	router.HandleFunc("/subscription/items", requireScope(scopeReadHistory, apiHandler(APIItemsHandler))).
+		Methods("GET")
+	router.HandleFunc("/tokens", requireScope(scopeReadSettings, apiHandler(APITokensHandler))).
+		Methods("GET")
+	router.HandleFunc("/tokens/{token}", requireScope(scopeWriteSettings, apiHandler(APITokensHandler))).
+		Methods("DELETE")
+	router.HandleFunc("/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "./public/openapi.json")
+	})
+	router.PathPrefix("/").Handler(apiHandler(func(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+		return errMessage{errNoSuchPath}
+	}))
+}
+
+// apiHandler wraps a custom handler function of the JSON API. Errors are rendered as apiError documents.
+func apiHandler(f handlerFunc) http.HandlerFunc {
+	return wrapHandler(f, writeAPIError)
+}
+
+// apiError is the body of the API error responses.
+type apiError struct {
+	Error apiErrorBody `json:"error"`
+}
+
+type apiErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeAPIError renders the error as an apiError document, see apiCodes.
+func writeAPIError(err error, w http.ResponseWriter) {
+	c := apiCode{http.StatusInternalServerError, "internal_error"}
+	msg := "An internal error occurred."
+	if e, ok := err.(errMessage); ok {
+		c, ok = apiCodes[e.error]
+		if !ok {
+			c = apiCode{http.StatusBadRequest, "invalid_request"}
+		}
+		msg = strings.TrimPrefix(err.Error(), "Error: ")
+	}
+	if c.status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+	}
+	writeJSON(w, c.status, apiError{apiErrorBody{Code: c.code, Message: msg}})
+}
+
+// writeJSON renders v as the JSON response body, with the given status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
+
+// decodeJSON reads the JSON request body into v. Unknown fields are rejected.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return errMessage{errInvalidJSON}
+	}
+	return nil
+}
+
+// apiStatus is the body of the API responses to changes, either waiting for their email
+// confirmation or applied.
+type apiStatus struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// writePending renders the apiStatus of a change waiting for its email confirmation.
+func writePending(w http.ResponseWriter) error {
+	return writeJSON(w, http.StatusAccepted, apiStatus{Status: apiPending, Message: linkSentMsg})
+}
+
+// writeApplied renders the apiStatus of an applied change, along with its message.
+func writeApplied(w http.ResponseWriter, msg string) error {
+	return writeJSON(w, http.StatusOK, apiStatus{Status: apiApplied, Message: msg})
+}
+
+// apiSettings are the rule Settings, as read and written by the API. Field names
+// follow the subscription form.
+type apiSettings struct {
+	Score          int      `json:"score"`
+	Velocity       int      `json:"velocity"`
+	Keywords       string   `json:"keywords"`
+	Exact          bool     `json:"exact"`
+	Article        bool     `json:"article"`
+	Feeds          []string `json:"feeds"`
+	Types          []string `json:"types"`
+	Authors        []string `json:"authors"`
+	MaxAge         int      `json:"max_age"`
+	MinComments    int      `json:"min_comments"`
+	Domains        []string `json:"domains"`
+	BlockedDomains []string `json:"blocked_domains"`
+}
+
+func newAPISettings(s *Settings) apiSettings {
+	return apiSettings{
+		Score:          s.Score,
+		Velocity:       s.Velocity,
+		Keywords:       s.Query,
+		Exact:          s.Exact,
+		Article:        s.Article,
+		Feeds:          nonNil(s.Feeds),
+		Types:          nonNil(s.Types),
+		Authors:        nonNil(s.Authors),
+		MaxAge:         s.MaxAge,
+		MinComments:    s.MinComments,
+		Domains:        nonNil(s.Domains),
+		BlockedDomains: nonNil(s.BlockedDomains),
+	}
+}
+
+// settings returns the unvalidated Settings. See apiRuleRequest.parse.
+func (s *apiSettings) settings() Settings {
+	return Settings{
+		Score:          s.Score,
+		Velocity:       s.Velocity,
+		Query:          s.Keywords,
+		Exact:          s.Exact,
+		Article:        s.Article,
+		Feeds:          s.Feeds,
+		Types:          s.Types,
+		Authors:        s.Authors,
+		MaxAge:         s.MaxAge,
+		MinComments:    s.MinComments,
+		Domains:        s.Domains,
+		BlockedDomains: s.BlockedDomains,
+	}
+}
+
+// apiDelivery is the Delivery of the user, as read and written by the API.
+type apiDelivery struct {
+	Mode          string `json:"mode"`
+	DigestHour    int    `json:"digest_hour"`
+	DigestWeekday int    `json:"digest_weekday"`
+	Timezone      string `json:"timezone"`
+	QuietStart    int    `json:"quiet_start"`
+	QuietEnd      int    `json:"quiet_end"`
+	MaxPerHour    int    `json:"max_per_hour"`
+	MaxPerDay     int    `json:"max_per_day"`
+	MuteEmail     bool   `json:"mute_email"`
+}
+
+func newAPIDelivery(d *Delivery) apiDelivery {
+	mode := d.Mode
+	if mode == "" {
+		mode = deliverImmediate
+	}
+	return apiDelivery{
+		Mode:          mode,
+		DigestHour:    d.Hour,
+		DigestWeekday: d.Weekday,
+		Timezone:      d.Timezone,
+		QuietStart:    d.QuietStart,
+		QuietEnd:      d.QuietEnd,
+		MaxPerHour:    d.MaxPerHour,
+		MaxPerDay:     d.MaxPerDay,
+		MuteEmail:     d.MuteEmail,
+	}
+}
+
+// delivery returns the unvalidated Delivery. See apiRuleRequest.parse.
+func (d *apiDelivery) delivery() Delivery {
+	return Delivery{
+		Mode:       d.Mode,
+		Hour:       d.DigestHour,
+		Weekday:    d.DigestWeekday,
+		Timezone:   d.Timezone,
+		QuietStart: d.QuietStart,
+		QuietEnd:   d.QuietEnd,
+		MaxPerHour: d.MaxPerHour,
+		MaxPerDay:  d.MaxPerDay,
+		MuteEmail:  d.MuteEmail,
+	}
+}
+
+// apiRuleRequest is the body of the API requests creating or updating a rule.
+type apiRuleRequest struct {
+	Settings apiSettings  `json:"settings"`
+	Delivery *apiDelivery `json:"delivery"` // Unchanged if omitted.
+}
+
+// parse validates the named rule and the delivery preferences, through the same
+// parsers as the subscription form. The delivery is nil if omitted.
+func (req *apiRuleRequest) parse(name string) (Rule, *Delivery, error) {
+	rule := Rule{Name: name, Settings: req.Settings.settings()}
+	q := url.Values{}
+	rule.encode(q)
+	if req.Delivery != nil {
+		d := req.Delivery.delivery()
+		d.encode(q)
+	}
+	r := &http.Request{Form: q}
+
+	var (
+		ok  bool
+		err error
+	)
+	if rule.Name, ok = parseRuleName(r); !ok {
+		return rule, nil, errMessage{errInvalidRule}
+	}
+	if rule.Settings, err = parseSettings(r); err != nil {
+		return rule, nil, err
+	}
+	if req.Delivery == nil {
+		return rule, nil, nil
+	}
+	delivery, ok := parseDelivery(r)
+	if !ok {
+		return rule, nil, errMessage{errInvalidDelivery}
+	}
+	return rule, &delivery, nil
+}
+
+// apiSubscribeRequest is the body of the API requests creating a subscription.
+type apiSubscribeRequest struct {
+	Email string `json:"email"`
+	Rule  string `json:"rule"` // Defaults to defaultRule.
+	apiRuleRequest
+}
+
+// apiSubscription is the subscription of the user, as read by the API.
+type apiSubscription struct {
+	Email     string       `json:"email"`
+	Active    bool         `json:"active"`
+	CreatedAt time.Time    `json:"created_at"`
+	Rules     []apiRule    `json:"rules"`
+	Delivery  apiDelivery  `json:"delivery"`
+	Channels  []apiChannel `json:"channels,omitempty"` // Omitted if none, or without the channels scope.
+	Following []string     `json:"following"`
+}
+
+type apiRule struct {
+	Name     string      `json:"name"`
+	Settings apiSettings `json:"settings"`
+}
+
+// apiChannel is a notification channel, without its secrets. See newAPIChannel.
+type apiChannel struct {
+	Id       string `json:"id"`
+	Kind     string `json:"kind"`
+	Target   string `json:"target,omitempty"`
+	Room     string `json:"room,omitempty"`
+	Verified bool   `json:"verified"`
+}
+
+// newAPISubscription returns the subscription of the user, along with the channels
+// if requested.
+func newAPISubscription(u *User, channels bool) *apiSubscription {
+	s := &apiSubscription{
+		Email:     u.Email,
+		Active:    u.Active,
+		CreatedAt: u.CreatedAt,
+		Rules:     []apiRule{},
+		Delivery:  newAPIDelivery(&u.Delivery),
+		Following: nonNil(u.Following),
+	}
+	for i := range u.Rules {
+		s.Rules = append(s.Rules, apiRule{Name: u.Rules[i].Name, Settings: newAPISettings(&u.Rules[i].Settings)})
+	}
+	if channels {
+		for i := range u.Channels {
+			s.Channels = append(s.Channels, newAPIChannel(&u.Channels[i]))
+		}
+	}
+	return s
+}
+
+// newAPIChannel returns the channel as read by the API. Webhook URLs are omitted,
+// as they hold the credentials of the webhook.
+func newAPIChannel(c *Channel) apiChannel {
+	ac := apiChannel{Id: c.Id, Kind: c.Kind, Target: c.Target, Room: c.Room, Verified: c.Verified}
+	switch c.Kind {
+	case chanWebhook, chanSlack, chanDiscord:
+		ac.Target = ""
+	}
+	return ac
+}
+
+// apiItem is a matched item, as listed by the API.
+type apiItem struct {
+	Id         int       `json:"id"`
+	Title      string    `json:"title"`
+	Url        string    `json:"url,omitempty"` // Empty for text posts.
+	Discussion string    `json:"discussion"`
+	Score      int       `json:"score"`
+	Comments   int       `json:"comments"`
+	Rule       string    `json:"rule"`
+	MatchedAt  time.Time `json:"matched_at"`
+}
+
+// APISubscribeHandler is the API handler for new subscriptions; It handles 'POST /api/v1/subscriptions'.
+// Just like '/subscribe', registered users use it to add or update a rule, which is confirmed by email.
+func APISubscribeHandler(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	var req apiSubscribeRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		return err
+	}
+	if !validateAddress(req.Email) {
+		return errMessage{errInvalidEmail}
+	}
+	rule, delivery, err := req.parse(req.Rule)
+	if err != nil {
+		return err
+	}
+	if err := requestRule(ctx.db, req.Email, rule, delivery, false); err != nil {
+		return err
+	}
+	return writePending(w)
+}
+
+// APISubscriptionHandler is the API handler for the subscription of the authenticated user; It handles
+// '/api/v1/subscription'. The channels are only listed to tokens granting the channels scope.
+func APISubscriptionHandler(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	u := ctx.auth.user
+	if r.Method != "DELETE" {
+		return writeJSON(w, http.StatusOK, newAPISubscription(u, ctx.auth.token.allows(scopeChannels)))
+	}
+
+	if err := ctx.db.deleteUser(u.Id); err != nil {
+		return errInternal{err}
+	}
+	return writeApplied(w, unsubscribedMsg)
+}
+
+// APIRuleHandler is the API handler for updating and deleting the rules of the authenticated user;
+// It handles '/api/v1/subscription/rules/{rule}'.
+func APIRuleHandler(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	u := ctx.auth.user
+	rule := Rule{Name: mux.Vars(r)["rule"]}
+	var delivery *Delivery
+	del := r.Method == "DELETE"
+	if !del {
+		var (
+			req apiRuleRequest
+			err error
+		)
+		if err := decodeJSON(w, r, &req); err != nil {
+			return err
+		}
+		if rule, delivery, err = req.parse(rule.Name); err != nil {
+			return err
+		}
+	}
+
+	if err := checkRule(u, rule.Name, del); err != nil {
+		return err
+	}
+	if del {
+		if err := ctx.db.deleteUserRule(u.Id, rule.Name); err != nil {
+			return errInternal{err}
+		}
+		return writeApplied(w, ruleDeletedMsg)
+	}
+	if err := ctx.db.saveUserRule(u.Id, rule, delivery); err != nil {
+		return errInternal{err}
+	}
+	return writeApplied(w, scoreUpdatedMsg)
+}
+
+// apiChannelRequest is the body of the API requests adding a channel. Field names
+// follow the channel form.
+type apiChannelRequest struct {
+	Kind   string `json:"kind"`
+	Target string `json:"target"`
+	Room   string `json:"room"`
+	Secret string `json:"secret"`
+}
+
+// APIChannelHandler is the API handler for adding and deleting the notification channels of
+// the authenticated user; It handles 'POST /api/v1/subscription/channels' and
+// 'DELETE /api/v1/subscription/channels/{channel}'. New channels get a verification message.
+func APIChannelHandler(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	u := ctx.auth.user
+	if r.Method == "DELETE" {
+		id := mux.Vars(r)["channel"]
+		found := false
+		for _, c := range u.Channels {
+			found = found || c.Id == id
+		}
+		if !found {
+			return errMessage{errChannelNotFound}
+		}
+		if err := ctx.db.deleteUserChannel(u.Id, id); err != nil {
+			return errInternal{err}
+		}
+		return writeApplied(w, channelGoneMsg)
+	}
+
+	var req apiChannelRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		return err
+	}
+	c := Channel{Kind: req.Kind, Target: req.Target, Room: req.Room, Secret: req.Secret}
+	q := url.Values{}
+	c.encode(q)
+	c, ok := parseChannel(&http.Request{Form: q})
+	if !ok {
+		return errMessage{errInvalidChannel}
+	}
+	if err := checkChannel(u, &c); err != nil {
+		return err
+	}
+	c.Id = newToken()
+	c.Token = newToken()
+	if err := ctx.db.addUserChannel(u.Id, c); err != nil {
+		return errInternal{err}
+	}
+	return writeApplied(w, verifyNewChannel(u, &c))
+}
+
+// APIItemsHandler is the API handler listing the items recently matched for the authenticated user,
+// newest first; It handles 'GET /api/v1/subscription/items'.
+func APIItemsHandler(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	limit := feedSize
+	if v := r.FormValue("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxHistory {
+			return errMessage{errInvalidLimit}
+		}
+	}
+	history, err := ctx.db.findHistory(ctx.auth.user.Id, limit)
+	if err != nil {
+		return errInternal{err}
+	}
+
+	items := []apiItem{}
+	for i := range history {
+		item := &history[i]
+		items = append(items, apiItem{
+			Id:         item.Id,
+			Title:      item.Title,
+			Url:        item.Url,
+			Discussion: item.discussion(),
+			Score:      item.Score,
+			Comments:   item.Comments,
+			Rule:       item.Rule,
+			MatchedAt:  item.QueuedAt,
+		})
+	}
+	return writeJSON(w, http.StatusOK, map[string][]apiItem{"items": items})
+}
+
+// apiTokenInfo is an API token, as listed by the API. The token itself is not stored.
+type apiTokenInfo struct {
+	Id        string     `json:"id"`
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	LastUsed  *time.Time `json:"last_used,omitempty"` // Omitted if never used.
+}
+
+// APITokensHandler is the API handler for listing and revoking the API tokens of the authenticated
+// user; It handles 'GET /api/v1/tokens' and 'DELETE /api/v1/tokens/{token}', token being the token id.
+// Tokens are created through the account email. See TokensHandler.
+func APITokensHandler(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	u := ctx.auth.user
+	if r.Method == "DELETE" {
+		id := mux.Vars(r)["token"]
+		if u.apiToken(id) == nil {
+			return errMessage{errTokenNotFound}
+		}
+		if err := ctx.db.deleteAPIToken(u.Id, id); err != nil {
+			return errInternal{err}
+		}
+		return writeApplied(w, tokenRevokedMsg)
+	}
+
+	tokens := []apiTokenInfo{}
+	for _, t := range u.Tokens {
+		info := apiTokenInfo{Id: t.Id, Name: t.Name, Scopes: nonNil(t.Scopes), CreatedAt: t.CreatedAt}
+		if last := t.LastUsed; !last.IsZero() {
+			info.LastUsed = &last
+		}
+		tokens = append(tokens, info)
+	}
+	return writeJSON(w, http.StatusOK, map[string][]apiTokenInfo{"tokens": tokens})
+}
+
+// nonNil returns the slice, or an empty one if nil, so that it is encoded as a JSON array.
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
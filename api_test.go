@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// apiTest serves the API on a memory store holding a single active user, who owns
+// two channels.
+type apiTest struct {
+	db     *memoryStore
+	user   *User
+	router *mux.Router
+}
+
+func newAPITest(t *testing.T) *apiTest {
+	db := newMemoryStore()
+	prev := openStore
+	openStore = func() Store { return db }
+	t.Cleanup(func() { openStore = prev })
+
+	u := newUser("a@example.com", Rule{Name: defaultRule, Settings: Settings{Score: 300, Feeds: []string{"top"}}}, Delivery{})
+	u.Active = true
+	u.Channels = []Channel{
+		{Id: "c1", Kind: chanSlack, Target: "https://hooks.slack.com/services/secret", Verified: true},
+		{Id: "c2", Kind: chanNtfy, Target: "https://ntfy.sh/topic", Verified: true},
+	}
+	if err := db.upsertUser(u); err != nil {
+		t.Fatalf("upsertUser() error: %v", err)
+	}
+
+	r := mux.NewRouter()
+	setupAPIHandlers(r.PathPrefix("/api/v1").Subrouter())
+	return &apiTest{db: db, user: u, router: r}
+}
+
+// token stores an API token granting the scopes, and returns its bearer value.
+func (at *apiTest) token(t *testing.T, scopes ...string) string {
+	tk, token := newAPIToken("test", scopes)
+	if err := at.db.saveAPIToken(at.user.Id, tk); err != nil {
+		t.Fatalf("saveAPIToken() error: %v", err)
+	}
+	return token
+}
+
+// do serves the request, authenticated with the token if not empty.
+func (at *apiTest) do(method, path, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/api/v1"+path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	at.router.ServeHTTP(w, r)
+	return w
+}
+
+// errorCode returns the code of the apiError document in the response body.
+func errorCode(w *httptest.ResponseRecorder) string {
+	var e apiError
+	json.Unmarshal(w.Body.Bytes(), &e)
+	return e.Error.Code
+}
+
+func TestAPIAuthentication(t *testing.T) {
+	at := newAPITest(t)
+	read := at.token(t, scopeReadSettings)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		header string
+		status int
+		code   string
+	}{
+		{"missing bearer", "GET", "/subscription", "", http.StatusUnauthorized, "unauthorized"},
+		{"basic auth", "GET", "/subscription", "Basic YTpi", http.StatusUnauthorized, "unauthorized"},
+		{"feed token", "GET", "/subscription", "Bearer " + at.user.FeedToken, http.StatusUnauthorized, "unauthorized"},
+		{"unknown token", "GET", "/subscription", "Bearer " + apiTokenPrefix + "unknown", http.StatusUnauthorized, "unauthorized"},
+		{"wrong scope", "PUT", "/subscription/rules/jobs", "Bearer " + read, http.StatusForbidden, "forbidden"},
+		{"wrong scope", "GET", "/subscription/items", "Bearer " + read, http.StatusForbidden, "forbidden"},
+		{"granted scope", "GET", "/subscription", "Bearer " + read, http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/api/v1"+tt.path, strings.NewReader("{}"))
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		w := httptest.NewRecorder()
+		at.router.ServeHTTP(w, r)
+
+		if w.Code != tt.status || errorCode(w) != tt.code {
+			t.Errorf("%s: %s %s = %d %q, want %d %q", tt.name, tt.method, tt.path, w.Code, errorCode(w), tt.status, tt.code)
+		}
+		if auth := w.Header().Get("WWW-Authenticate"); (tt.status == http.StatusUnauthorized) != (auth != "") {
+			t.Errorf("%s: WWW-Authenticate = %q", tt.name, auth)
+		}
+	}
+}
+
+func TestAPISubscriptionChannels(t *testing.T) {
+	at := newAPITest(t)
+
+	tests := []struct {
+		scopes   []string
+		expected []apiChannel
+	}{
+		{[]string{scopeReadSettings}, nil},
+		{[]string{scopeReadSettings, scopeChannels}, []apiChannel{
+			{Id: "c1", Kind: chanSlack, Verified: true},
+			{Id: "c2", Kind: chanNtfy, Target: "https://ntfy.sh/topic", Verified: true},
+		}},
+	}
+
+	for _, tt := range tests {
+		w := at.do("GET", "/subscription", at.token(t, tt.scopes...), "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /subscription with %v = %d, want %d", tt.scopes, w.Code, http.StatusOK)
+		}
+		var raw map[string]json.RawMessage
+		var s apiSubscription
+		if err := json.Unmarshal(w.Body.Bytes(), &raw); err != nil {
+			t.Fatalf("GET /subscription: %v", err)
+		}
+		json.Unmarshal(w.Body.Bytes(), &s)
+
+		if _, listed := raw["channels"]; listed != (tt.expected != nil) {
+			t.Errorf("GET /subscription with %v lists channels: %v, want %v", tt.scopes, listed, tt.expected != nil)
+		}
+		if len(s.Channels) != len(tt.expected) {
+			t.Errorf("GET /subscription with %v = %+v, want %+v", tt.scopes, s.Channels, tt.expected)
+			continue
+		}
+		for i := range tt.expected {
+			if s.Channels[i] != tt.expected[i] {
+				t.Errorf("GET /subscription with %v = %+v, want %+v", tt.scopes, s.Channels, tt.expected)
+			}
+		}
+	}
+}
+
+func TestAPIRules(t *testing.T) {
+	at := newAPITest(t)
+	write := at.token(t, scopeWriteSettings)
+
+	w := at.do("PUT", "/subscription/rules/jobs", write, `{"settings":{"score":250,"feeds":["top"],"types":["job"]}}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"status":"`+apiApplied+`"`) {
+		t.Fatalf("PUT /subscription/rules/jobs = %d %s", w.Code, w.Body)
+	}
+	u, _ := at.db.findUser("a@example.com")
+	if r := u.rule("jobs"); r == nil || r.Score != 250 || len(r.Types) != 1 || r.Types[0] != "job" {
+		t.Fatalf("PUT /subscription/rules/jobs stored %+v", u.Rules)
+	}
+
+	tests := []struct {
+		rule   string
+		status int
+		code   string
+		rules  int
+	}{
+		{"missing", http.StatusNotFound, "rule_not_found", 2},
+		{"jobs", http.StatusOK, "", 1},
+		{defaultRule, http.StatusConflict, "last_rule", 1},
+	}
+	for _, tt := range tests {
+		w := at.do("DELETE", "/subscription/rules/"+tt.rule, write, "")
+		if w.Code != tt.status || errorCode(w) != tt.code {
+			t.Errorf("DELETE /subscription/rules/%s = %d %q, want %d %q", tt.rule, w.Code, errorCode(w), tt.status, tt.code)
+		}
+		if u, _ := at.db.findUser("a@example.com"); len(u.Rules) != tt.rules {
+			t.Errorf("DELETE /subscription/rules/%s left %+v, want %d rules", tt.rule, u.Rules, tt.rules)
+		}
+	}
+}
@@ -1,191 +1,290 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
+	"context"
+	"errors"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
-	"sync"
+	"os/signal"
+	"syscall"
 	"time"
+
+	"github.com/ichinaski/hnnotifications/hnapi"
 )
 
 const (
-	topStoriesUrl = "https://hacker-news.firebaseio.com/v0/topstories.json"
-	itemUrl       = "https://hacker-news.firebaseio.com/v0/item/%d.json"
-
-	runInterval   = 15 * time.Minute // Interval at which we fetch the items
-	maxTopStories = 150              // Maximum top stories fetched per cycle
+	maxTopStories = 150 // Maximum stories fetched per list and cycle
 )
 
 var (
-	config = loadConfig()
+	config *Config // Loaded by main().
 	Logger = log.New(os.Stdout, "  ", log.LstdFlags|log.Lshortfile)
+
+	hn *hnapi.Client // HN API client, concurrently used by all goroutines.
 )
 
 func main() {
+	config = loadConfig()
 	initDb() // Will panic on failure
 	setupHandlers()
 
-	// set up a goroutine that will periodically call run()
+	hn = hnapi.NewClient(config.APIUrl, config.APIRate)
+	hn.Timeout = config.APITimeout()
+
+	// ctx is cancelled upon SIGTERM/SIGINT, stopping the background jobs.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	if config.Fetcher == fetcherStream {
+		live = newLiveStream()
+		live.start(ctx)
+	}
+	schedule(ctx, "notifier", config.RunInterval(), run)
+	schedule(ctx, "digest", digestInterval, runDigests)
+	schedule(ctx, "webhooks", hookInterval, runWebhooks)
+	schedule(ctx, "comments", commentInterval, runComments)
+	schedule(ctx, "follows", followInterval, runFollows)
+	schedule(ctx, "watched", watchInterval, runWatched)
+
+	srv := &http.Server{Addr: config.Addr}
 	go func() {
-		run()
-		ticker := time.NewTicker(runInterval)
-		for {
-			select {
-			case <-ticker.C:
-				run() // TODO: Consider executing run() in a separate goroutine
-			}
-		}
+		<-ctx.Done()
+		Logger.Println("Shutting down...")
+		srv.Shutdown(context.Background())
 	}()
 
 	Logger.Printf("Listening on %s...\n", config.Addr)
-	Logger.Fatal(http.ListenAndServe(config.Addr, nil))
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		Logger.Fatal(err)
+	}
+	jobs.Wait() // Let the running jobs wind down.
 }
 
-// Item represents a HN story.
-type Item struct {
-	By    string // unused
-	Id    int
-	Kids  []int64 // unused
-	Score int
-	Time  int64 // unused
-	Title string
-	Type  string // unused
-	Url   string
-}
+// run fetches the HN story lists and sends notifications according to each user's criteria.
+// Items are fetched by a bounded pool of workers (see fetchItems), and the cycle stops
+// early when ctx is cancelled.
+func run(ctx context.Context) error {
+	lists := config.Feeds
+	if live != nil && live.healthy() {
+		// The top stories are streamed; the other lists are still polled.
+		lists = nil
+		for _, feed := range config.Feeds {
+			if feed != hnapi.Top {
+				lists = append(lists, feed)
+			}
+		}
+		if len(lists) == 0 {
+			Logger.Println("Live stream active, skipping poll")
+			return nil
+		}
+	}
 
-// run fetches the top HN stories and sends notifications according to each user's score threshold.
-// The channel fan-in approach is fully inspired by the example in http://blog.golang.org/pipelines.
-func run() {
 	Logger.Println("Notifier started...")
 	t0 := time.Now()
-	db := newDatabase()
+	db := openStore()
 	defer db.close()
 
-	// Single http.Client concurrently used by all goroutines
-	client := &http.Client{}
-
-	ids, err := getTopStories(client)
+	ids, feeds, err := listStories(ctx, lists)
 	if err != nil {
-		Logger.Println(err)
-		return // Just wait till the next cycle.
-	}
-	if len(ids) > maxTopStories {
-		ids = ids[:maxTopStories]
-	}
-
-	// fetcher runs a goroutine to fetch the item. Once completed, the result
-	// will be inserted in the returned channel, and the channel closed.
-	fetchItem := func(id int) chan Item {
-		out := make(chan Item)
-		go func() {
-			item, err := getItem(client, id)
-			if err != nil {
-				Logger.Println(err)
-			} else if id == item.Id { // Guard against null responses, coerced into an empty Item
-				out <- item
-			}
-			close(out)
-		}()
-		return out
+		return err // Just wait till the next cycle.
 	}
 
-	// Fetch items concurrently. Each channel will just hold one item.
-	cs := make([]chan Item, len(ids))
-	for i, id := range ids {
-		cs[i] = fetchItem(id)
+	ids, reused := unchangedItems(ctx, db, ids)
+	items, failed := fetchLogged(ctx, ids, config.Workers)
+	stories := enrichItems(ctx, withItems(ctx, reused, items), feeds, config.Workers)
+	fetched := make(map[int]bool, len(ids)) // Items to store, as opposed to the reused ones.
+	for _, id := range ids {
+		fetched[id] = true
 	}
 
-	for item := range merge(cs...) {
-		if users := db.findUsersForItem(item); len(users) > 0 {
-			emails := make([]string, len(users)) // Create a slice with all the recipients for this item.
-			for i, u := range users {
-				emails[i] = u.Email
-			}
-
-			// Send the email.
-			if err := sendItem(item.Id, item.Title, item.Url, emails); err != nil {
-				Logger.Println("Error sending mail: ", err)
-				continue
-			}
-			Logger.Printf("Item %d sent to users: %v\n", item.Id, emails)
-
-			// Update items set.
-			if err := db.updateSentItems(emails, item.Id); err != nil {
-				Logger.Println("Error: updateItems() - ", err)
+	now := time.Now()
+	for s := range stories {
+		if ctx.Err() != nil {
+			continue
+		}
+		if fetched[s.Id] {
+			if err := db.saveItem(&s.Item, now); err != nil {
+				Logger.Println("Error: saveItem() - ", err)
 			}
+		} else if err := db.saveSnapshot(s.Id, Snapshot{now, s.Score, s.Descendants}); err != nil {
+			Logger.Println("Error: saveSnapshot() - ", err)
 		}
+		s.Velocity = velocity(db, &s.Item, now)
+		process(db, s)
+	}
+	if len(reused) > 0 {
+		Logger.Printf("Reused %d unchanged items\n", len(reused))
+	}
+	if err := db.pruneItems(now.Add(-config.ItemRetention())); err != nil {
+		Logger.Println("Error: pruneItems() - ", err)
+	}
+	if n := <-failed; n > 0 {
+		Logger.Printf("Failed to fetch %d/%d items\n", n, len(ids))
+		if n == len(ids) {
+			return errors.New("failed to fetch all the items")
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
 	Logger.Printf("Notifier finished - Total time: %s\n", time.Now().Sub(t0).String())
+	return nil
 }
 
-// getTopStories reads the top stories IDs from the API.
-func getTopStories(client *http.Client) ([]int, error) {
-	req, err := http.NewRequest("GET", topStoriesUrl, nil)
-	if err != nil {
-		return nil, err
+// story is an item going through the matching pipeline, along with the story lists it was found in.
+type story struct {
+	hnapi.Item
+	Feeds    []string
+	Article  string  // Text of the linked article, if fetched. See enrich.
+	Velocity float64 // Points gained per hour, over the velocityWindow. See velocity.
+
+	titleWords, titleTerms     []string // Lazily computed by words().
+	articleWords, articleTerms []string
+	parsedUrl                  *url.URL // Lazily computed by link().
+}
+
+// link returns the parsed story URL, or nil if the story has no valid link.
+func (s *story) link() *url.URL {
+	if s.parsedUrl == nil && s.Url != "" {
+		u, err := url.Parse(s.Url)
+		if err == nil && u.Host != "" {
+			s.parsedUrl = u
+		}
 	}
-	req.Close = true
+	return s.parsedUrl
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+// words returns the title words, followed by the article words if article is set.
+// They are normalized unless exact is set. See Normalize.
+func (s *story) words(exact, article bool) []string {
+	if s.titleWords == nil {
+		s.titleWords = Keywords(s.Title)
+		s.titleTerms = Normalize(s.titleWords)
+	}
+	if article && s.Article != "" {
+		if s.articleWords == nil {
+			s.articleWords = append(s.titleWords[:len(s.titleWords):len(s.titleWords)], Keywords(s.Article)...)
+			s.articleTerms = Normalize(s.articleWords)
+		}
+		if exact {
+			return s.articleWords
+		}
+		return s.articleTerms
 	}
-	defer resp.Body.Close()
+	if exact {
+		return s.titleWords
+	}
+	return s.titleTerms
+}
 
-	res := struct {
-		Items []int
-	}{}
+// inAny reports whether the story was found in any of the given lists.
+func (s *story) inAny(feeds []string) bool {
+	for _, f := range s.Feeds {
+		for _, feed := range feeds {
+			if f == feed {
+				return true
+			}
+		}
+	}
+	return false
+}
 
-	err = json.NewDecoder(resp.Body).Decode(&res.Items)
-	return res.Items, err
+// listStories reads the given story lists, returning the ids found, without
+// duplicates, along with the lists each id was found in. Lists failing to load
+// are skipped, unless all of them fail.
+func listStories(ctx context.Context, lists []string) ([]int, map[int][]string, error) {
+	var (
+		ids   []int
+		feeds = make(map[int][]string)
+		err   error
+	)
+	for _, feed := range lists {
+		var list []int
+		if list, err = hn.Stories(ctx, feed); err != nil {
+			Logger.Printf("Error reading %s stories: %v\n", feed, err)
+			continue
+		}
+		if len(list) > maxTopStories {
+			list = list[:maxTopStories]
+		}
+		for _, id := range list {
+			if _, ok := feeds[id]; !ok {
+				ids = append(ids, id)
+			}
+			feeds[id] = append(feeds[id], feed)
+		}
+	}
+	if len(ids) == 0 && err != nil {
+		return nil, nil, err
+	}
+	return ids, feeds, nil
 }
 
-// getItem reads the HN story item from the API.
-func getItem(client *http.Client, id int) (item Item, err error) {
-	var req *http.Request
-	req, err = http.NewRequest("GET", fmt.Sprintf(itemUrl, id), nil)
-	if err != nil {
+// process sends the story to the users entitled to receive it, through all of
+// their channels (see deliver). Messages mention the rule that fired. Users
+// receiving digests, or held back by their quiet hours or email caps, get the
+// story queued instead. See runDigests. Either way, the story is added to the
+// users' match history, which their feeds are built from.
+func process(db Store, item *story) {
+	users := db.findUsersForItem(item)
+	if len(users) == 0 {
 		return
 	}
-	req.Close = true
 
-	var resp *http.Response
-	resp, err = client.Do(req)
-	if err != nil {
-		return
+	var (
+		now     = time.Now()
+		sent    []string                // Notified users.
+		queued  = map[string][]string{} // Digest and held users per rule name.
+		matched = map[string][]string{} // Notified and queued users per rule name.
+	)
+	for i := range users {
+		u := &users[i]
+		r := u.matchingRule(item)
+		if r == nil {
+			continue
+		}
+		if u.digest() || u.held(now) {
+			queued[r.Name] = append(queued[r.Name], u.Email)
+			matched[r.Name] = append(matched[r.Name], u.Email)
+			continue
+		}
+		if err := deliver(db, u, itemMessage(item, r.Name)); err != nil {
+			Logger.Printf("Error sending item %d to user %s: %v\n", item.Id, u.Email, err)
+			continue
+		}
+		sent = append(sent, u.Email)
+		matched[r.Name] = append(matched[r.Name], u.Email)
 	}
-	defer resp.Body.Close()
 
-	err = json.NewDecoder(resp.Body).Decode(&item)
-	return item, err
-}
+	if len(sent) > 0 {
+		Logger.Printf("Item %d sent to users: %v\n", item.Id, sent)
+		if err := db.recordSend(sent, now); err != nil {
+			Logger.Println("Error: recordSend() - ", err)
+		}
+		// Update items set.
+		if err := db.updateSentItems(sent, item.Id); err != nil {
+			Logger.Println("Error: updateItems() - ", err)
+		}
+	}
 
-// merge converts a list of channels to a single channel.
-func merge(cs ...chan Item) <-chan Item {
-	var wg sync.WaitGroup
-	out := make(chan Item)
+	for rule, recipients := range queued {
+		if err := db.queueItem(recipients, newQueuedItem(item, rule)); err != nil {
+			Logger.Println("Error: queueItem() - ", err)
+			continue
+		}
+		Logger.Printf("Item %d queued for users: %v (rule %q)\n", item.Id, recipients, rule)
 
-	// Start an output goroutine for each input channel in cs. output
-	// copies values from c to out until c is closed, then calls wg.Done.
-	output := func(c <-chan Item) {
-		for n := range c {
-			out <- n
+		if err := db.updateSentItems(recipients, item.Id); err != nil {
+			Logger.Println("Error: updateItems() - ", err)
 		}
-		wg.Done()
-	}
-	wg.Add(len(cs))
-	for _, c := range cs {
-		go output(c)
 	}
 
-	// Start a goroutine to close out once all the output goroutines are
-	// done. This must start after the wg.Add call.
-	go func() {
-		wg.Wait()
-		close(out)
-	}()
-	return out
+	for rule, recipients := range matched {
+		if err := db.recordMatch(recipients, newQueuedItem(item, rule)); err != nil {
+			Logger.Println("Error: recordMatch() - ", err)
+		}
+	}
 }
@@ -0,0 +1,12 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// TestMain sets up a default configuration, as the tests read no config file.
+func TestMain(m *testing.M) {
+	config = &Config{Url: "http://localhost", aliases: aliasTable(nil)}
+	os.Exit(m.Run())
+}
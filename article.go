@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ichinaski/hnnotifications/hnapi"
+	"golang.org/x/net/html"
+)
+
+const (
+	defaultArticleTimeout  = 10 * time.Second
+	defaultArticleMaxBytes = 1 << 20 // Article bodies are truncated past this size.
+	defaultArticleCache    = 2000    // Cached articles, unless configured.
+
+	maxArticleText = 64 << 10 // Extracted text kept per article.
+)
+
+var (
+	errNotHTML     = errors.New("not an HTML document")
+	errPrivateAddr = errors.New("refusing to connect to a private address")
+
+	articles = newArticleCache() // Shared by all the notifier runs.
+)
+
+// enrich fetches the linked article of the story, if enabled in the config, so
+// that users can match their keywords against its contents. Failures are logged
+// and leave the story without article text.
+func enrich(ctx context.Context, s *story) {
+	if !config.Articles.Enabled || s.Url == "" {
+		return
+	}
+	text, err := articles.get(ctx, s.Url)
+	if err != nil {
+		Logger.Printf("Error fetching article of item %d: %v\n", s.Id, err)
+	}
+	s.Article = text
+}
+
+// enrichItems is the enrichment stage of the notifier run: it turns the fetched
+// items into stories, fetching their articles (see enrich) with the given number
+// of workers. The returned channel is closed once items is drained, or the
+// context is done.
+func enrichItems(ctx context.Context, items <-chan hnapi.Item, feeds map[int][]string, workers int) <-chan *story {
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	out := make(chan *story)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for item := range items {
+				s := &story{Item: item, Feeds: feeds[item.Id]}
+				enrich(ctx, s)
+				select {
+				case out <- s:
+				case <-ctx.Done():
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+// articleCache holds the text extracted from the fetched articles, so that each
+// URL is fetched once. Failures are not cached, and are retried by the next
+// request. Once full, the oldest entries are evicted first.
+type articleCache struct {
+	client *http.Client
+
+	mu      sync.Mutex
+	entries map[string]*articleEntry
+	order   []string // URLs, oldest first.
+}
+
+type articleEntry struct {
+	ready chan struct{} // Closed once text and err are set.
+	text  string
+	err   error
+}
+
+func newArticleCache() *articleCache {
+	return &articleCache{
+		client:  &http.Client{Transport: publicTransport(defaultArticleTimeout)},
+		entries: make(map[string]*articleEntry),
+	}
+}
+
+// publicTransport returns an HTTP transport dialing public addresses only, with the
+// given dial timeout. See publicOnly.
+func publicTransport(timeout time.Duration) *http.Transport {
+	dialer := &net.Dialer{Timeout: timeout, Control: publicOnly}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil // The addresses dialed are checked, so no proxy is to hide them.
+	transport.DialContext = dialer.DialContext
+	return transport
+}
+
+// publicOnly is the Control hook of the public transport dialer. It refuses connections
+// to loopback, private, link-local and unspecified addresses, once resolved, so that
+// story links and channel targets (or their redirects) cannot reach the hosts of the
+// internal network.
+func publicOnly(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return errPrivateAddr
+	}
+	return nil
+}
+
+// get returns the text of the article at url, fetching it unless cached.
+// Concurrent requests for the same url share a single fetch.
+func (c *articleCache) get(ctx context.Context, url string) (string, error) {
+	c.mu.Lock()
+	e, ok := c.entries[url]
+	if !ok {
+		e = &articleEntry{ready: make(chan struct{})}
+		c.entries[url] = e
+		c.order = append(c.order, url)
+		for len(c.order) > config.Articles.cacheSize() {
+			delete(c.entries, c.order[0])
+			c.order = c.order[1:]
+		}
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		e.text, e.err = c.fetch(ctx, url)
+		if e.err != nil {
+			c.drop(url, e)
+		}
+		close(e.ready)
+	}
+	select {
+	case <-e.ready:
+		return e.text, e.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// drop removes the entry of url from the cache, unless already replaced.
+func (c *articleCache) drop(url string, e *articleEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries[url] != e {
+		return // Evicted already.
+	}
+	delete(c.entries, url)
+	for i, u := range c.order {
+		if u == url {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// fetch downloads the article at url, and extracts its readable text.
+func (c *articleCache) fetch(ctx context.Context, url string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.Articles.timeout())
+	defer cancel()
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", "HN Notifications ("+config.Url+")")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "" && !strings.Contains(ct, "html") {
+		return "", errNotHTML
+	}
+	return extractText(io.LimitReader(resp.Body, config.Articles.maxBytes()))
+}
+
+// extractText pulls the readable text out of an HTML document: the title, the
+// meta description and the body text, skipping scripts, styles, navigation and
+// other page furniture. If the page has an <article> or <main> element, only its
+// text is taken from the body.
+func extractText(r io.Reader) (string, error) {
+	var (
+		title, description string
+		body, main         strings.Builder
+		skip               int // Depth inside skipped elements.
+		inMain             int // Depth inside <article> or <main>.
+		inTitle            bool
+	)
+
+	z := html.NewTokenizer(r)
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			if err := z.Err(); err != io.EOF {
+				return "", err
+			}
+			text := strings.Join([]string{title, description, body.String()}, "\n")
+			if main.Len() > 0 {
+				text = strings.Join([]string{title, description, main.String()}, "\n")
+			}
+			if len(text) > maxArticleText {
+				n := maxArticleText
+				for n > 0 && !utf8.RuneStart(text[n]) {
+					n-- // Keep the last rune whole.
+				}
+				text = text[:n]
+			}
+			return text, nil
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			switch string(name) {
+			case "script", "style", "noscript", "nav", "header", "footer", "aside", "form", "svg":
+				if tt == html.StartTagToken {
+					skip++
+				}
+			case "article", "main":
+				inMain++
+			case "title":
+				inTitle = true
+			case "meta":
+				var key, val []byte
+				attrs := make(map[string]string)
+				for hasAttr {
+					key, val, hasAttr = z.TagAttr()
+					attrs[string(key)] = string(val)
+				}
+				if n := attrs["name"]; n == "description" || attrs["property"] == "og:description" {
+					if description == "" {
+						description = attrs["content"]
+					}
+				}
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "script", "style", "noscript", "nav", "header", "footer", "aside", "form", "svg":
+				if skip > 0 {
+					skip--
+				}
+			case "article", "main":
+				if inMain > 0 {
+					inMain--
+				}
+			case "title":
+				inTitle = false
+			}
+		case html.TextToken:
+			text := strings.TrimSpace(string(z.Text()))
+			switch {
+			case text == "":
+			case inTitle:
+				title += text
+			case skip == 0:
+				body.WriteString(text)
+				body.WriteByte(' ')
+				if inMain > 0 {
+					main.WriteString(text)
+					main.WriteByte(' ')
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,200 @@
+// Command hnstub is a local stand-in for the Hacker News Firebase API, meant for
+// testing the notifier without hitting the real service. It serves a fixed set of
+// fake stories whose scores grow over time, both through plain JSON requests and
+// through Server-Sent Events streams (Accept: text/event-stream).
+//
+// Point the "apiUrl" config setting at it, e.g. "http://localhost:3001/v0".
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxUpdated = 100 // Changed items listed by updates.json.
+
+var (
+	addr     = flag.String("addr", ":3001", "listen address")
+	count    = flag.Int("stories", 30, "number of fake stories")
+	interval = flag.Duration("interval", 10*time.Second, "interval between score updates")
+)
+
+// item mirrors the fields of a HN API item.
+type item struct {
+	By          string `json:"by"`
+	Descendants int    `json:"descendants"`
+	Id          int    `json:"id"`
+	Score       int    `json:"score"`
+	Time        int64  `json:"time"`
+	Title       string `json:"title"`
+	Type        string `json:"type"`
+	Url         string `json:"url"`
+}
+
+// stub holds the fake stories, and the subscribers of the update events.
+type stub struct {
+	sync.Mutex
+	items       map[int]*item
+	top         []int
+	updated     []int // Recently changed items, newest last.
+	subscribers map[chan []int]bool
+}
+
+func newStub(n int) *stub {
+	words := []string{"go", "rust", "postgres", "release", "show", "hn", "database", "compiler", "startup", "linux"}
+	s := &stub{
+		items:       make(map[int]*item),
+		subscribers: make(map[chan []int]bool),
+	}
+	for i := 0; i < n; i++ {
+		id := 1000 + i
+		s.items[id] = &item{
+			By:    fmt.Sprintf("user%d", i),
+			Id:    id,
+			Score: rand.Intn(50),
+			Time:  time.Now().Unix(),
+			Title: fmt.Sprintf("Story %d about %s and %s", i, words[rand.Intn(len(words))], words[rand.Intn(len(words))]),
+			Type:  "story",
+			Url:   fmt.Sprintf("http://example.com/%d", id),
+		}
+		s.top = append(s.top, id)
+	}
+	return s
+}
+
+// bump increases the score of a few random stories, and notifies the subscribers.
+func (s *stub) bump() {
+	s.Lock()
+	defer s.Unlock()
+
+	var changed []int
+	for i := 0; i < 3; i++ {
+		it := s.items[s.top[rand.Intn(len(s.top))]]
+		it.Score += rand.Intn(100)
+		it.Descendants += rand.Intn(10)
+		changed = append(changed, it.Id)
+	}
+	s.updated = append(s.updated, changed...)
+	if len(s.updated) > maxUpdated {
+		s.updated = s.updated[len(s.updated)-maxUpdated:]
+	}
+	for c := range s.subscribers {
+		select {
+		case c <- changed:
+		default: // Slow subscriber. Drop the update.
+		}
+	}
+}
+
+func (s *stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v0")
+	switch {
+	case path == "/topstories.json":
+		s.Lock()
+		top := append([]int(nil), s.top...)
+		s.Unlock()
+		if isStream(r) {
+			s.stream(w, top, nil)
+		} else {
+			json.NewEncoder(w).Encode(top)
+		}
+	case path == "/updates.json":
+		if isStream(r) {
+			s.stream(w, map[string][]int{"items": {}}, func(ids []int) interface{} {
+				return map[string][]int{"items": ids}
+			})
+		} else {
+			s.Lock()
+			updated := append([]int{}, s.updated...)
+			s.Unlock()
+			json.NewEncoder(w).Encode(map[string][]int{"items": updated})
+		}
+	case strings.HasPrefix(path, "/item/"):
+		id, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(path, "/item/"), ".json"))
+		s.Lock()
+		defer s.Unlock()
+		json.NewEncoder(w).Encode(s.items[id]) // Unknown items are encoded as null, as the real API does.
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// stream writes the initial data as a 'put' event, followed by a 'put' event built
+// by update for every change, if not nil. Otherwise, only keep-alive events follow.
+func (s *stub) stream(w http.ResponseWriter, initial interface{}, update func(ids []int) interface{}) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+
+	put := func(data interface{}) error {
+		b, err := json.Marshal(map[string]interface{}{"path": "/", "data": data})
+		if err != nil {
+			return err
+		}
+		if _, err = fmt.Fprintf(w, "event: put\ndata: %s\n\n", b); err == nil {
+			f.Flush()
+		}
+		return err
+	}
+	if put(initial) != nil {
+		return
+	}
+
+	c := make(chan []int, 10)
+	s.Lock()
+	s.subscribers[c] = true
+	s.Unlock()
+	defer func() {
+		s.Lock()
+		delete(s.subscribers, c)
+		s.Unlock()
+	}()
+
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case ids := <-c:
+			if update != nil {
+				err = put(update(ids))
+			}
+		case <-keepAlive.C:
+			if _, err = fmt.Fprint(w, "event: keep-alive\ndata: null\n\n"); err == nil {
+				f.Flush()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func isStream(r *http.Request) bool {
+	return r.Header.Get("Accept") == "text/event-stream"
+}
+
+func main() {
+	flag.Parse()
+
+	s := newStub(*count)
+	go func() {
+		for range time.Tick(*interval) {
+			s.bump()
+		}
+	}()
+
+	log.Printf("Listening on %s...\n", *addr)
+	log.Fatal(http.ListenAndServe(*addr, s))
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ichinaski/hnnotifications/hnapi"
+)
+
+const (
+	maxThreads       = 20                  // Watched threads per user.
+	maxUserItems     = 30                  // Most recent items of each username checked for replies.
+	maxCrawled       = 5000                // Items fetched per comments job run.
+	maxExcerpt       = 200                 // Characters of the comment text sent along with the alerts.
+	commentInterval  = 10 * time.Minute    // Interval at which the comments job crawls the watched threads.
+	commentRetention = 30 * 24 * time.Hour // Age of the seen comment records dropped. Older comments are ignored.
+)
+
+// Comment alert reasons, shown in place of the rule name.
+const (
+	reasonReply   = "reply to your comment"
+	reasonMention = "mention of your username"
+	reasonThread  = "watched thread"
+)
+
+// CommentWatch holds the comment alerts of a user, besides the story rules.
+type CommentWatch struct {
+	Username string          `bson:"username"` // HN username of the user.
+	Replies  bool            `bson:"replies"`  // Alert on the replies to the Username items.
+	Mentions bool            `bson:"mentions"` // Alert on the crawled comments mentioning Username.
+	Since    time.Time       `bson:"since"`    // Time Username was set. Older comments are not sent.
+	Threads  []WatchedThread `bson:"threads"`  // Stories whose new comments are sent.
+	Keywords string          `bson:"keywords"` // Query (see query.go) matched against the comments of the Threads. Empty means any.
+}
+
+// WatchedThread is a story watched by a user.
+type WatchedThread struct {
+	Id    int       `bson:"id"`
+	Since time.Time `bson:"since"` // Time the thread was added. Older comments are not sent.
+}
+
+// active reports whether there is anything to look for.
+func (w *CommentWatch) active() bool {
+	return w.Username != "" && (w.Replies || w.Mentions) || len(w.Threads) > 0
+}
+
+// thread returns the watched thread of the given story, or nil if not watched.
+func (w *CommentWatch) thread(id int) *WatchedThread {
+	for i := range w.Threads {
+		if w.Threads[i].Id == id {
+			return &w.Threads[i]
+		}
+	}
+	return nil
+}
+
+// startedAt returns a copy of w, replacing the previous watch at the given time.
+// The username and the threads already watched keep their start times.
+func (w CommentWatch) startedAt(prev *CommentWatch, now time.Time) CommentWatch {
+	w.Since = now
+	if w.Username == prev.Username && !prev.Since.IsZero() {
+		w.Since = prev.Since
+	}
+	threads := make([]WatchedThread, len(w.Threads))
+	for i, t := range w.Threads {
+		t.Since = now
+		if old := prev.thread(t.Id); old != nil {
+			t.Since = old.Since
+		}
+		threads[i] = t
+	}
+	w.Threads = threads
+	return w
+}
+
+// alert returns the reason the comment is sent to the user, or "" if it is not.
+// Replies and mentions take precedence over the watched threads.
+func (w *CommentWatch) alert(c *crawl, comment *hnapi.Item) string {
+	if w.Username != "" && comment.By == w.Username {
+		return "" // Own comment.
+	}
+	posted := time.Unix(comment.Time, 0)
+	if w.Username != "" && posted.After(w.Since) {
+		if parent := c.items[comment.Parent]; w.Replies && parent != nil && parent.By == w.Username {
+			return reasonReply
+		}
+		if w.Mentions && mentions(commentText(comment.Text), w.Username) {
+			return reasonMention
+		}
+	}
+	if t := w.thread(c.roots[comment.Id]); t != nil && posted.After(t.Since) {
+		if w.Keywords == "" || compileQuery(w.Keywords, false).eval(Normalize(Keywords(commentText(comment.Text)))) {
+			return reasonThread
+		}
+	}
+	return ""
+}
+
+// tagPattern matches the HTML tags of the comment bodies.
+var tagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// commentText returns the plain text of an HTML comment body.
+func commentText(body string) string {
+	body = strings.Replace(body, "<p>", "\n", -1)
+	return html.UnescapeString(tagPattern.ReplaceAllString(body, ""))
+}
+
+// mentions reports whether the text mentions the username, optionally prefixed
+// with "@". Case is ignored.
+func mentions(text, username string) bool {
+	re, err := regexp.Compile(`(?i)(^|[^\w-])@?` + regexp.QuoteMeta(username) + `($|[^\w-])`)
+	return err == nil && re.MatchString(text)
+}
+
+// excerpt returns the beginning of the text, up to maxExcerpt characters, with
+// its whitespace collapsed.
+func excerpt(text string) string {
+	s := []rune(strings.Join(strings.Fields(text), " "))
+	if len(s) > maxExcerpt {
+		s = append(s[:maxExcerpt-1], '…')
+	}
+	return string(s)
+}
+
+// commentMessage creates the alert of the comment, sent for the given reason.
+// root is the crawled root of the comment, if known.
+func commentMessage(comment, root *hnapi.Item, reason string) *Message {
+	var subject string
+	switch {
+	case reason == reasonReply:
+		subject = fmt.Sprintf("%s replied to your comment", comment.By)
+	case reason == reasonMention:
+		subject = fmt.Sprintf("%s mentioned you", comment.By)
+	case root != nil && root.Title != "":
+		subject = fmt.Sprintf("New comment by %s on \"%s\"", comment.By, root.Title)
+	default:
+		subject = fmt.Sprintf("New comment by %s in a watched thread", comment.By)
+	}
+	item := QueuedItem{Id: comment.Id, Title: subject, Rule: reason, QueuedAt: time.Now()}
+	return &Message{Kind: msgComment, Subject: subject, Items: []QueuedItem{item}, Text: excerpt(commentText(comment.Text))}
+}
+
+// crawl holds the items fetched by a comments job run.
+type crawl struct {
+	items  map[int]*hnapi.Item // Fetched items, the crawled roots included.
+	roots  map[int]int         // Crawled root of each fetched item.
+	budget int                 // Items left to fetch.
+	failed int                 // Items failing to fetch.
+}
+
+func newCrawl(budget int) *crawl {
+	return &crawl{
+		items:  make(map[int]*hnapi.Item),
+		roots:  make(map[int]int),
+		budget: budget,
+	}
+}
+
+// fetch fetches the given roots and their comments (see fetchItems), level by level,
+// down to the given depth below the roots, or the whole tree if negative. Items
+// fetched before are skipped, along with their comments. It stops once the budget
+// is exhausted.
+func (c *crawl) fetch(ctx context.Context, roots []int, depth int) {
+	root := make(map[int]int) // Root of the items of the next level.
+	for _, id := range roots {
+		root[id] = id
+	}
+	ids := roots
+	for level := 0; len(ids) > 0 && (depth < 0 || level <= depth) && ctx.Err() == nil; level++ {
+		var todo []int
+		for _, id := range ids {
+			if _, ok := c.items[id]; !ok && len(todo) < c.budget {
+				todo = append(todo, id)
+			}
+		}
+		c.budget -= len(todo)
+
+		items, failed := fetchLogged(ctx, todo, config.Workers)
+		ids = nil
+		for item := range items {
+			item := item
+			c.items[item.Id] = &item
+			c.roots[item.Id] = root[item.Id]
+			for _, kid := range item.Kids {
+				root[kid] = root[item.Id]
+				ids = append(ids, kid)
+			}
+		}
+		c.failed += <-failed
+	}
+}
+
+// runComments crawls the threads watched by the users, and the comment trees of
+// their recent items for replies and mentions, alerting them of the new comments.
+// Comments are handled once: the ones seen by a previous run are skipped.
+func runComments(ctx context.Context) error {
+	db := openStore()
+	defer db.close()
+
+	users, err := db.findWatchers()
+	if err != nil {
+		return err
+	}
+	if len(users) == 0 {
+		return nil
+	}
+
+	var (
+		threads   []int
+		usernames []string
+	)
+	for i := range users {
+		w := &users[i].Watch
+		for _, t := range w.Threads {
+			if !containsInt(threads, t.Id) {
+				threads = append(threads, t.Id)
+			}
+		}
+		if w.Username != "" && (w.Replies || w.Mentions) && !contains(usernames, w.Username) {
+			usernames = append(usernames, w.Username)
+		}
+	}
+
+	c := newCrawl(maxCrawled)
+	c.fetch(ctx, threads, -1)
+	var submitted []int
+	for _, name := range usernames {
+		hu, err := hn.User(ctx, name)
+		if err != nil {
+			Logger.Printf("Error reading HN user %s: %v\n", name, err)
+			continue
+		}
+		if len(hu.Submitted) > maxUserItems {
+			hu.Submitted = hu.Submitted[:maxUserItems]
+		}
+		submitted = append(submitted, hu.Submitted...)
+	}
+	c.fetch(ctx, submitted, 1)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if c.failed > 0 {
+		Logger.Printf("Failed to fetch %d comment thread items\n", c.failed)
+	}
+
+	var ids []int
+	cutoff := time.Now().Add(-commentRetention)
+	for id, item := range c.items {
+		if item.Type == hnapi.CommentType && !item.Deleted && !item.Dead && time.Unix(item.Time, 0).After(cutoff) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids) // Oldest first.
+	seen, err := db.seenComments(ids)
+	if err != nil {
+		return err
+	}
+	known := make(map[int]bool, len(seen))
+	for _, id := range seen {
+		known[id] = true
+	}
+
+	var (
+		now    = time.Now()
+		unseen []int
+	)
+	for _, id := range ids {
+		if known[id] {
+			continue
+		}
+		unseen = append(unseen, id)
+		comment := c.items[id]
+		for i := range users {
+			u := &users[i]
+			if reason := u.Watch.alert(c, comment); reason != "" {
+				notifyAlert(db, u, commentMessage(comment, c.items[c.roots[id]], reason), now)
+			}
+		}
+	}
+	if err := db.markSeen(unseen, now); err != nil {
+		return err
+	}
+	Logger.Printf("Comments crawled: %d items, %d new comments\n", len(c.items), len(unseen))
+	return nil
+}
+
+// notifyAlert sends the alert (a comment, or an item of a followed account) to the
+// user through all of their channels, or queues it for users receiving digests, or
+// held back. It reports whether the alert was either sent or queued.
+func notifyAlert(db Store, u *User, m *Message, now time.Time) bool {
+	item := m.Items[0]
+	if u.digest() || u.held(now) {
+		if err := db.queueItem([]string{u.Email}, item); err != nil {
+			Logger.Println("Error: queueItem() - ", err)
+			return false
+		}
+		Logger.Printf("Item %d queued for user %s (%s)\n", item.Id, u.Email, item.Rule)
+		return true
+	}
+	if err := deliver(db, u, m); err != nil {
+		Logger.Printf("Error sending item %d to user %s: %v\n", item.Id, u.Email, err)
+		return false
+	}
+	Logger.Printf("Item %d sent to user %s (%s)\n", item.Id, u.Email, item.Rule)
+	if err := db.recordSend([]string{u.Email}, now); err != nil {
+		Logger.Println("Error: recordSend() - ", err)
+	}
+	u.Sends = append(u.Sends, now) // For the email caps of the alerts to come.
+	return true
+}
@@ -3,6 +3,17 @@ package main
 import (
 	"encoding/json"
 	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/ichinaski/hnnotifications/hnapi"
+)
+
+const (
+	defaultRunInterval = 15 * time.Minute // Interval at which we fetch the items, unless configured.
+
+	fetcherPoll   = "poll"   // Fetch the top stories every Interval.
+	fetcherStream = "stream" // Follow the Firebase event streams, polling only while they are down.
 )
 
 // SMTPServer represents the SMTP configuration details.
@@ -13,13 +24,38 @@ type SMTPServer struct {
 	Password string `json:"pass"`
 }
 
+// ArticleConfig configures the fetching of the linked articles. See enrich.
+type ArticleConfig struct {
+	Enabled   bool   `json:"enabled"`
+	Timeout   string `json:"timeout"`   // Article request timeout, e.g. "10s". Defaults to 10 seconds.
+	MaxBytes  int64  `json:"maxBytes"`  // Bytes read per article. Defaults to 1MB.
+	CacheSize int    `json:"cacheSize"` // Articles kept in the cache. Defaults to 2000.
+}
+
 // Config represents the configuration information.
 type Config struct {
-	Url    string     `json:"url"`
-	Addr   string     `json:"addr"`
-	Email  string     `json:"email"`
-	SMTP   SMTPServer `json:"smtp"`
-	DBAddr string     `json:"dbAddr"`
+	Url      string     `json:"url"`
+	Addr     string     `json:"addr"`
+	Email    string     `json:"email"`
+	SMTP     SMTPServer `json:"smtp"`
+	DBAddr   string     `json:"dbAddr"`
+	Interval string     `json:"interval"`   // Notifier run interval, e.g. "15m". Defaults to 15 minutes.
+	Fetcher  string     `json:"fetcher"`    // Either "poll" (default) or "stream".
+	APIUrl   string     `json:"apiUrl"`     // HN API base URL. Defaults to the official Firebase API.
+	APIRate  int        `json:"apiRate"`    // Maximum HN API requests per second. Zero means no limit.
+	Timeout  string     `json:"apiTimeout"` // HN API request timeout, e.g. "10s".
+	Workers  int        `json:"workers"`    // Maximum concurrent item fetches. Defaults to 10.
+	Feeds    []string   `json:"feeds"`      // Story lists fetched by the poller. Defaults to all of them.
+
+	// Stored items. See unchangedItems.
+	Refresh   string `json:"itemRefresh"`   // Age up to which items not listed as updated are not re-fetched, e.g. "1h". Empty means always fetch.
+	Retention string `json:"itemRetention"` // Age of the stored items and snapshots dropped, e.g. "168h". Defaults to a week.
+
+	// Synonyms maps canonical terms to their aliases (e.g. "go": ["golang"]), on top of defaultSynonyms.
+	Synonyms map[string][]string `json:"synonyms"`
+	aliases  map[string]string   // Alias to canonical term lookup table, built from Synonyms.
+
+	Articles ArticleConfig `json:"articles"` // Linked article fetching, for the users matching against them.
 }
 
 // loadConfig reads the config file and returns the parsed Config.
@@ -34,5 +70,112 @@ func loadConfig() *Config {
 	if err = json.Unmarshal(config_file, &conf); err != nil {
 		Logger.Fatalf("Error loading config file: %v\n", err)
 	}
+	if conf.APIUrl == "" {
+		conf.APIUrl = hnapi.DefaultBaseURL
+	}
+	conf.APIUrl = strings.TrimSuffix(conf.APIUrl, "/")
+	switch conf.Fetcher {
+	case "":
+		conf.Fetcher = fetcherPoll
+	case fetcherPoll, fetcherStream:
+	default:
+		Logger.Fatalf("Error loading config file: invalid fetcher %q\n", conf.Fetcher)
+	}
+	conf.aliases = aliasTable(conf.Synonyms)
+	if len(conf.Feeds) == 0 {
+		conf.Feeds = hnapi.Feeds
+	}
+	for _, feed := range conf.Feeds {
+		if !validFeed(feed) {
+			Logger.Fatalf("Error loading config file: invalid feed %q\n", feed)
+		}
+	}
+	if conf.Interval != "" {
+		if d, err := time.ParseDuration(conf.Interval); err != nil || d <= 0 {
+			Logger.Fatalf("Error loading config file: invalid interval %q\n", conf.Interval)
+		}
+	}
+	if conf.Timeout != "" {
+		if d, err := time.ParseDuration(conf.Timeout); err != nil || d <= 0 {
+			Logger.Fatalf("Error loading config file: invalid apiTimeout %q\n", conf.Timeout)
+		}
+	}
+	if conf.Refresh != "" {
+		if d, err := time.ParseDuration(conf.Refresh); err != nil || d <= 0 {
+			Logger.Fatalf("Error loading config file: invalid itemRefresh %q\n", conf.Refresh)
+		}
+	}
+	if conf.Retention != "" {
+		if d, err := time.ParseDuration(conf.Retention); err != nil || d <= 0 {
+			Logger.Fatalf("Error loading config file: invalid itemRetention %q\n", conf.Retention)
+		}
+	}
+	if conf.Articles.Timeout != "" {
+		if d, err := time.ParseDuration(conf.Articles.Timeout); err != nil || d <= 0 {
+			Logger.Fatalf("Error loading config file: invalid articles timeout %q\n", conf.Articles.Timeout)
+		}
+	}
 	return &conf
 }
+
+// RunInterval returns the configured notifier interval.
+func (c *Config) RunInterval() time.Duration {
+	if d, err := time.ParseDuration(c.Interval); err == nil {
+		return d
+	}
+	return defaultRunInterval
+}
+
+// APITimeout returns the configured HN API request timeout.
+func (c *Config) APITimeout() time.Duration {
+	if d, err := time.ParseDuration(c.Timeout); err == nil {
+		return d
+	}
+	return hnapi.DefaultTimeout
+}
+
+// ItemRefresh returns the configured age up to which unchanged items are not re-fetched.
+// Zero means items are always fetched.
+func (c *Config) ItemRefresh() time.Duration {
+	if d, err := time.ParseDuration(c.Refresh); err == nil {
+		return d
+	}
+	return 0
+}
+
+// ItemRetention returns the configured age of the stored items dropped.
+func (c *Config) ItemRetention() time.Duration {
+	if d, err := time.ParseDuration(c.Retention); err == nil {
+		return d
+	}
+	return defaultItemRetention
+}
+
+// timeout returns the configured article request timeout.
+func (c *ArticleConfig) timeout() time.Duration {
+	if d, err := time.ParseDuration(c.Timeout); err == nil {
+		return d
+	}
+	return defaultArticleTimeout
+}
+
+// maxBytes returns the configured article size limit.
+func (c *ArticleConfig) maxBytes() int64 {
+	if c.MaxBytes > 0 {
+		return c.MaxBytes
+	}
+	return defaultArticleMaxBytes
+}
+
+// cacheSize returns the configured article cache size.
+func (c *ArticleConfig) cacheSize() int {
+	if c.CacheSize > 0 {
+		return c.CacheSize
+	}
+	return defaultArticleCache
+}
+
+// validFeed reports whether feed is one of hnapi.Feeds.
+func validFeed(feed string) bool {
+	return contains(hnapi.Feeds, feed)
+}
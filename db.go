@@ -1,230 +1,383 @@
 package main
 
 import (
+	"fmt"
+	"strings"
 	"time"
 
-	"labix.org/v2/mgo"
+	"github.com/ichinaski/hnnotifications/hnapi"
 	"labix.org/v2/mgo/bson"
 )
 
+const defaultRule = "default" // Name of the rule created along with the subscription, unless named.
+
 var (
-	session *mgo.Session // Though global, this session is meant to be copied for each database instance.
+	openStore func() Store // Store factory, set up by initDb().
 )
 
-// initDb sets up the DB configuration. Panics upon error.
+// initDb sets up the storage backend, picked by the scheme of the DBAddr URL:
+// "sqlite:///path/to/file.db", "memory://" or "mongodb://host[:port]". A plain
+// "memory" is accepted too. Addresses without a scheme are assumed to be MongoDB
+// hosts. Panics upon error.
 func initDb() {
-	var err error
-	session, err = mgo.Dial(config.DBAddr)
-	if err != nil {
-		panic(err)
+	var scheme, path string
+	if i := strings.Index(config.DBAddr, "://"); i != -1 {
+		scheme, path = config.DBAddr[:i], config.DBAddr[i+3:]
+	} else if config.DBAddr == "memory" {
+		scheme = "memory"
 	}
-	Logger.Println("Connected to MongoDB")
 
-	session.EnsureSafe(&mgo.Safe{})
+	switch scheme {
+	case "sqlite":
+		s, err := openSQLite(path)
+		if err != nil {
+			panic(err)
+		}
+		openStore = func() Store { return s }
+		Logger.Println("Using SQLite store:", path)
+	case "memory":
+		ms := newMemoryStore()
+		openStore = func() Store { return ms }
+		Logger.Println("Using in-memory store")
+	case "mongodb", "":
+		initMongo()
+		openStore = func() Store { return newDatabase() }
+	default:
+		panic(fmt.Sprintf("Unsupported database scheme: %s", scheme))
+	}
+}
 
-	db := newDatabase()
-	defer db.close()
+// Id identifies users, runs and webhook deliveries in every storage backend. Ids are
+// generated as hex encoded MongoDB ObjectIds, which the Mongo store keeps as such.
+type Id string
 
-	// ensure indexes
-	if err := db.users.EnsureIndex(mgo.Index{
-		Key:    []string{"email"},
-		Unique: true,
-	}); err != nil {
-		panic(err)
-	}
+// newId returns a new unique Id.
+func newId() Id {
+	return Id(bson.NewObjectId().Hex())
+}
 
-	if err := db.users.EnsureIndex(mgo.Index{
-		Key:    []string{"email", "token"},
-		Unique: true,
-	}); err != nil {
-		panic(err)
-	}
+// Hex returns the hex representation of the id.
+func (id Id) Hex() string {
+	return string(id)
+}
+
+// Store is the interface implemented by the storage backends.
+type Store interface {
+	// upsertUser inserts/updates a user into the store.
+	upsertUser(u *User) error
+	// validate checks whether the user and token pair is valid, returning the user if found.
+	validate(email, token string) *User
+	// activate sets the account status to 'active'.
+	activate(email, token string) bool
+	// unsubscribe completely removes the user account from the store.
+	unsubscribe(email, token string) bool
+	// deleteUser completely removes the user account from the store. See unsubscribe.
+	deleteUser(uid Id) error
+	// saveRule validates the user, adds the rule, replacing any rule with the same name,
+	// and updates the delivery preferences, unless d is nil.
+	saveRule(email, token string, rule Rule, d *Delivery) bool
+	// saveUserRule adds the rule to the user, replacing any rule with the same name, and
+	// updates the delivery preferences, unless d is nil. See saveRule.
+	saveUserRule(uid Id, rule Rule, d *Delivery) error
+	// deleteRule validates the user and removes the named rule.
+	deleteRule(email, token, name string) bool
+	// deleteUserRule removes the named rule from the user.
+	deleteUserRule(uid Id, name string) error
+	// findUsersForItem queries all users entitled to receive a given story.
+	findUsersForItem(s *story) []User
+	// addChannel validates the user and adds the (unverified) channel, activating the account.
+	addChannel(email, token string, c Channel) bool
+	// addUserChannel adds the (unverified) channel to the user.
+	addUserChannel(uid Id, c Channel) error
+	// deleteChannel validates the user and removes the channel with the given id, along
+	// with its pending webhook deliveries.
+	deleteChannel(email, token, id string) bool
+	// deleteUserChannel removes the user channel with the given id, along with its
+	// pending webhook deliveries.
+	deleteUserChannel(uid Id, id string) error
+	// verifyChannel marks the user channel as verified, if the verification token matches.
+	verifyChannel(email, id, token string) bool
+	// savePendingChannel replaces the channel of the user awaiting the confirmation link.
+	savePendingChannel(uid Id, c Channel) error
+	// takePendingChannel removes and returns the channel of the user awaiting the
+	// confirmation link, if its id matches.
+	takePendingChannel(uid Id, id string) (*Channel, bool)
+	// updateSentItems adds the given item to each user's item set.
+	updateSentItems(emails []string, item int) error
+	// queueItem adds the given item to each user's queue, for digests and held items.
+	queueItem(emails []string, item QueuedItem) error
+	// findQueuedUsers queries the active users with queued items.
+	findQueuedUsers() ([]User, error)
+	// clearQueue removes the given items from the user's queue, recording the digest time.
+	clearQueue(uid Id, ids []int, at time.Time) error
+	// recordSend records an email sent to each user at the given time, for the email caps.
+	// Records older than a day are dropped.
+	recordSend(emails []string, at time.Time) error
+	// recordMatch adds the given item to each user's match history, unless already there.
+	// Only the last maxHistory items are kept.
+	recordMatch(emails []string, item QueuedItem) error
+	// findHistory queries the most recently matched items of the user, newest first.
+	findHistory(uid Id, limit int) ([]QueuedItem, error)
+	// setFeedToken validates the user and assigns the feed token, activating the account.
+	setFeedToken(email, token, feedToken string) bool
+	// findFeedUser queries a user by its feed token.
+	findFeedUser(feedToken string) (*User, bool)
+	// saveWatch validates the user and replaces its comment watch, activating the account.
+	saveWatch(email, token string, w CommentWatch) bool
+	// findWatchers queries the active users watching comments.
+	findWatchers() ([]User, error)
+	// seenComments returns which of the given comments were seen before.
+	seenComments(ids []int) ([]int, error)
+	// markSeen records the given comments as seen at the given time. Records older
+	// than commentRetention are dropped.
+	markSeen(ids []int, at time.Time) error
+	// saveFollowing validates the user and replaces the followed accounts, activating the account.
+	saveFollowing(email, token string, usernames []string) bool
+	// findFollowers queries the active users following any account.
+	findFollowers() ([]User, error)
+	// lastSubmissions returns the newest item seen of each followed account.
+	lastSubmissions() (map[string]int, error)
+	// saveSubmissions replaces the newest item seen of the followed accounts. Accounts
+	// left out are dropped.
+	saveSubmissions(last map[string]int) error
+	// saveWatchedItem adds the watched story to the user, or updates it if already watched.
+	saveWatchedItem(uid Id, w WatchedItem) error
+	// deleteWatchedItem removes the watched story from the user.
+	deleteWatchedItem(uid Id, id int) error
+	// findWatching queries the active users watching any story.
+	findWatching() ([]User, error)
+	// saveAPIToken adds the API token to the user.
+	saveAPIToken(uid Id, t APIToken) error
+	// deleteAPIToken removes the API token with the given id from the user.
+	deleteAPIToken(uid Id, id string) error
+	// touchAPIToken records the last use of the user API token with the given id.
+	touchAPIToken(uid Id, id string, at time.Time) error
+	// findTokenUser queries a user by the hash of one of its API tokens.
+	findTokenUser(hash string) (*User, bool)
+	// saveItem stores the latest metadata of the item, fetched at the given time, and
+	// records its score and comment count.
+	saveItem(item *hnapi.Item, at time.Time) error
+	// saveSnapshot records the score and comment count of the stored item, leaving the
+	// item itself, and its fetch time, untouched.
+	saveSnapshot(id int, s Snapshot) error
+	// findItems queries the stored items with the given ids, without their snapshots.
+	findItems(ids []int) ([]StoredItem, error)
+	// findSnapshots queries the snapshots of the item taken since the given time, oldest first.
+	findSnapshots(id int, since time.Time) ([]Snapshot, error)
+	// pruneItems removes the items last fetched before the given time, and the snapshots
+	// taken before then.
+	pruneItems(before time.Time) error
+	// saveDelivery inserts/updates a webhook delivery.
+	saveDelivery(d *WebhookDelivery) error
+	// dueDeliveries queries the pending webhook deliveries due for a retry at the given time.
+	dueDeliveries(now time.Time) ([]WebhookDelivery, error)
+	// findDeliveries queries the most recent webhook deliveries of the user, newest first.
+	findDeliveries(uid Id, limit int) ([]WebhookDelivery, error)
+	// pruneDeliveries removes the finished webhook deliveries last attempted before the given time.
+	pruneDeliveries(before time.Time) error
+	// updateToken assigns the new token to the user.
+	updateToken(uid Id, token string) error
+	// findUser queries a user by its email field.
+	findUser(email string) (*User, bool)
+	// saveRun inserts/updates a scheduler run.
+	saveRun(r *Run) error
+	// lastRun returns the most recently started run of the given job.
+	lastRun(job string) (*Run, bool)
+	// close releases the resources held by the Store.
+	close()
+}
+
+// Rule is a named set of criteria. A user receives the items matching any of their rules.
+type Rule struct {
+	Name     string `bson:"name"`
+	Settings `bson:",inline"`
+}
+
+// Settings holds the criteria an item must meet to be sent to a user.
+type Settings struct {
+	Score    int      `bson:"score"`    // Minimum score for an item to be sent.
+	Velocity int      `bson:"velocity"` // Points per hour for an item to be sent below Score. Zero means off. See story.Velocity.
+	Query    string   `bson:"query"`    // Keyword query (see query.go) matched against the titles. Empty means any.
+	Keywords []string `bson:"keywords"` // Legacy keyword list, matching any of them. Superseded by Query.
+	Exact    bool     `bson:"exact"`    // Match the exact words, instead of their stems and synonyms.
+	Article  bool     `bson:"article"`  // Match the linked article text too, not just the title.
+	Feeds    []string `bson:"feeds"`    // Story lists watched (see hnapi.Feeds). Empty means top stories only.
+
+	Types       []string `bson:"types"`       // Item types (story, job, poll). Empty means any.
+	Authors     []string `bson:"authors"`     // HN usernames of the authors. Empty means anyone.
+	MaxAge      int      `bson:"maxAge"`      // Maximum item age, in hours. Zero means no limit.
+	MinComments int      `bson:"minComments"` // Minimum comment count.
+
+	Domains        []string `bson:"domains"`        // Domain rules (see domains.go) of the stories sent regardless of their keywords.
+	BlockedDomains []string `bson:"blockedDomains"` // Domain rules of the stories never sent.
+}
 
-	if err := db.users.EnsureIndex(mgo.Index{
-		Key: []string{"score", "sentItems", "active"},
-	}); err != nil {
-		panic(err)
+// feeds returns the story lists watched.
+func (s *Settings) feeds() []string {
+	if len(s.Feeds) == 0 {
+		return []string{hnapi.Top}
 	}
+	return s.Feeds
 }
 
 // User represents a user subscribed to the service.
 type User struct {
-	Id        bson.ObjectId `bson:"_id"`       // Unique Identifier.
-	Email     string        `bson:"email"`     // User mail. We do not need any more details.
-	Score     int           `bson:"score"`     // Minimum score for an item to be sent.
-	Keywords  []string      `bson:"keywords"`  // Keywords 'subscribed' to
-	SentItems []int         `bson:"sentItems"` // Sent item ids.
-	Token     string        `bson:"token"`     // User token.
-	Active    bool          `bson:"active"`    // Account status.
-	CreatedAt time.Time     `bson:"createdAt"` // Registration time.
-	// TODO: Add queue for unprocessed items (batch notifications).
+	Id        Id        `bson:"_id"`       // Unique Identifier.
+	Email     string    `bson:"email"`     // User mail. We do not need any more details.
+	SentItems []int     `bson:"sentItems"` // Sent item ids.
+	Token     string    `bson:"token"`     // User token.
+	Active    bool      `bson:"active"`    // Account status.
+	CreatedAt time.Time `bson:"createdAt"` // Registration time.
+	Rules     []Rule    `bson:"rules"`     // Subscription criteria.
+	Channels  []Channel `bson:"channels"`  // Notification channels, besides the account email.
+
+	Queue      []QueuedItem `bson:"queue"`      // Matched items waiting for the next digest.
+	LastDigest time.Time    `bson:"lastDigest"` // Time of the last digest sent.
+	Sends      []time.Time  `bson:"sends"`      // Emails sent over the last day.
+
+	WebhookSecret string       `bson:"webhookSecret"` // Key of the webhook signatures. See sign.
+	FeedToken     string       `bson:"feedToken"`     // Private token of the user feeds. See writeFeed.
+	History       []QueuedItem `bson:"history"`       // Last maxHistory matched items, oldest first.
+
+	Watch     CommentWatch  `bson:"watch"`     // Comment alerts. See runComments.
+	Following []string      `bson:"following"` // Followed HN usernames. See runFollows.
+	Watched   []WatchedItem `bson:"watched"`   // Watched stories. See runWatched.
+	Tokens    []APIToken    `bson:"tokens"`    // Personal API tokens. See requireScope.
+
+	Delivery `bson:",inline"` // Immediate or digest delivery.
 }
 
 // newUser creates a new user, with a randomly generated token.
-func newUser(email string, score int, keywords []string) *User {
+func newUser(email string, rule Rule, d Delivery) *User {
 	return &User{
-		Id:        bson.NewObjectId(),
+		Id:        newId(),
 		Email:     email,
-		Score:     score,
-		Keywords:  keywords,
+		Rules:     []Rule{rule},
+		Delivery:  d,
 		Token:     newToken(),
 		Active:    false, // Email verification required.
 		CreatedAt: time.Now(),
-	}
-}
 
-// Database is a convenient struct to wrap mgo collection(s).
-type Database struct {
-	mdb   *mgo.Database
-	users *mgo.Collection
-}
-
-// newDatabase created a new Database, cloning the initial mgo.Session.
-// The caller *must* call close() before disposing the Database.
-func newDatabase() *Database {
-	s := session.Copy()
-	mdb := s.DB("hnnotifications")
-	return &Database{
-		mdb:   mdb,
-		users: mdb.C("users"),
+		WebhookSecret: newToken(),
+		FeedToken:     newToken(),
 	}
 }
 
-// close handles the underlying session closure.
-func (db *Database) close() {
-	db.mdb.Session.Close()
-}
-
-// upsertUser inserts/updates a user into the database.
-func (db *Database) upsertUser(u *User) (err error) {
-	_, err = db.users.UpsertId(u.Id, u)
-	return
+// matches reports whether the user is entitled to receive the given story.
+// Backends unable to express the criteria as a query can filter with it.
+func (u *User) matches(s *story) bool {
+	return u.matchingRule(s) != nil
 }
 
-// validate checks whether the user and token pair is valid, returning the user if found.
-func (db *Database) validate(email, token string) *User {
-	if email == "" || token == "" {
-		Logger.Printf("User validation error: %s - %s\n", email, token)
+// matchingRule returns the first of the user's rules matching the given story,
+// or nil if the user is not entitled to receive it.
+func (u *User) matchingRule(s *story) *Rule {
+	if !u.Active || u.hasSent(s.Id) {
 		return nil
 	}
-
-	var u User
-	if err := db.users.Find(bson.M{"email": email, "token": token}).One(&u); err != nil {
-		Logger.Printf("User validation error: %s - %s. %v\n", email, token, err)
-		return nil
+	for i := range u.Rules {
+		if u.Rules[i].matches(s) {
+			return &u.Rules[i]
+		}
 	}
-	return &u
+	return nil
 }
 
-// activate sets the account status to 'active'.
-func (db *Database) activate(email, token string) bool {
-	u := db.validate(email, token)
-	if u == nil {
-		return false
+// rule returns the named rule, or nil if the user has no such rule.
+func (u *User) rule(name string) *Rule {
+	for i := range u.Rules {
+		if u.Rules[i].Name == name {
+			return &u.Rules[i]
+		}
 	}
+	return nil
+}
 
-	update := bson.M{
-		"$set": bson.M{
-			"active": true,
-			"token":  nil,
-		},
+// withRule returns a copy of the rules, with the given rule added or replacing
+// the rule with the same name.
+func (u *User) withRule(rule Rule) []Rule {
+	rules := make([]Rule, 0, len(u.Rules)+1)
+	for _, r := range u.Rules {
+		if r.Name == rule.Name {
+			r = rule
+		}
+		rules = append(rules, r)
 	}
-	err := db.users.UpdateId(u.Id, update)
-	if err != nil {
-		Logger.Println("Error: activate() - ", err)
+	if u.rule(rule.Name) == nil {
+		rules = append(rules, rule)
 	}
-	return err == nil
+	return rules
 }
 
-// unsubscribe completely removes the user account from the database.
-func (db *Database) unsubscribe(email, token string) bool {
-	u := db.validate(email, token)
-	if u == nil {
-		return false
+// withoutRule returns a copy of the rules, without the named rule.
+func (u *User) withoutRule(name string) []Rule {
+	var rules []Rule
+	for _, r := range u.Rules {
+		if r.Name != name {
+			rules = append(rules, r)
+		}
 	}
-
-	err := db.users.RemoveId(u.Id)
-	if err == nil {
-		return true
-	}
-	Logger.Println("Error: unsubscribe() - ", err)
-	return false
+	return rules
 }
 
-// updateScore validates the user and updates the score threshold.
-func (db *Database) updateUser(email, token string, score int, keywords []string) bool {
-	u := db.validate(email, token)
-	if u == nil {
+// matches reports whether the story meets the criteria of the rule.
+func (s *Settings) matches(st *story) bool {
+	if (st.Score < s.Score && !s.rising(st)) || !st.inAny(s.feeds()) {
 		return false
 	}
-
-	update := bson.M{
-		"$set": bson.M{
-			"score":    score,
-			"keywords": keywords,
-			"token":    nil,
-			"active":   true,
-		},
-	}
-	err := db.users.UpdateId(u.Id, update)
-	if err != nil {
-		Logger.Println("Error: updateUser() - ", err)
+	if !s.passesFilters(&st.Item) || matchDomain(s.BlockedDomains, st.link()) {
+		return false
 	}
-	return err == nil
-}
-
-// findUsersForItem queries all users entitled to receive a given item.
-func (db *Database) findUsersForItem(item Item) []User {
-	query := bson.M{
-		"score":     bson.M{"$lte": item.Score},
-		"sentItems": bson.M{"$ne": item.Id},
-		"active":    true,
-		"$or": []bson.M{
-			bson.M{"keywords": bson.M{"$exists": false}},
-			bson.M{"keywords": bson.M{"$size": 0}},
-			bson.M{"keywords": bson.M{"$in": Keywords(item.Title)}},
-		},
+	if matchDomain(s.Domains, st.link()) {
+		return true
 	}
-
-	var result []User
-	err := db.users.Find(query).All(&result)
-	if err != nil {
-		Logger.Println(err)
+	if len(s.Domains) > 0 && s.Query == "" && len(s.Keywords) == 0 {
+		return false // Domain subscription only.
 	}
-
-	return result
+	return s.matchesWords(st.words(s.Exact, s.Article))
 }
 
-// updateSentItems adds the given item to each user's item set.
-func (db *Database) updateSentItems(emails []string, item int) error {
-	selector := bson.M{"email": bson.M{"$in": emails}}
+// rising reports whether the story gains points fast enough for the velocity setting.
+func (s *Settings) rising(st *story) bool {
+	return s.Velocity > 0 && st.Velocity >= float64(s.Velocity)
+}
 
-	update := bson.M{
-		"$addToSet": bson.M{
-			"sentItems": item,
-		},
+// matchesWords evaluates the keyword query (or the legacy keyword list) against
+// the given words, which must be normalized unless the Exact setting is on.
+func (s *Settings) matchesWords(words []string) bool {
+	if s.Query != "" {
+		return compileQuery(s.Query, s.Exact).eval(words)
 	}
-
-	_, err := db.users.UpdateAll(selector, update)
-	return err
+	if len(s.Keywords) == 0 {
+		return true
+	}
+	keywords := s.Keywords
+	if !s.Exact {
+		keywords = Normalize(keywords)
+	}
+	for _, w := range words {
+		if contains(keywords, w) {
+			return true
+		}
+	}
+	return false
 }
 
-// updateToken assigns the new token to the user.
-func (db *Database) updateToken(uid bson.ObjectId, token string) error {
-	update := bson.M{
-		"$set": bson.M{
-			"token": token,
-		},
+// passesFilters checks the item type, author, age and comment count filters.
+func (s *Settings) passesFilters(item *hnapi.Item) bool {
+	if len(s.Types) > 0 && !contains(s.Types, item.Type) {
+		return false
+	}
+	if len(s.Authors) > 0 && !contains(s.Authors, item.By) {
+		return false
 	}
-	return db.users.UpdateId(uid, update)
+	if s.MaxAge > 0 && time.Since(time.Unix(item.Time, 0)) > time.Duration(s.MaxAge)*time.Hour {
+		return false
+	}
+	return item.Descendants >= s.MinComments
 }
 
-// findUser queries a user by its email field.
-func (db *Database) findUser(email string) (*User, bool) {
-	var u User
-	err := db.users.Find(bson.M{"email": email}).One(&u)
-	if err != nil && err != mgo.ErrNotFound {
-		Logger.Println("Error: findUser() - ", err)
-	}
-	return &u, err == nil
+// hasSent reports whether the given item has already been sent to the user.
+func (u *User) hasSent(id int) bool {
+	return containsInt(u.SentItems, id)
 }
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Delivery modes.
+const (
+	deliverImmediate = "immediate" // One email per item, as soon as it matches.
+	deliverHourly    = "hourly"
+	deliverDaily     = "daily"
+	deliverWeekly    = "weekly"
+
+	digestInterval = 5 * time.Minute // Interval at which the digest job looks for due digests and held items.
+)
+
+// Delivery holds the user preferences about when to receive the matched items.
+type Delivery struct {
+	Mode     string `bson:"delivery"`      // One of the deliver* modes. Empty means immediate.
+	Hour     int    `bson:"digestHour"`    // Local hour of the daily and weekly digests.
+	Weekday  int    `bson:"digestWeekday"` // Day of the weekly digests, Sunday being 0.
+	Timezone string `bson:"timezone"`      // IANA time zone name, e.g. "Europe/Madrid". Empty means UTC.
+
+	QuietStart int `bson:"quietStart"` // Local hour the quiet hours start at.
+	QuietEnd   int `bson:"quietEnd"`   // Local hour the quiet hours end at. Equal to QuietStart means no quiet hours.
+	MaxPerHour int `bson:"maxPerHour"` // Maximum emails sent over the last hour. Zero means no limit.
+	MaxPerDay  int `bson:"maxPerDay"`  // Maximum emails sent over the last 24 hours. Zero means no limit.
+
+	MuteEmail bool `bson:"muteEmail"` // Skip the account email, if any other channel is verified.
+}
+
+// QueuedItem is a matched item waiting for the next digest, or held back from immediate delivery.
+type QueuedItem struct {
+	Id       int       `bson:"id"`
+	Title    string    `bson:"title"`
+	Url      string    `bson:"url"`
+	Score    int       `bson:"score"`
+	Comments int       `bson:"comments"`
+	Rule     string    `bson:"rule"`     // Name of the rule that fired.
+	QueuedAt time.Time `bson:"queuedAt"` // Time the item was matched.
+}
+
+// newQueuedItem snapshots the story, matched by the named rule.
+func newQueuedItem(s *story, rule string) QueuedItem {
+	return QueuedItem{
+		Id:       s.Id,
+		Title:    s.Title,
+		Url:      s.Url,
+		Score:    s.Score,
+		Comments: s.Descendants,
+		Rule:     rule,
+		QueuedAt: time.Now(),
+	}
+}
+
+// discussion returns the HN discussion URL of the item.
+func (item *QueuedItem) discussion() string {
+	return fmt.Sprintf(commentsUrl, item.Id)
+}
+
+// link returns the item URL, or the HN discussion URL for text posts (e.g. Ask HN).
+func (item *QueuedItem) link() string {
+	if item.Url == "" {
+		return item.discussion()
+	}
+	return item.Url
+}
+
+// digest reports whether the items are batched into digests, instead of sent immediately.
+func (d *Delivery) digest() bool {
+	return d.Mode != "" && d.Mode != deliverImmediate
+}
+
+// location returns the user time zone.
+func (d *Delivery) location() *time.Location {
+	if loc, err := time.LoadLocation(d.Timezone); err == nil {
+		return loc
+	}
+	return time.UTC
+}
+
+// nextDigest returns the time of the first digest due after t.
+func (d *Delivery) nextDigest(t time.Time) time.Time {
+	t = t.In(d.location())
+	switch d.Mode {
+	case deliverHourly:
+		return t.Truncate(time.Hour).Add(time.Hour)
+	case deliverWeekly:
+		next := time.Date(t.Year(), t.Month(), t.Day(), d.Hour, 0, 0, 0, t.Location())
+		next = next.AddDate(0, 0, (d.Weekday-int(next.Weekday())+7)%7)
+		if !next.After(t) {
+			next = next.AddDate(0, 0, 7)
+		}
+		return next
+	default: // deliverDaily
+		next := time.Date(t.Year(), t.Month(), t.Day(), d.Hour, 0, 0, 0, t.Location())
+		if !next.After(t) {
+			next = next.AddDate(0, 0, 1)
+		}
+		return next
+	}
+}
+
+// quiet reports whether t falls within the quiet hours.
+func (d *Delivery) quiet(t time.Time) bool {
+	if d.QuietStart == d.QuietEnd {
+		return false
+	}
+	h := t.In(d.location()).Hour()
+	if d.QuietStart < d.QuietEnd {
+		return h >= d.QuietStart && h < d.QuietEnd
+	}
+	return h >= d.QuietStart || h < d.QuietEnd // Overnight, e.g. 22 to 7.
+}
+
+// capped reports whether the user has reached any of the email caps at the given time.
+func (u *User) capped(now time.Time) bool {
+	if u.MaxPerHour == 0 && u.MaxPerDay == 0 {
+		return false
+	}
+	hour, day := 0, 0
+	for _, t := range u.Sends {
+		if d := now.Sub(t); d < time.Hour {
+			hour++
+			day++
+		} else if d < 24*time.Hour {
+			day++
+		}
+	}
+	return (u.MaxPerHour > 0 && hour >= u.MaxPerHour) || (u.MaxPerDay > 0 && day >= u.MaxPerDay)
+}
+
+// held reports whether emails to the user are held back at the given time, be it
+// due to the quiet hours or the email caps. Held items wait in the queue.
+func (u *User) held(now time.Time) bool {
+	return u.quiet(now) || u.capped(now)
+}
+
+// digestDue reports whether the queued items are due at the given time. Items
+// held back from immediate delivery are due as soon as the user is no longer held.
+// Digests are due once the scheduled time following the previous digest (or the
+// oldest queued item, for the first one) has passed, outside the quiet hours.
+func (u *User) digestDue(now time.Time) bool {
+	if len(u.Queue) == 0 || u.held(now) {
+		return false
+	}
+	if !u.digest() {
+		return true
+	}
+	since := u.LastDigest
+	if since.IsZero() {
+		since = u.Queue[0].QueuedAt
+		for _, item := range u.Queue {
+			if item.QueuedAt.Before(since) {
+				since = item.QueuedAt
+			}
+		}
+	}
+	return !now.Before(u.nextDigest(since))
+}
+
+// runDigests sends the digests due, along with the items held back from immediate
+// delivery, emptying the corresponding queues.
+func runDigests(ctx context.Context) error {
+	db := openStore()
+	defer db.close()
+
+	users, err := db.findQueuedUsers()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, u := range users {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !u.digestDue(now) {
+			continue
+		}
+
+		items := u.Queue
+		sort.SliceStable(items, func(i, j int) bool { return items[i].Score > items[j].Score })
+		if err := deliver(db, &u, digestMessage(u.Mode, items)); err != nil {
+			Logger.Println("Error sending digest: ", err)
+			continue
+		}
+		Logger.Printf("Digest with %d items sent to user %s\n", len(items), u.Email)
+		if err := db.recordSend([]string{u.Email}, now); err != nil {
+			Logger.Println("Error: recordSend() - ", err)
+		}
+
+		ids := make([]int, len(items))
+		for i, item := range items {
+			ids[i] = item.Id
+		}
+		if err := db.clearQueue(u.Id, ids, now); err != nil {
+			Logger.Println("Error: clearQueue() - ", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Domain rules select stories by their link. A rule is a host name, optionally
+// followed by a path prefix, and optionally starting with a "*." wildcard:
+//
+//	example.com          example.com and www.example.com
+//	*.rust-lang.org      rust-lang.org and any of its subdomains
+//	github.com/golang    github.com/golang and anything below it
+//
+// Rules are case insensitive, and path prefixes match whole path segments.
+
+// validDomainRule reports whether rule is a well formed domain rule.
+func validDomainRule(rule string) bool {
+	host, path := splitDomainRule(strings.ToLower(rule))
+	host = strings.TrimPrefix(host, "*.")
+	if host == "" || strings.HasPrefix(host, ".") || strings.HasSuffix(host, ".") || !strings.Contains(host, ".") {
+		return false
+	}
+	for _, c := range host {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '.' {
+			return false
+		}
+	}
+	_, err := url.Parse("http://" + host + path)
+	return err == nil && !strings.ContainsAny(path, "?#")
+}
+
+// splitDomainRule splits a rule into its host and path prefix parts.
+func splitDomainRule(rule string) (host, path string) {
+	if i := strings.Index(rule, "/"); i != -1 {
+		return rule[:i], strings.TrimSuffix(rule[i:], "/")
+	}
+	return rule, ""
+}
+
+// matchDomain reports whether the link matches any of the rules.
+func matchDomain(rules []string, link *url.URL) bool {
+	if link == nil {
+		return false
+	}
+	host, linkPath := strings.ToLower(link.Hostname()), strings.ToLower(link.Path)
+	for _, rule := range rules {
+		h, path := splitDomainRule(strings.ToLower(rule))
+		switch {
+		case strings.HasPrefix(h, "*."):
+			h = h[2:]
+			if host != h && !strings.HasSuffix(host, "."+h) {
+				continue
+			}
+		case host != h && host != "www."+h:
+			continue
+		}
+		if path == "" || linkPath == path || strings.HasPrefix(linkPath, path+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Feed formats.
+const (
+	feedAtom = "atom"
+	feedRSS  = "rss"
+	feedJSON = "json"
+
+	maxHistory = 200 // Matched items kept per user.
+	feedSize   = 50  // Items listed in the feeds.
+)
+
+// feedTypes maps the feed formats to their content type.
+var feedTypes = map[string]string{
+	feedAtom: "application/atom+xml; charset=utf-8",
+	feedRSS:  "application/rss+xml; charset=utf-8",
+	feedJSON: "application/feed+json; charset=utf-8",
+}
+
+// feedUrl returns the URL of the user feed in the given format.
+func feedUrl(feedToken, format string) string {
+	return fmt.Sprintf("%s/feeds/%s.%s", config.Url, feedToken, format)
+}
+
+// summary describes the matched item, as shown by the feed readers.
+func (item *QueuedItem) summary() string {
+	return fmt.Sprintf("%d points, %d comments. Matched by your rule: %s. Hacker News discussion: %s",
+		item.Score, item.Comments, item.Rule, item.discussion())
+}
+
+// writeFeed renders the matched items of the user, newest first, in the given format.
+func writeFeed(w io.Writer, format string, u *User, items []QueuedItem) error {
+	updated := u.CreatedAt
+	if len(items) > 0 {
+		updated = items[0].QueuedAt
+	}
+	title := "HN Notifications"
+
+	switch format {
+	case feedAtom:
+		return writeAtom(w, title, feedUrl(u.FeedToken, format), updated, items)
+	case feedRSS:
+		return writeRSS(w, title, feedUrl(u.FeedToken, format), updated, items)
+	}
+	return writeJSONFeed(w, title, feedUrl(u.FeedToken, format), items)
+}
+
+// atomFeed is an Atom (RFC 4287) feed document.
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	Id      string      `xml:"id"`
+	Link    []atomLink  `xml:"link"`
+	Updated string      `xml:"updated"`
+	Author  string      `xml:"author>name"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title   string     `xml:"title"`
+	Id      string     `xml:"id"`
+	Link    []atomLink `xml:"link"`
+	Updated string     `xml:"updated"`
+	Summary string     `xml:"summary"`
+}
+
+func writeAtom(w io.Writer, title, self string, updated time.Time, items []QueuedItem) error {
+	feed := atomFeed{
+		Title:   title,
+		Id:      self,
+		Link:    []atomLink{{Href: self, Rel: "self"}, {Href: config.Url}},
+		Updated: updated.UTC().Format(time.RFC3339),
+		Author:  "HN Notifications",
+	}
+	for i := range items {
+		item := &items[i]
+		links := []atomLink{{Href: item.link()}}
+		if item.Url != "" {
+			links = append(links, atomLink{Href: item.discussion(), Rel: "related"})
+		}
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:   item.Title,
+			Id:      item.discussion(),
+			Link:    links,
+			Updated: item.QueuedAt.UTC().Format(time.RFC3339),
+			Summary: item.summary(),
+		})
+	}
+	return writeXML(w, feed)
+}
+
+// rssFeed is a RSS 2.0 feed document.
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	Description string  `xml:"description"`
+	Comments    string  `xml:"comments"`
+	Guid        rssGuid `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+}
+
+type rssGuid struct {
+	Value       string `xml:",chardata"`
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+}
+
+func writeRSS(w io.Writer, title, self string, updated time.Time, items []QueuedItem) error {
+	feed := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:         title,
+			Link:          config.Url,
+			Description:   "Hacker News stories matching your rules",
+			LastBuildDate: updated.UTC().Format(time.RFC1123Z),
+		},
+	}
+	for i := range items {
+		item := &items[i]
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       item.Title,
+			Link:        item.link(),
+			Description: item.summary(),
+			Comments:    item.discussion(),
+			Guid:        rssGuid{item.discussion(), true},
+			PubDate:     item.QueuedAt.UTC().Format(time.RFC1123Z),
+		})
+	}
+	return writeXML(w, feed)
+}
+
+// writeXML encodes the feed document, preceded by the XML header.
+func writeXML(w io.Writer, v interface{}) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(v)
+}
+
+// jsonFeed is a JSON Feed (version 1.1) document.
+type jsonFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageUrl string         `json:"home_page_url"`
+	FeedUrl     string         `json:"feed_url"`
+	Items       []jsonFeedItem `json:"items"`
+}
+
+type jsonFeedItem struct {
+	Id            string `json:"id"`
+	Url           string `json:"url"`
+	ExternalUrl   string `json:"external_url,omitempty"`
+	Title         string `json:"title"`
+	ContentText   string `json:"content_text"`
+	DatePublished string `json:"date_published"`
+}
+
+func writeJSONFeed(w io.Writer, title, self string, items []QueuedItem) error {
+	feed := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       title,
+		HomePageUrl: config.Url,
+		FeedUrl:     self,
+		Items:       []jsonFeedItem{},
+	}
+	for i := range items {
+		item := &items[i]
+		feed.Items = append(feed.Items, jsonFeedItem{
+			Id:            item.discussion(),
+			Url:           item.discussion(),
+			ExternalUrl:   item.Url, // Empty for text posts.
+			Title:         item.Title,
+			ContentText:   item.summary(),
+			DatePublished: item.QueuedAt.UTC().Format(time.RFC3339),
+		})
+	}
+	return json.NewEncoder(w).Encode(feed)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ichinaski/hnnotifications/hnapi"
+)
+
+const (
+	maxFollowing   = 20               // Followed accounts per user.
+	followInterval = 10 * time.Minute // Interval at which the follow job polls the followed accounts.
+)
+
+// following returns the reason shown along with the items of the followed account.
+func following(username string) string {
+	return "following " + username
+}
+
+// follows reports whether the user follows the given account.
+func (u *User) follows(username string) bool {
+	return username != "" && contains(u.Following, username)
+}
+
+// followMessage creates the alert of the item submitted by a followed account.
+// Stories, jobs and polls are sent like the matched stories; comments, along with
+// their excerpt.
+func followMessage(item *hnapi.Item) *Message {
+	if item.Type == hnapi.CommentType {
+		subject := fmt.Sprintf("%s commented", item.By)
+		qi := QueuedItem{Id: item.Id, Title: subject, Rule: following(item.By), QueuedAt: time.Now()}
+		return &Message{Kind: msgComment, Subject: subject, Items: []QueuedItem{qi}, Text: excerpt(commentText(item.Text))}
+	}
+	return itemMessage(&story{Item: *item}, following(item.By))
+}
+
+// newSubmissions returns the items submitted by the account since the last seen one,
+// up to maxUserItems, along with the newest item id. Nothing is new to accounts not
+// seen before.
+func newSubmissions(hu *hnapi.User, last int, seen bool) ([]int, int) {
+	submitted := hu.Submitted
+	if len(submitted) > maxUserItems {
+		submitted = submitted[:maxUserItems]
+	}
+	var ids []int
+	newest := last
+	for _, id := range submitted {
+		if id <= last {
+			continue
+		}
+		if seen {
+			ids = append(ids, id)
+		}
+		if id > newest {
+			newest = id
+		}
+	}
+	return ids, newest
+}
+
+// runFollows polls the submissions of the followed accounts, sending the new items
+// to their followers. The newest item seen of each account is stored, and the
+// accounts no longer followed are forgotten.
+func runFollows(ctx context.Context) error {
+	db := openStore()
+	defer db.close()
+
+	users, err := db.findFollowers()
+	if err != nil {
+		return err
+	}
+	if len(users) == 0 {
+		return nil
+	}
+	last, err := db.lastSubmissions()
+	if err != nil {
+		return err
+	}
+
+	var (
+		ids    []int
+		polled = make(map[string]bool)
+		newest = make(map[string]int) // Newest item seen of each account, once polled.
+	)
+	for i := range users {
+		for _, name := range users[i].Following {
+			if polled[name] {
+				continue
+			}
+			polled[name] = true
+			prev, seen := last[name]
+			hu, err := hn.User(ctx, name)
+			if err != nil {
+				Logger.Printf("Error reading HN user %s: %v\n", name, err)
+				if seen {
+					newest[name] = prev
+				}
+				continue
+			}
+			var items []int
+			items, newest[name] = newSubmissions(hu, prev, seen)
+			ids = append(ids, items...)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	items, failed := fetchLogged(ctx, ids, config.Workers)
+	now := time.Now()
+	for item := range items {
+		if item.Deleted || item.Dead || ctx.Err() != nil {
+			continue
+		}
+		m := followMessage(&item)
+		var notified []string
+		for i := range users {
+			if u := &users[i]; u.follows(item.By) && notifyAlert(db, u, m, now) {
+				notified = append(notified, u.Email)
+			}
+		}
+		if item.Type == hnapi.CommentType || len(notified) == 0 {
+			continue
+		}
+		// Stories are not sent again when matched by a rule, and show up in the feeds.
+		if err := db.updateSentItems(notified, item.Id); err != nil {
+			Logger.Println("Error: updateItems() - ", err)
+		}
+		if err := db.recordMatch(notified, m.Items[0]); err != nil {
+			Logger.Println("Error: recordMatch() - ", err)
+		}
+	}
+	if n := <-failed; n > 0 {
+		Logger.Printf("Failed to fetch %d/%d followed items\n", n, len(ids))
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return db.saveSubmissions(newest)
+}
@@ -2,31 +2,76 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"html"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/gorilla/mux"
+	"github.com/ichinaski/hnnotifications/hnapi"
 )
 
 const (
 	linkSentMsg     = "An account verification email has been sent."
 	subscribedMsg   = "Your account is now active!"
 	scoreUpdatedMsg = "Your settings have been successfully updated!"
+	ruleDeletedMsg  = "Your rule has been successfully deleted."
+	channelSentMsg  = "A verification message has been sent to your channel."
+	channelOKMsg    = "Your channel is now verified!"
+	channelGoneMsg  = "Your channel has been successfully deleted."
+	webhookSentMsg  = "A verification message has been sent to your webhook. Deliveries are signed with your webhook secret: %s"
+	logSentMsg      = "An email with the link to your delivery log has been sent."
+	feedSentMsg     = "An email with the links to your feeds has been sent."
+	watchUpdatedMsg = "Your comment alerts have been successfully updated!"
+	followingMsg    = "Your followed accounts have been successfully updated!"
+	watchingMsg     = "You are now watching %s. Follow-ups are sent for the next 7 days."
+	unwatchedMsg    = "You are no longer watching this story."
+	tokensSentMsg   = "An email with the link to your API tokens has been sent."
+	tokenRevokedMsg = "Your API token has been successfully revoked."
 	unsubscribedMsg = "You have been successfully unsubscribed."
 
-	minScoreNoKeywords = 200
+	minScoreNoKeywords    = 200
+	minVelocityNoKeywords = 100 // Points per hour.
+	maxRuleName           = 50  // Characters.
+	maxRules              = 20  // Rules per user.
 )
 
 var (
 	errInvalidEmail    = errors.New("Error: The email address is not valid!")
 	errInvalidScore    = errors.New("Error: The score field must be a number!")
+	errInvalidVelocity = errors.New("Error: The velocity field must be a positive number of points per hour!")
 	errInvalidLink     = errors.New("Error: The link is not valid.")
-	errInvalidKeywords = errors.New("Error: Invalid keywords. Keywords must be space-separated, alphanumeric strings")
 	errNotFound        = errors.New("Error: The email address you provided is not subscribed to this service!")
-	errMinScore        = errors.New("Error: You must either add some keywords or select a minimum score of 200 points!")
+	errMinScore        = errors.New("Error: You must either add some keywords or domains, or select a minimum score of 200 points!")
+	errMinVelocity     = errors.New("Error: You must either add some keywords or domains, or select a minimum velocity of 100 points per hour!")
+	errInvalidFeeds    = errors.New("Error: Invalid story lists.")
+	errInvalidTypes    = errors.New("Error: Invalid item types.")
+	errInvalidAuthors  = errors.New("Error: Invalid authors. Authors must be space-separated HN usernames")
+	errInvalidMaxAge   = errors.New("Error: The maximum age field must be a positive number of hours!")
+	errInvalidComments = errors.New("Error: The minimum comments field must be a positive number!")
+	errInvalidDomains  = errors.New("Error: Invalid domains. Domains must be space-separated, e.g. github.com/golang *.rust-lang.org")
+	errInvalidRule     = errors.New("Error: Rule names must be up to 50 characters long.")
+	errRuleNotFound    = errors.New("Error: You have no rule with that name.")
+	errLastRule        = errors.New("Error: You cannot delete your only rule. Unsubscribe instead.")
+	errTooManyRules    = errors.New("Error: You cannot have more than 20 rules.")
+	errInvalidChannel  = errors.New("Error: Invalid channel. Pick a channel type, and a valid address or http(s) URL, along with the room and token where needed.")
+	errChannelNotFound = errors.New("Error: You have no such channel.")
+	errChannelExists   = errors.New("Error: You already have this channel.")
+	errTooManyChannels = errors.New("Error: You cannot have more than 10 channels.")
+	errInvalidDelivery = errors.New("Error: Invalid delivery. Pick a delivery mode, hours (0-23), a weekday, a valid time zone and positive email limits.")
+	errInvalidUsername = errors.New("Error: Invalid username. Replies and mentions need your HN username.")
+	errInvalidThreads  = errors.New("Error: Invalid threads. Threads must be up to 20 space-separated HN story ids or links.")
+	errInvalidFollows  = errors.New("Error: Invalid accounts. Accounts must be up to 20 space-separated HN usernames.")
+	errTooManyWatched  = errors.New("Error: You cannot watch more than 50 stories.")
+	errItemNotFound    = errors.New("Error: The story could not be found on Hacker News.")
+	errInvalidToken    = errors.New("Error: Invalid API token. Tokens need a name, up to 50 characters long, and at least one scope.")
+	errTooManyTokens   = errors.New("Error: You cannot have more than 10 API tokens.")
+	errTokenNotFound   = errors.New("Error: You have no API token with that id.")
 )
 
 // errInternal represents an internal server error.
@@ -38,22 +83,33 @@ type errMessage struct{ error }
 // Context carries http session information. It will be passed to all HTTP handlers.
 // TODO: Include user information, simplifying authentication management.
 type Context struct {
-	db *Database
+	db   Store
+	auth *apiAuth // Authenticated API caller, if any. See requireScope.
 }
 
 // newContext creates a new Context, ready to be passed to a HTTP handler.
 func newContext() *Context {
 	return &Context{
-		db: newDatabase(),
+		db: openStore(),
 	}
 }
 
+// handlerFunc is a custom HTTP handler function, taking the session Context.
+type handlerFunc func(ctx *Context, w http.ResponseWriter, r *http.Request) error
+
 // handler wraps a custom handler function returning a standard HandlerFunc closure.
-func handler(f func(ctx *Context, w http.ResponseWriter, r *http.Request) error) http.HandlerFunc {
+// Errors are rendered in the 'info' template.
+func handler(f handlerFunc) http.HandlerFunc {
+	return wrapHandler(f, writeError)
+}
+
+// wrapHandler wraps a custom handler function, rendering its errors with writeErr.
+func wrapHandler(f handlerFunc, writeErr func(err error, w http.ResponseWriter)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		Logger.Printf("%s %s %s\n", r.Method, r.URL.Path, r.URL.RawQuery)
 		ctx := newContext()
 		defer ctx.db.close()
+		ctx.auth, _ = r.Context().Value(authKey{}).(*apiAuth)
 
 		err := f(ctx, w, r)
 
@@ -63,15 +119,20 @@ func handler(f func(ctx *Context, w http.ResponseWriter, r *http.Request) error)
 
 		// Log the error, and depending on the type, display it to the user.
 		Logger.Println(err)
-		switch err.(type) {
-		case errMessage:
-			w.WriteHeader(http.StatusBadRequest)
-			writeMessage(err.Error(), w)
-		case errInternal:
-		default:
-			w.WriteHeader(http.StatusInternalServerError)
-			writeMessage("Oops! An error occurred.", w)
-		}
+		writeErr(err, w)
+	}
+}
+
+// writeError renders the error in the 'info' template.
+func writeError(err error, w http.ResponseWriter) {
+	switch err.(type) {
+	case errMessage:
+		w.WriteHeader(http.StatusBadRequest)
+		writeMessage(err.Error(), w)
+	case errInternal:
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		writeMessage("Oops! An error occurred.", w)
 	}
 }
 
@@ -84,6 +145,35 @@ func setupHandlers() {
 		Methods("GET")
 	router.HandleFunc("/unsubscribe", handler(UnsubscribeHandler)).
 		Methods("GET", "POST")
+	router.HandleFunc("/channels", handler(ChannelHandler)).
+		Methods("POST")
+	router.HandleFunc("/channels/confirm", handler(ConfirmChannelHandler)).
+		Methods("GET")
+	router.HandleFunc("/channels/verify", handler(VerifyChannelHandler)).
+		Methods("GET")
+	router.HandleFunc("/comments", handler(CommentsHandler)).
+		Methods("POST")
+	router.HandleFunc("/comments/confirm", handler(ConfirmCommentsHandler)).
+		Methods("GET")
+	router.HandleFunc("/follow", handler(FollowHandler)).
+		Methods("POST")
+	router.HandleFunc("/follow/confirm", handler(ConfirmFollowHandler)).
+		Methods("GET")
+	router.HandleFunc("/watch", handler(WatchStoryHandler)).
+		Methods("GET")
+	router.HandleFunc("/webhooks", handler(WebhookLogHandler)).
+		Methods("GET", "POST")
+	router.HandleFunc("/tokens", handler(TokensHandler)).
+		Methods("GET", "POST")
+	router.HandleFunc("/tokens/manage", handler(ManageTokensHandler)).
+		Methods("POST")
+	router.HandleFunc("/feeds", handler(FeedLinksHandler)).
+		Methods("POST")
+	router.HandleFunc("/feeds/confirm", handler(ConfirmFeedHandler)).
+		Methods("GET")
+	router.HandleFunc("/feeds/{token:[A-Za-z0-9_=-]+}.{format:atom|rss|json}", handler(FeedHandler)).
+		Methods("GET")
+	setupAPIHandlers(router.PathPrefix("/api/v1").Subrouter())
 
 	// serve settings.html static file. index.html works the same way,
 	// though it's automatically handled by the root file server handler.
@@ -96,36 +186,82 @@ func setupHandlers() {
 }
 
 // SubscribeHandler is the HTTP handler for managing new subscriptions; It handles '/subscribe'.
+// Registered users use it to create, edit and delete their rules, which is confirmed by email.
 func SubscribeHandler(ctx *Context, w http.ResponseWriter, r *http.Request) error {
 	email, ok := parseEmail(r)
 	if !ok {
 		return errMessage{errInvalidEmail}
 	}
-	keywords, ok := parseKeywords(r)
+	name, ok := parseRuleName(r)
 	if !ok {
-		return errMessage{errInvalidKeywords}
+		return errMessage{errInvalidRule}
 	}
-	score, ok := parseScore(r)
+
+	if r.FormValue("delete") != "" {
+		if err := requestRule(ctx.db, email, Rule{Name: name}, nil, true); err != nil {
+			return err
+		}
+		return writeMessage(linkSentMsg, w)
+	}
+
+	settings, err := parseSettings(r)
+	if err != nil {
+		return err
+	}
+	delivery, ok := parseDelivery(r)
 	if !ok {
-		return errMessage{errInvalidScore}
-	} else if len(keywords) == 0 && score < minScoreNoKeywords {
-		return errMessage{errMinScore}
+		return errMessage{errInvalidDelivery}
+	}
+	d := &delivery
+	if _, found := ctx.db.findUser(email); found && r.FormValue("update_delivery") == "" {
+		d = nil // Registered users keep their delivery preferences, unless asked otherwise.
+	}
+	Logger.Printf("Rule %q -> Score:%d, Keywords:%q, Feeds:%v\n", name, settings.Score, settings.Query, settings.Feeds)
+
+	if err := requestRule(ctx.db, email, Rule{Name: name, Settings: settings}, d, false); err != nil {
+		return err
 	}
-	Logger.Printf("Settings -> Score:%d, Keywords:%v\n", score, keywords)
+	return writeMessage(linkSentMsg, w)
+}
 
+// requestRule emails the link confirming the rule change, or the activation link of
+// new users. The rule is added, or replaces the rule with the same name, unless del
+// is set, deleting it. The delivery preferences are changed too, unless nil; new
+// users get immediate delivery then. Errors are returned as errMessage or errInternal
+// values.
+func requestRule(db Store, email string, rule Rule, delivery *Delivery, del bool) error {
 	q := url.Values{} // Link query parameters.
-	u, ok := ctx.db.findUser(email)
-	if ok {
-		// The user already exists. Settings will be added to the query.
-		q.Set("score", strconv.Itoa(score))
-		q.Set("keywords", strings.Join(keywords, " ")) // FIXME: Should we just forward whatever we got in the initial request?
-		u.Token = newToken()                           // reset user token.
-		if err := ctx.db.updateToken(u.Id, u.Token); err != nil {
-			return errInternal{err}
+	u, found := db.findUser(email)
+	if del && !found {
+		return errMessage{errNotFound}
+	}
+	if found {
+		if err := checkRule(u, rule.Name, del); err != nil {
+			return err
+		}
+	}
+	if del {
+		q.Set("rule", rule.Name)
+		q.Set("delete", "1")
+	} else if found {
+		// The user already exists. The rule will be added to the query.
+		rule.encode(q) // FIXME: Should we just forward whatever we got in the initial request?
+		if delivery != nil {
+			delivery.encode(q)
 		}
 	} else {
-		u = newUser(email, score, keywords)
-		if err := ctx.db.upsertUser(u); err != nil {
+		var d Delivery
+		if delivery != nil {
+			d = *delivery
+		}
+		u = newUser(email, rule, d)
+		if err := db.upsertUser(u); err != nil {
+			return errInternal{err}
+		}
+	}
+	if found {
+		u.Token = newToken() // reset user token.
+		if err := db.updateToken(u.Id, u.Token); err != nil {
 			return errInternal{err}
 		}
 	}
@@ -134,21 +270,34 @@ func SubscribeHandler(ctx *Context, w http.ResponseWriter, r *http.Request) erro
 	q.Set("token", u.Token)
 	link := config.Url + "/activate?" + q.Encode()
 	go sendVerification(email, link)
-
-	return writeMessage(linkSentMsg, w)
+	return nil
 }
 
 // ActivateHandler is the HTTP handler for managing account activations; It handles '/activate'.
-// On registered users, it also handles setting updates.
+// On registered users, it also handles rule updates.
 func ActivateHandler(ctx *Context, w http.ResponseWriter, r *http.Request) error {
 	email, token := r.FormValue("email"), r.FormValue("token")
 
-	// Attempt to read score and keywords preferences, in case of setting updates.
-	score, sOK := parseScore(r)
-	keywords, kOK := parseKeywords(r)
-	if sOK && kOK {
-		// Update settings
-		if ctx.db.updateUser(email, token, score, keywords) {
+	if r.FormValue("delete") != "" {
+		if ctx.db.deleteRule(email, token, r.FormValue("rule")) {
+			return writeMessage(ruleDeletedMsg, w)
+		}
+		return errMessage{errInvalidLink}
+	}
+
+	// Attempt to read the rule, in case of rule updates. The delivery preferences are
+	// only in the link when changed along with the rule.
+	if settings, err := parseSettings(r); err == nil {
+		name, _ := parseRuleName(r)
+		var delivery *Delivery
+		if r.FormValue("delivery") != "" {
+			d, ok := parseDelivery(r)
+			if !ok {
+				return errMessage{errInvalidLink}
+			}
+			delivery = &d
+		}
+		if ctx.db.saveRule(email, token, Rule{Name: name, Settings: settings}, delivery) {
 			return writeMessage(scoreUpdatedMsg, w)
 		}
 		return errMessage{errInvalidLink}
@@ -162,6 +311,301 @@ func ActivateHandler(ctx *Context, w http.ResponseWriter, r *http.Request) error
 
 // ActivateHandler is the HTTP handler for managing account unsubscriptions; It handles '/unsubscribe'.
 func UnsubscribeHandler(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "POST":
+		email, ok := parseEmail(r)
+		u, found := ctx.db.findUser(email)
+		if !ok || !found {
+			return errMessage{errNotFound}
+		}
+		if err := requestUnsubscribe(ctx.db, u); err != nil {
+			return err
+		}
+		return writeMessage(linkSentMsg, w)
+	case "GET":
+		email, token := r.FormValue("email"), r.FormValue("token")
+		if ctx.db.unsubscribe(email, token) {
+			return writeMessage(unsubscribedMsg, w)
+		}
+		return errMessage{errInvalidLink}
+	}
+	return nil
+}
+
+// checkRule validates the change of the named rule of the user: its deletion if
+// del is set, and its addition or update otherwise.
+func checkRule(u *User, name string, del bool) error {
+	switch {
+	case del && u.rule(name) == nil:
+		return errMessage{errRuleNotFound}
+	case del && len(u.Rules) == 1:
+		return errMessage{errLastRule}
+	case !del && u.rule(name) == nil && len(u.Rules) >= maxRules:
+		return errMessage{errTooManyRules}
+	}
+	return nil
+}
+
+// requestUnsubscribe emails the link confirming the unsubscription of the user.
+func requestUnsubscribe(db Store, u *User) error {
+	u.Token = newToken() // reset user token.
+	if err := db.updateToken(u.Id, u.Token); err != nil {
+		return errInternal{err}
+	}
+
+	q := url.Values{}
+	q.Set("email", u.Email)
+	q.Set("token", u.Token)
+	link := config.Url + "/unsubscribe?" + q.Encode()
+	go sendUnsubscription(u.Email, link)
+	return nil
+}
+
+// ChannelHandler is the HTTP handler for adding and deleting notification channels; It handles '/channels'.
+// Changes are confirmed through the account email, just like the rule updates.
+func ChannelHandler(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	email, ok := parseEmail(r)
+	u, found := ctx.db.findUser(email)
+	if !ok || !found {
+		return errMessage{errNotFound}
+	}
+	c, ok := parseChannel(r)
+	if !ok {
+		return errMessage{errInvalidChannel}
+	}
+
+	q := url.Values{} // Link query parameters.
+	existing := u.findChannel(&c)
+	if r.FormValue("delete") != "" {
+		if existing == nil {
+			return errMessage{errChannelNotFound}
+		}
+		q.Set("channel", existing.Id)
+		q.Set("delete", "1")
+	} else {
+		if err := checkChannel(u, &c); err != nil {
+			return err
+		}
+		// The channel, and its secret, stay out of the link, which only refers to it.
+		c.Id = newToken()
+		if err := ctx.db.savePendingChannel(u.Id, c); err != nil {
+			return errInternal{err}
+		}
+		q.Set("channel", c.Id)
+	}
+
+	u.Token = newToken() // reset user token.
+	if err := ctx.db.updateToken(u.Id, u.Token); err != nil {
+		return errInternal{err}
+	}
+	q.Set("email", u.Email)
+	q.Set("token", u.Token)
+	link := config.Url + "/channels/confirm?" + q.Encode()
+	go sendVerification(email, link)
+
+	return writeMessage(linkSentMsg, w)
+}
+
+// checkChannel validates the addition of the channel to the user.
+func checkChannel(u *User, c *Channel) error {
+	switch {
+	case u.findChannel(c) != nil:
+		return errMessage{errChannelExists}
+	case len(u.Channels) >= maxChannels:
+		return errMessage{errTooManyChannels}
+	}
+	return nil
+}
+
+// ConfirmChannelHandler is the HTTP handler for confirming channel changes; It handles '/channels/confirm'.
+// New channels get a verification message, with the link that verifies them.
+func ConfirmChannelHandler(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	email, token := r.FormValue("email"), r.FormValue("token")
+
+	if r.FormValue("delete") != "" {
+		if ctx.db.deleteChannel(email, token, r.FormValue("channel")) {
+			return writeMessage(channelGoneMsg, w)
+		}
+		return errMessage{errInvalidLink}
+	}
+
+	u := ctx.db.validate(email, token)
+	if u == nil {
+		return errMessage{errInvalidLink}
+	}
+	c, ok := ctx.db.takePendingChannel(u.Id, r.FormValue("channel"))
+	if !ok {
+		return errMessage{errInvalidLink}
+	}
+	msg, err := confirmChannel(ctx.db, email, token, *c)
+	if err != nil {
+		return err
+	}
+	return writeMessage(msg, w)
+}
+
+// confirmChannel validates the user and adds the channel, sending it the verification
+// message. It returns the message shown to the user.
+func confirmChannel(db Store, email, token string, c Channel) (string, error) {
+	c.Id = newToken()
+	c.Token = newToken()
+	if !db.addChannel(email, token, c) {
+		return "", errMessage{errInvalidLink}
+	}
+	u, found := db.findUser(email)
+	if !found {
+		return "", errMessage{errInvalidLink}
+	}
+	return verifyNewChannel(u, &c), nil
+}
+
+// verifyNewChannel sends the verification message to the new channel of the user,
+// returning the message shown to the user.
+func verifyNewChannel(u *User, c *Channel) string {
+	q := url.Values{}
+	q.Set("email", u.Email)
+	q.Set("channel", c.Id)
+	q.Set("token", c.Token)
+	m := &Message{Kind: msgVerification, Subject: "Channel verification", Link: config.Url + "/channels/verify?" + q.Encode()}
+	go func() {
+		if err := notifierFor(u, c).notify(m); err != nil {
+			Logger.Printf("Error sending %s channel verification: %v\n", c.Kind, err)
+		}
+	}()
+	if c.Kind == chanWebhook {
+		return fmt.Sprintf(webhookSentMsg, u.WebhookSecret)
+	}
+	return channelSentMsg
+}
+
+// VerifyChannelHandler is the HTTP handler for channel verifications; It handles '/channels/verify'.
+func VerifyChannelHandler(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	if ctx.db.verifyChannel(r.FormValue("email"), r.FormValue("channel"), r.FormValue("token")) {
+		return writeMessage(channelOKMsg, w)
+	}
+	return errMessage{errInvalidLink}
+}
+
+// CommentsHandler is the HTTP handler for updating the comment alerts; It handles '/comments'.
+// Changes are confirmed through the account email, just like the rule updates.
+func CommentsHandler(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	email, ok := parseEmail(r)
+	u, found := ctx.db.findUser(email)
+	if !ok || !found {
+		return errMessage{errNotFound}
+	}
+	watch, err := parseWatch(r)
+	if err != nil {
+		return err
+	}
+
+	u.Token = newToken() // reset user token.
+	if err := ctx.db.updateToken(u.Id, u.Token); err != nil {
+		return errInternal{err}
+	}
+	q := url.Values{} // Link query parameters.
+	watch.encode(q)
+	q.Set("email", u.Email)
+	q.Set("token", u.Token)
+	link := config.Url + "/comments/confirm?" + q.Encode()
+	go sendVerification(email, link)
+
+	return writeMessage(linkSentMsg, w)
+}
+
+// ConfirmCommentsHandler is the HTTP handler for confirming comment alert changes; It handles '/comments/confirm'.
+func ConfirmCommentsHandler(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	email, token := r.FormValue("email"), r.FormValue("token")
+	u := ctx.db.validate(email, token)
+	if u == nil {
+		return errMessage{errInvalidLink}
+	}
+	watch, err := parseWatch(r)
+	if err != nil {
+		return errMessage{errInvalidLink}
+	}
+	if ctx.db.saveWatch(email, token, watch.startedAt(&u.Watch, time.Now())) {
+		return writeMessage(watchUpdatedMsg, w)
+	}
+	return errMessage{errInvalidLink}
+}
+
+// FollowHandler is the HTTP handler for updating the followed accounts; It handles '/follow'.
+// Changes are confirmed through the account email, just like the rule updates.
+func FollowHandler(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	email, ok := parseEmail(r)
+	u, found := ctx.db.findUser(email)
+	if !ok || !found {
+		return errMessage{errNotFound}
+	}
+	following, ok := parseFollowing(r)
+	if !ok {
+		return errMessage{errInvalidFollows}
+	}
+
+	u.Token = newToken() // reset user token.
+	if err := ctx.db.updateToken(u.Id, u.Token); err != nil {
+		return errInternal{err}
+	}
+	q := url.Values{} // Link query parameters.
+	q.Set("following", strings.Join(following, " "))
+	q.Set("email", u.Email)
+	q.Set("token", u.Token)
+	link := config.Url + "/follow/confirm?" + q.Encode()
+	go sendVerification(email, link)
+
+	return writeMessage(linkSentMsg, w)
+}
+
+// ConfirmFollowHandler is the HTTP handler for confirming followed account changes; It handles '/follow/confirm'.
+func ConfirmFollowHandler(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	following, ok := parseFollowing(r)
+	if ok && ctx.db.saveFollowing(r.FormValue("email"), r.FormValue("token"), following) {
+		return writeMessage(followingMsg, w)
+	}
+	return errMessage{errInvalidLink}
+}
+
+// WatchStoryHandler is the HTTP handler for (un)watching a single story; It handles '/watch'.
+// The links are sent along with the item emails, signed with the user feed token (see watchLink).
+func WatchStoryHandler(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	u, found := ctx.db.findUser(r.FormValue("email"))
+	if !found {
+		return errMessage{errInvalidLink}
+	}
+	id, err := strconv.Atoi(r.FormValue("item"))
+	if err != nil || !validWatchKey(u, id, r.FormValue("key")) {
+		return errMessage{errInvalidLink}
+	}
+
+	if r.FormValue("delete") != "" {
+		if err := ctx.db.deleteWatchedItem(u.Id, id); err != nil {
+			return errInternal{err}
+		}
+		return writeMessage(unwatchedMsg, w)
+	}
+	if u.watched(id) == nil && len(u.Watched) >= maxWatched {
+		return errMessage{errTooManyWatched}
+	}
+	item, err := hn.Item(r.Context(), id)
+	if err == hnapi.ErrNotFound || err == nil && (item.Deleted || item.Dead) {
+		return errMessage{errItemNotFound}
+	} else if err != nil {
+		return errInternal{err}
+	}
+	front, err := frontPage(r.Context())
+	if err != nil {
+		return errInternal{err}
+	}
+	if err := ctx.db.saveWatchedItem(u.Id, *newWatchedItem(item, front, time.Now())); err != nil {
+		return errInternal{err}
+	}
+	return writeMessage(fmt.Sprintf(watchingMsg, html.EscapeString("\""+item.Title+"\"")), w)
+}
+
+// WebhookLogHandler is the HTTP handler for the webhook delivery log; It handles '/webhooks'.
+// The log is reached through a link sent to the account email, which works once.
+func WebhookLogHandler(ctx *Context, w http.ResponseWriter, r *http.Request) error {
 	switch r.Method {
 	case "POST":
 		email, ok := parseEmail(r)
@@ -178,20 +622,193 @@ func UnsubscribeHandler(ctx *Context, w http.ResponseWriter, r *http.Request) er
 		q := url.Values{}
 		q.Set("email", u.Email)
 		q.Set("token", u.Token)
-		link := config.Url + "/unsubscribe?" + q.Encode()
-		go sendUnsubscription(email, link)
+		link := config.Url + "/webhooks?" + q.Encode()
+		go sendDeliveryLog(email, link)
 
-		return writeMessage(linkSentMsg, w)
+		return writeMessage(logSentMsg, w)
 	case "GET":
-		email, token := r.FormValue("email"), r.FormValue("token")
-		if ctx.db.unsubscribe(email, token) {
-			return writeMessage(unsubscribedMsg, w)
+		u := ctx.db.validate(r.FormValue("email"), r.FormValue("token"))
+		if u == nil {
+			return errMessage{errInvalidLink}
 		}
-		return errMessage{errInvalidLink}
+		if err := ctx.db.updateToken(u.Id, ""); err != nil { // The link is spent.
+			return errInternal{err}
+		}
+		deliveries, err := ctx.db.findDeliveries(u.Id, hookLogSize)
+		if err != nil {
+			return errInternal{err}
+		}
+		data := map[string]interface{}{
+			"secret":     u.WebhookSecret,
+			"deliveries": deliveries,
+		}
+		return useTemplate("webhooks", data, w)
 	}
 	return nil
 }
 
+// TokensHandler is the HTTP handler for the API tokens page; It handles '/tokens'.
+// The page is reached through a link sent to the account email, which works once:
+// the user token is reset for the page forms. See ManageTokensHandler.
+func TokensHandler(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "POST":
+		email, ok := parseEmail(r)
+		u, found := ctx.db.findUser(email)
+		if !ok || !found {
+			return errMessage{errNotFound}
+		}
+
+		u.Token = newToken() // reset user token.
+		if err := ctx.db.updateToken(u.Id, u.Token); err != nil {
+			return errInternal{err}
+		}
+
+		q := url.Values{}
+		q.Set("email", u.Email)
+		q.Set("token", u.Token)
+		link := config.Url + "/tokens?" + q.Encode()
+		go sendTokensLink(email, link)
+
+		return writeMessage(tokensSentMsg, w)
+	case "GET":
+		u := ctx.db.validate(r.FormValue("email"), r.FormValue("token"))
+		if u == nil {
+			return errMessage{errInvalidLink}
+		}
+		u.Token = newToken() // reset user token.
+		if err := ctx.db.updateToken(u.Id, u.Token); err != nil {
+			return errInternal{err}
+		}
+		return writeTokens(u, "", w)
+	}
+	return nil
+}
+
+// ManageTokensHandler is the HTTP handler for creating and revoking API tokens, posted from
+// the API tokens page; It handles '/tokens/manage'. The user token is reset on every change,
+// so that the page links work once.
+func ManageTokensHandler(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	email := r.FormValue("email")
+	u := ctx.db.validate(email, r.FormValue("token"))
+	if u == nil {
+		return errMessage{errInvalidLink}
+	}
+
+	var created string
+	if id := r.FormValue("delete"); id != "" {
+		if u.apiToken(id) == nil {
+			return errMessage{errTokenNotFound}
+		}
+		if err := ctx.db.deleteAPIToken(u.Id, id); err != nil {
+			return errInternal{err}
+		}
+	} else {
+		name, scopes, ok := parseAPIToken(r)
+		if !ok {
+			return errMessage{errInvalidToken}
+		}
+		if len(u.Tokens) >= maxTokens {
+			return errMessage{errTooManyTokens}
+		}
+		var t APIToken
+		t, created = newAPIToken(name, scopes)
+		if err := ctx.db.saveAPIToken(u.Id, t); err != nil {
+			return errInternal{err}
+		}
+	}
+
+	token := newToken() // reset user token.
+	if err := ctx.db.updateToken(u.Id, token); err != nil {
+		return errInternal{err}
+	}
+	u, found := ctx.db.findUser(email) // Reloaded, along with the token changes.
+	if !found {
+		return errMessage{errInvalidLink}
+	}
+	return writeTokens(u, created, w)
+}
+
+// writeTokens renders the API tokens page of the user. The created token, if any, is shown once.
+func writeTokens(u *User, created string, w http.ResponseWriter) error {
+	data := map[string]interface{}{
+		"email":   u.Email,
+		"token":   u.Token,
+		"tokens":  u.Tokens,
+		"scopes":  scopes,
+		"created": created,
+	}
+	return useTemplate("tokens", data, w)
+}
+
+// FeedLinksHandler is the HTTP handler for requesting the feed links; It handles '/feeds'.
+// The links are reached through the account email, and the feed token may be regenerated
+// on the way, revoking the previous links.
+func FeedLinksHandler(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	email, ok := parseEmail(r)
+	u, found := ctx.db.findUser(email)
+	if !ok || !found {
+		return errMessage{errNotFound}
+	}
+
+	u.Token = newToken() // reset user token.
+	if err := ctx.db.updateToken(u.Id, u.Token); err != nil {
+		return errInternal{err}
+	}
+
+	q := url.Values{}
+	q.Set("email", u.Email)
+	q.Set("token", u.Token)
+	if r.FormValue("regenerate") != "" {
+		q.Set("regenerate", "1")
+	}
+	link := config.Url + "/feeds/confirm?" + q.Encode()
+	go sendFeedLinks(email, link)
+
+	return writeMessage(feedSentMsg, w)
+}
+
+// ConfirmFeedHandler is the HTTP handler showing the feed links; It handles '/feeds/confirm'.
+func ConfirmFeedHandler(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	email, token := r.FormValue("email"), r.FormValue("token")
+	u := ctx.db.validate(email, token)
+	if u == nil {
+		return errMessage{errInvalidLink}
+	}
+
+	feedToken := u.FeedToken
+	if feedToken == "" || r.FormValue("regenerate") != "" {
+		feedToken = newToken()
+	}
+	if !ctx.db.setFeedToken(email, token, feedToken) {
+		return errMessage{errInvalidLink}
+	}
+
+	data := map[string]string{
+		"atom": feedUrl(feedToken, feedAtom),
+		"rss":  feedUrl(feedToken, feedRSS),
+		"json": feedUrl(feedToken, feedJSON),
+	}
+	return useTemplate("feeds", data, w)
+}
+
+// FeedHandler is the HTTP handler for the user feeds; It handles '/feeds/{token}.{format}',
+// format being atom, rss or json.
+func FeedHandler(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	u, found := ctx.db.findFeedUser(vars["token"])
+	if !found {
+		http.NotFound(w, r)
+		return nil
+	}
+	items, err := ctx.db.findHistory(u.Id, feedSize)
+	if err != nil {
+		return errInternal{err}
+	}
+	w.Header().Set("Content-Type", feedTypes[vars["format"]])
+	return writeFeed(w, vars["format"], u, items)
+}
+
 // writeMessage renders a message in the default 'info' template.
 func writeMessage(msg string, w http.ResponseWriter) error {
 	return useTemplate("info", msg, w)
@@ -209,13 +826,342 @@ func parseScore(r *http.Request) (int, bool) {
 	return score, err == nil
 }
 
-// parseKeywords reads the keywords attribute from the request.
-func parseKeywords(r *http.Request) ([]string, bool) {
-	text := r.FormValue("keywords")
-	for _, r := range text {
-		if !unicode.IsLetter(r) && !unicode.IsNumber(r) && !unicode.IsSpace(r) {
+// parseRuleName reads the rule name from the request, defaulting to defaultRule.
+func parseRuleName(r *http.Request) (string, bool) {
+	name := strings.TrimSpace(r.FormValue("rule"))
+	if name == "" {
+		return defaultRule, true
+	}
+	return name, utf8.RuneCountInString(name) <= maxRuleName
+}
+
+// parseSettings reads the subscription settings from the request.
+// Validation errors are returned as errMessage values.
+func parseSettings(r *http.Request) (Settings, error) {
+	var (
+		s  Settings
+		ok bool
+	)
+	s.Query = strings.TrimSpace(r.FormValue("keywords"))
+	q, err := parseQuery(s.Query)
+	if err != nil {
+		return s, errMessage{fmt.Errorf("Error: Invalid keywords: %v", err)}
+	}
+	keywords := narrows(q) // Exclusions alone do not count.
+	s.Exact = r.FormValue("exact") != ""
+	s.Article = r.FormValue("match") == "article"
+	if s.Domains, ok = parseDomains(r, "domains"); !ok {
+		return s, errMessage{errInvalidDomains}
+	}
+	if s.BlockedDomains, ok = parseDomains(r, "blocked_domains"); !ok {
+		return s, errMessage{errInvalidDomains}
+	}
+	if s.Score, ok = parseScore(r); !ok {
+		return s, errMessage{errInvalidScore}
+	} else if !keywords && len(s.Domains) == 0 && s.Score < minScoreNoKeywords {
+		return s, errMessage{errMinScore}
+	}
+	if s.Velocity, ok = parseOptionalInt(r, "velocity"); !ok {
+		return s, errMessage{errInvalidVelocity}
+	} else if !keywords && len(s.Domains) == 0 && s.Velocity > 0 && s.Velocity < minVelocityNoKeywords {
+		return s, errMessage{errMinVelocity}
+	}
+	if s.Feeds, ok = parseFeeds(r); !ok {
+		return s, errMessage{errInvalidFeeds}
+	}
+	if s.Types, ok = parseTypes(r); !ok {
+		return s, errMessage{errInvalidTypes}
+	}
+	if s.Authors, ok = parseAuthors(r); !ok {
+		return s, errMessage{errInvalidAuthors}
+	}
+	if s.MaxAge, ok = parseOptionalInt(r, "max_age"); !ok {
+		return s, errMessage{errInvalidMaxAge}
+	}
+	if s.MinComments, ok = parseOptionalInt(r, "min_comments"); !ok {
+		return s, errMessage{errInvalidComments}
+	}
+	return s, nil
+}
+
+// encode adds the rule to the given link query parameters. See parseRuleName and parseSettings.
+func (r *Rule) encode(q url.Values) {
+	q.Set("rule", r.Name)
+	r.Settings.encode(q)
+}
+
+// encode adds the settings to the given link query parameters. See parseSettings.
+func (s *Settings) encode(q url.Values) {
+	q.Set("score", strconv.Itoa(s.Score))
+	q.Set("velocity", strconv.Itoa(s.Velocity))
+	q.Set("keywords", s.Query)
+	if s.Exact {
+		q.Set("exact", "1")
+	}
+	if s.Article {
+		q.Set("match", "article")
+	}
+	q["feeds"] = s.Feeds
+	q["types"] = s.Types
+	q.Set("authors", strings.Join(s.Authors, " "))
+	q.Set("max_age", strconv.Itoa(s.MaxAge))
+	q.Set("min_comments", strconv.Itoa(s.MinComments))
+	q.Set("domains", strings.Join(s.Domains, " "))
+	q.Set("blocked_domains", strings.Join(s.BlockedDomains, " "))
+}
+
+// parseDelivery reads the delivery preferences from the request.
+func parseDelivery(r *http.Request) (Delivery, bool) {
+	d := Delivery{
+		Mode:     r.FormValue("delivery"),
+		Timezone: strings.TrimSpace(r.FormValue("timezone")),
+	}
+	switch d.Mode {
+	case "":
+		d.Mode = deliverImmediate
+	case deliverImmediate, deliverHourly, deliverDaily, deliverWeekly:
+	default:
+		return d, false
+	}
+	var ok bool
+	if d.Hour, ok = parseOptionalInt(r, "digest_hour"); !ok || d.Hour > 23 {
+		return d, false
+	}
+	if d.Weekday, ok = parseOptionalInt(r, "digest_weekday"); !ok || d.Weekday > 6 {
+		return d, false
+	}
+	if d.QuietStart, ok = parseOptionalInt(r, "quiet_start"); !ok || d.QuietStart > 23 {
+		return d, false
+	}
+	if d.QuietEnd, ok = parseOptionalInt(r, "quiet_end"); !ok || d.QuietEnd > 23 {
+		return d, false
+	}
+	if d.MaxPerHour, ok = parseOptionalInt(r, "max_per_hour"); !ok {
+		return d, false
+	}
+	if d.MaxPerDay, ok = parseOptionalInt(r, "max_per_day"); !ok {
+		return d, false
+	}
+	d.MuteEmail = r.FormValue("mute_email") != ""
+	if _, err := time.LoadLocation(d.Timezone); err != nil {
+		return d, false
+	}
+	return d, true
+}
+
+// encode adds the delivery preferences to the given link query parameters. See parseDelivery.
+func (d *Delivery) encode(q url.Values) {
+	q.Set("delivery", d.Mode)
+	q.Set("digest_hour", strconv.Itoa(d.Hour))
+	q.Set("digest_weekday", strconv.Itoa(d.Weekday))
+	q.Set("timezone", d.Timezone)
+	q.Set("quiet_start", strconv.Itoa(d.QuietStart))
+	q.Set("quiet_end", strconv.Itoa(d.QuietEnd))
+	q.Set("max_per_hour", strconv.Itoa(d.MaxPerHour))
+	q.Set("max_per_day", strconv.Itoa(d.MaxPerDay))
+	if d.MuteEmail {
+		q.Set("mute_email", "1")
+	}
+}
+
+// parseChannel reads a notification channel from the request.
+func parseChannel(r *http.Request) (Channel, bool) {
+	c := Channel{
+		Kind:   r.FormValue("kind"),
+		Target: strings.TrimSpace(r.FormValue("target")),
+		Room:   strings.TrimSpace(r.FormValue("room")),
+		Secret: strings.TrimSpace(r.FormValue("secret")),
+	}
+	switch c.Kind {
+	case chanEmail:
+		return c, validateAddress(c.Target)
+	case chanMatrix:
+		if c.Room == "" || c.Secret == "" {
+			return c, false
+		}
+	case chanGotify:
+		if c.Secret == "" {
+			return c, false
+		}
+	case chanWebhook, chanSlack, chanDiscord, chanNtfy:
+	default:
+		return c, false
+	}
+	u, err := url.Parse(c.Target)
+	return c, err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// encode adds the channel to the given query parameters. See parseChannel.
+func (c *Channel) encode(q url.Values) {
+	q.Set("kind", c.Kind)
+	q.Set("target", c.Target)
+	if c.Room != "" {
+		q.Set("room", c.Room)
+	}
+	if c.Secret != "" {
+		q.Set("secret", c.Secret)
+	}
+}
+
+// parseAPIToken reads the name and scopes of a new API token from the request.
+func parseAPIToken(r *http.Request) (string, []string, bool) {
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" || utf8.RuneCountInString(name) > maxTokenName {
+		return name, nil, false
+	}
+	r.ParseForm()
+	var granted []string
+	for _, s := range r.Form["scopes"] {
+		if !contains(scopes, s) {
+			return name, nil, false
+		}
+		if !contains(granted, s) {
+			granted = append(granted, s)
+		}
+	}
+	return name, granted, len(granted) > 0
+}
+
+// parseWatch reads the comment alerts from the request.
+// Validation errors are returned as errMessage values.
+func parseWatch(r *http.Request) (CommentWatch, error) {
+	w := CommentWatch{
+		Username: strings.TrimSpace(r.FormValue("username")),
+		Replies:  r.FormValue("replies") != "",
+		Mentions: r.FormValue("mentions") != "",
+		Keywords: strings.TrimSpace(r.FormValue("keywords")),
+	}
+	if !validUsername(w.Username) || (w.Username == "" && (w.Replies || w.Mentions)) {
+		return w, errMessage{errInvalidUsername}
+	}
+	fields := strings.Fields(r.FormValue("threads"))
+	if len(fields) > maxThreads {
+		return w, errMessage{errInvalidThreads}
+	}
+	for _, f := range fields {
+		id, ok := parseThread(f)
+		if !ok {
+			return w, errMessage{errInvalidThreads}
+		}
+		if w.thread(id) == nil {
+			w.Threads = append(w.Threads, WatchedThread{Id: id})
+		}
+	}
+	if _, err := parseQuery(w.Keywords); err != nil {
+		return w, errMessage{fmt.Errorf("Error: Invalid keywords: %v", err)}
+	}
+	return w, nil
+}
+
+// encode adds the comment alerts to the given link query parameters. See parseWatch.
+func (w *CommentWatch) encode(q url.Values) {
+	q.Set("username", w.Username)
+	if w.Replies {
+		q.Set("replies", "1")
+	}
+	if w.Mentions {
+		q.Set("mentions", "1")
+	}
+	var threads []string
+	for _, t := range w.Threads {
+		threads = append(threads, strconv.Itoa(t.Id))
+	}
+	q.Set("threads", strings.Join(threads, " "))
+	q.Set("keywords", w.Keywords)
+}
+
+// parseFollowing reads the space-separated followed accounts from the request.
+func parseFollowing(r *http.Request) ([]string, bool) {
+	var following []string
+	for _, name := range strings.Fields(r.FormValue("following")) {
+		if !validUsername(name) {
+			return nil, false
+		}
+		if !contains(following, name) {
+			following = append(following, name)
+		}
+	}
+	return following, len(following) <= maxFollowing
+}
+
+// parseThread reads a story id, given either as a number or as a HN item link.
+func parseThread(s string) (int, bool) {
+	if u, err := url.Parse(s); err == nil && u.Host != "" {
+		if u.Host != "news.ycombinator.com" || u.Path != "/item" {
+			return 0, false
+		}
+		s = u.Query().Get("id")
+	}
+	id, err := strconv.Atoi(s)
+	return id, err == nil && id > 0
+}
+
+// parseFeeds reads the feeds attribute from the request. It may be repeated.
+func parseFeeds(r *http.Request) ([]string, bool) {
+	r.ParseForm()
+	var feeds []string
+	for _, feed := range r.Form["feeds"] {
+		if !validFeed(feed) {
 			return nil, false
 		}
+		feeds = append(feeds, feed)
+	}
+	return feeds, true
+}
+
+// parseTypes reads the types attribute from the request. It may be repeated.
+func parseTypes(r *http.Request) ([]string, bool) {
+	r.ParseForm()
+	var types []string
+	for _, t := range r.Form["types"] {
+		switch t {
+		case hnapi.StoryType, hnapi.JobType, hnapi.PollType:
+			types = append(types, t)
+		default:
+			return nil, false
+		}
+	}
+	return types, true
+}
+
+// parseAuthors reads the space-separated authors attribute from the request.
+func parseAuthors(r *http.Request) ([]string, bool) {
+	authors := strings.Fields(r.FormValue("authors"))
+	for _, a := range authors {
+		if !validUsername(a) {
+			return nil, false
+		}
+	}
+	return authors, true
+}
+
+// validUsername reports whether name is made of the characters allowed in HN usernames.
+func validUsername(name string) bool {
+	for _, c := range name {
+		if !unicode.IsLetter(c) && !unicode.IsNumber(c) && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseDomains reads a space-separated list of domain rules from the request.
+func parseDomains(r *http.Request, name string) ([]string, bool) {
+	rules := strings.Fields(strings.ToLower(r.FormValue(name)))
+	for _, rule := range rules {
+		if !validDomainRule(rule) {
+			return nil, false
+		}
+	}
+	return rules, true
+}
+
+// parseOptionalInt reads a non-negative integer attribute from the request, defaulting to zero.
+func parseOptionalInt(r *http.Request, name string) (int, bool) {
+	v := r.FormValue(name)
+	if v == "" {
+		return 0, true
 	}
-	return Keywords(text), true
+	n, err := strconv.Atoi(v)
+	return n, err == nil && n >= 0
 }
@@ -0,0 +1,251 @@
+// Package hnapi implements a client for the Hacker News API.
+// See https://github.com/HackerNews/API.
+package hnapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBaseURL is the base URL of the official HN API.
+	DefaultBaseURL = "https://hacker-news.firebaseio.com/v0"
+
+	DefaultTimeout    = 10 * time.Second // Default per-request timeout.
+	DefaultMaxRetries = 3                // Default number of retries of a failed request.
+
+	minBackoff = 500 * time.Millisecond
+)
+
+// Story lists.
+const (
+	Top  = "top"
+	New  = "new"
+	Best = "best"
+	Ask  = "ask"
+	Show = "show"
+	Job  = "job"
+)
+
+// Feeds lists all the available story lists.
+var Feeds = []string{Top, New, Best, Ask, Show, Job}
+
+// ErrNotFound is returned when the API responds with a null value.
+var ErrNotFound = errors.New("hnapi: not found")
+
+// StatusError is returned on unexpected HTTP response statuses.
+type StatusError struct {
+	URL  string
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("hnapi: %s returned status %d", e.URL, e.Code)
+}
+
+// Item types.
+const (
+	StoryType   = "story"
+	JobType     = "job"
+	PollType    = "poll"
+	CommentType = "comment"
+)
+
+// Item represents a HN story or comment.
+type Item struct {
+	By          string // Author's username.
+	Descendants int    // Total comment count.
+	Id          int
+	Kids        []int // Ids of the item's comments, in ranked display order.
+	Parent      int   // Id of the parent item, for comments.
+	Score       int
+	Text        string // Comment or text post body, in HTML.
+	Time        int64  // Creation date, in Unix Time.
+	Title       string
+	Type        string // One of "job", "story", "comment", "poll", or "pollopt".
+	Url         string
+	Deleted     bool
+	Dead        bool
+}
+
+// User represents a HN user.
+type User struct {
+	Id        string // Case-sensitive username.
+	Created   int64  // Creation date, in Unix Time.
+	Karma     int
+	Submitted []int // Ids of the user's stories, polls and comments, newest first.
+}
+
+// Client is a HN API client. It is safe for concurrent use.
+type Client struct {
+	BaseURL    string        // API base URL, without the trailing slash.
+	HTTPClient *http.Client  // Underlying HTTP client.
+	Timeout    time.Duration // Per-request timeout, including the response body read. Zero means no timeout.
+	MaxRetries int           // Retries of requests failing with network errors or 5xx statuses.
+
+	limiter *limiter
+}
+
+// NewClient creates a Client for the given base URL, issuing at most rate
+// requests per second overall. A zero rate disables the limit.
+func NewClient(baseURL string, rate int) *Client {
+	c := &Client{
+		BaseURL:    baseURL,
+		HTTPClient: &http.Client{},
+		Timeout:    DefaultTimeout,
+		MaxRetries: DefaultMaxRetries,
+		limiter:    &limiter{},
+	}
+	if rate > 0 {
+		c.limiter.interval = time.Second / time.Duration(rate)
+	}
+	return c
+}
+
+// TopStories reads the top stories IDs.
+func (c *Client) TopStories(ctx context.Context) ([]int, error) {
+	return c.Stories(ctx, Top)
+}
+
+// Stories reads the IDs of the given story list, one of Feeds.
+func (c *Client) Stories(ctx context.Context, feed string) ([]int, error) {
+	var ids []int
+	err := c.get(ctx, "/"+feed+"stories.json", &ids)
+	return ids, err
+}
+
+// Updates reads the IDs of the recently changed items.
+func (c *Client) Updates(ctx context.Context) ([]int, error) {
+	var updates struct {
+		Items []int `json:"items"`
+	}
+	err := c.get(ctx, "/updates.json", &updates)
+	return updates.Items, err
+}
+
+// Item reads the item with the given id. ErrNotFound is returned for unknown items.
+func (c *Client) Item(ctx context.Context, id int) (*Item, error) {
+	var item *Item
+	if err := c.get(ctx, fmt.Sprintf("/item/%d.json", id), &item); err != nil {
+		return nil, err
+	}
+	if item == nil || item.Id != id {
+		return nil, ErrNotFound
+	}
+	return item, nil
+}
+
+// User reads the user with the given username. ErrNotFound is returned for unknown users.
+func (c *Client) User(ctx context.Context, id string) (*User, error) {
+	var u *User
+	if err := c.get(ctx, "/user/"+url.PathEscape(id)+".json", &u); err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return nil, ErrNotFound
+	}
+	return u, nil
+}
+
+// get reads the JSON document at path into v, retrying with exponential backoff
+// upon network errors and 5xx responses.
+func (c *Client) get(ctx context.Context, path string, v interface{}) error {
+	backoff := minBackoff
+	for attempt := 0; ; attempt++ {
+		err := c.try(ctx, path, v)
+		if err == nil || attempt == c.MaxRetries || !retryable(err) {
+			return err
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// try performs a single request.
+func (c *Client) try(ctx context.Context, path string, v interface{}) error {
+	if err := c.limiter.wait(ctx); err != nil {
+		return err
+	}
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequest("GET", c.BaseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &StatusError{URL: req.URL.String(), Code: resp.StatusCode}
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// retryable reports whether a failed request is worth retrying: network errors
+// (including timeouts) and 5xx statuses are, unless the request was cancelled.
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	switch err := err.(type) {
+	case *StatusError:
+		return err.Code >= 500
+	case *url.Error:
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded) // Timed out while reading the body.
+}
+
+// limiter spaces out events, so that they happen at most once every interval.
+type limiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time // Earliest time for the next event.
+}
+
+// wait blocks until the next event is allowed, or the context is done.
+func (l *limiter) wait(ctx context.Context) error {
+	if l.interval == 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	t := l.next
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	if d := t.Sub(now); d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
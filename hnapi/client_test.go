@@ -0,0 +1,191 @@
+package hnapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testServer serves the given handler, counting the requests received.
+func testServer(t *testing.T, h func(w http.ResponseWriter, r *http.Request, n int32)) (*Client, *int32) {
+	var n int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h(w, r, atomic.AddInt32(&n, 1))
+	}))
+	t.Cleanup(ts.Close)
+	return NewClient(ts.URL, 0), &n
+}
+
+func TestItem(t *testing.T) {
+	c, _ := testServer(t, func(w http.ResponseWriter, r *http.Request, n int32) {
+		switch r.URL.Path {
+		case "/item/1.json":
+			fmt.Fprint(w, `{"id":1,"by":"pg","title":"Y Combinator","score":57,"type":"story"}`)
+		case "/item/2.json":
+			fmt.Fprint(w, `null`)
+		case "/item/3.json":
+			fmt.Fprint(w, `{}`) // Deleted items may come back without an id.
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	item, err := c.Item(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("Item(1) error: %v", err)
+	}
+	if item.Id != 1 || item.By != "pg" || item.Score != 57 || item.Type != StoryType {
+		t.Errorf("Item(1) = %+v", item)
+	}
+	for _, id := range []int{2, 3} {
+		if _, err := c.Item(context.Background(), id); err != ErrNotFound {
+			t.Errorf("Item(%d) error = %v, want ErrNotFound", id, err)
+		}
+	}
+}
+
+func TestUserNotFound(t *testing.T) {
+	c, _ := testServer(t, func(w http.ResponseWriter, r *http.Request, n int32) {
+		fmt.Fprint(w, `null`)
+	})
+	if _, err := c.User(context.Background(), "nobody"); err != ErrNotFound {
+		t.Errorf("User() error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		fail     int32 // Requests failing before a successful one.
+		code     int
+		retries  int
+		requests int32
+		ok       bool
+	}{
+		{"no failure", 0, 0, 1, 1, true},
+		{"server error recovered", 1, http.StatusServiceUnavailable, 1, 2, true},
+		{"server error", 5, http.StatusInternalServerError, 1, 2, false},
+		{"client error", 5, http.StatusNotFound, 1, 1, false},
+		{"no retries", 5, http.StatusBadGateway, 0, 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, n := testServer(t, func(w http.ResponseWriter, r *http.Request, n int32) {
+				if n <= tt.fail {
+					w.WriteHeader(tt.code)
+					return
+				}
+				fmt.Fprint(w, `[3,2,1]`)
+			})
+			c.MaxRetries = tt.retries
+
+			ids, err := c.TopStories(context.Background())
+			if tt.ok && (err != nil || len(ids) != 3) {
+				t.Errorf("TopStories() = %v, %v", ids, err)
+			}
+			if !tt.ok {
+				if se, ok := err.(*StatusError); !ok || se.Code != tt.code {
+					t.Errorf("TopStories() error = %v, want status %d", err, tt.code)
+				}
+			}
+			if got := atomic.LoadInt32(n); got != tt.requests {
+				t.Errorf("requests = %d, want %d", got, tt.requests)
+			}
+		})
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	c, n := testServer(t, func(w http.ResponseWriter, r *http.Request, n int32) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	c.MaxRetries = 2
+
+	start := time.Now()
+	if _, err := c.Updates(context.Background()); err == nil {
+		t.Fatal("Updates() succeeded")
+	}
+	// Two retries, after minBackoff and twice as much.
+	if elapsed, want := time.Since(start), 3*minBackoff; elapsed < want {
+		t.Errorf("retried after %v, want at least %v", elapsed, want)
+	}
+	if got := atomic.LoadInt32(n); got != 3 {
+		t.Errorf("requests = %d, want 3", got)
+	}
+}
+
+func TestRetryCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c, n := testServer(t, func(w http.ResponseWriter, r *http.Request, n int32) {
+		cancel()
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	// Depending on timing, the cancellation is seen by the request or the backoff.
+	if _, err := c.Updates(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Updates() error = %v, want context.Canceled", err)
+	}
+	if got := atomic.LoadInt32(n); got != 1 {
+		t.Errorf("requests = %d, want 1", got)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	c, n := testServer(t, func(w http.ResponseWriter, r *http.Request, n int32) {
+		if n == 1 {
+			time.Sleep(200 * time.Millisecond)
+		}
+		fmt.Fprint(w, `[1]`)
+	})
+	c.Timeout = 50 * time.Millisecond
+	c.MaxRetries = 1
+
+	if ids, err := c.Stories(context.Background(), New); err != nil || len(ids) != 1 {
+		t.Errorf("Stories() = %v, %v", ids, err)
+	}
+	if got := atomic.LoadInt32(n); got != 2 {
+		t.Errorf("requests = %d, want 2", got)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := &limiter{interval: 20 * time.Millisecond}
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := l.wait(context.Background()); err != nil {
+			t.Fatalf("wait() error: %v", err)
+		}
+	}
+	if elapsed, want := time.Since(start), 4*l.interval; elapsed < want {
+		t.Errorf("5 events took %v, want at least %v", elapsed, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l.next = time.Now().Add(time.Hour)
+	if err := l.wait(ctx); err != context.Canceled {
+		t.Errorf("wait() error = %v, want context.Canceled", err)
+	}
+}
+
+func TestLimiterDisabled(t *testing.T) {
+	c := NewClient("", 0)
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		if err := c.limiter.wait(context.Background()); err != nil {
+			t.Fatalf("wait() error: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("100 unlimited events took %v", elapsed)
+	}
+	if c := NewClient("", 4); c.limiter.interval != 250*time.Millisecond {
+		t.Errorf("interval = %v, want 250ms for 4 requests per second", c.limiter.interval)
+	}
+}
@@ -0,0 +1,91 @@
+package hnapi
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ErrStreamCancelled is returned when the server cancels an event stream.
+var ErrStreamCancelled = errors.New("hnapi: stream cancelled by the server")
+
+// Event is a Firebase streaming event. See
+// https://firebase.google.com/docs/reference/rest/database#section-streaming.
+type Event struct {
+	Name string          `json:"-"`    // Event type: "put" or "patch".
+	Path string          `json:"path"` // Path of the changed data, relative to the stream.
+	Data json.RawMessage `json:"data"` // New data at Path.
+}
+
+// Stream subscribes to the Live Data stream at path (e.g. "/topstories.json"),
+// calling fn for each put and patch event received. It blocks until the
+// connection is lost, the context is done, or fn returns an error. Neither the
+// client Timeout nor the rate limit apply, as the request is long-lived.
+func (c *Client) Stream(ctx context.Context, path string, fn func(e *Event) error) error {
+	req, err := http.NewRequest("GET", c.BaseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &StatusError{URL: req.URL.String(), Code: resp.StatusCode}
+	}
+
+	return readEvents(resp.Body, func(e *Event) error {
+		switch e.Name {
+		case "put", "patch":
+			return fn(e)
+		case "cancel", "auth_revoked":
+			return ErrStreamCancelled
+		}
+		return nil // keep-alive
+	})
+}
+
+// readEvents parses a text/event-stream body, calling fn for each event found.
+// It returns when the stream ends, or fn returns an error.
+func readEvents(r io.Reader, fn func(e *Event) error) error {
+	var (
+		name string
+		data []string
+	)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16*1024*1024) // The initial top stories event might be sizable.
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "": // Dispatch the event.
+			if name != "" {
+				e := &Event{Name: name}
+				if payload := strings.Join(data, "\n"); payload != "null" && payload != "" {
+					if err := json.Unmarshal([]byte(payload), e); err != nil {
+						return err
+					}
+				}
+				if err := fn(e); err != nil {
+					return err
+				}
+			}
+			name, data = "", nil
+		case strings.HasPrefix(line, "event:"):
+			name = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimSpace(strings.TrimPrefix(line, "data:")))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
@@ -0,0 +1,135 @@
+package hnapi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadEvents(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		want   []string // name path data, for each event.
+		err    bool
+	}{
+		{
+			name:   "put",
+			stream: "event: put\ndata: {\"path\":\"/\",\"data\":[1,2,3]}\n\n",
+			want:   []string{"put / [1,2,3]"},
+		},
+		{
+			name:   "multi-line data",
+			stream: "event: patch\ndata: {\"path\":\"/\",\ndata: \"data\":{\"1\":8863}}\n\n",
+			want:   []string{"patch / {\"1\":8863}"},
+		},
+		{
+			name:   "keep-alive",
+			stream: "event: keep-alive\ndata: null\n\nevent: put\ndata: {\"path\":\"/0\",\"data\":8863}\n\n",
+			want:   []string{"keep-alive  ", "put /0 8863"},
+		},
+		{
+			name:   "comments and blank lines",
+			stream: ": comment\n\n\nevent: put\ndata: {\"path\":\"/\",\"data\":1}\n\n",
+			want:   []string{"put / 1"},
+		},
+		{
+			name:   "truncated event",
+			stream: "event: put\ndata: {\"path\":\"/\",\"data\":1}\n\nevent: put\ndata: {\"path\":\"/\",\"data\":2}\n",
+			want:   []string{"put / 1"},
+		},
+		{
+			name:   "invalid data",
+			stream: "event: put\ndata: {\"path\":\n\n",
+			err:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			err := readEvents(strings.NewReader(tt.stream), func(e *Event) error {
+				got = append(got, fmt.Sprintf("%s %s %s", e.Name, e.Path, string(e.Data)))
+				return nil
+			})
+			if tt.err {
+				if err == nil || err == io.EOF {
+					t.Fatalf("readEvents() = %v, want a parse error", err)
+				}
+				return
+			}
+			if err != io.EOF {
+				t.Fatalf("readEvents() = %v, want io.EOF", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("events = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadEventsStop(t *testing.T) {
+	errStop := fmt.Errorf("stop")
+	stream := "event: put\ndata: {\"path\":\"/\",\"data\":1}\n\nevent: put\ndata: {\"path\":\"/\",\"data\":2}\n\n"
+	n := 0
+	err := readEvents(strings.NewReader(stream), func(e *Event) error {
+		n++
+		return errStop
+	})
+	if err != errStop || n != 1 {
+		t.Errorf("readEvents() = %v after %d events, want %v after 1", err, n, errStop)
+	}
+}
+
+func TestStreamReconnect(t *testing.T) {
+	// Each connection gets a single event, and is then closed by the server.
+	conns := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conns++
+		if r.Header.Get("Accept") != "text/event-stream" {
+			t.Errorf("Accept = %q", r.Header.Get("Accept"))
+		}
+		if conns == 3 {
+			fmt.Fprint(w, "event: cancel\ndata: null\n\n")
+			return
+		}
+		fmt.Fprint(w, "event: keep-alive\ndata: null\n\n")
+		fmt.Fprintf(w, "event: put\ndata: {\"path\":\"/\",\"data\":%d}\n\n", conns)
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL, 0)
+	var got []string
+	fn := func(e *Event) error {
+		got = append(got, string(e.Data))
+		return nil
+	}
+	for i := 0; i < 2; i++ {
+		if err := c.Stream(context.Background(), "/topstories.json", fn); err != io.EOF {
+			t.Fatalf("Stream() = %v, want io.EOF", err)
+		}
+	}
+	if err := c.Stream(context.Background(), "/topstories.json", fn); err != ErrStreamCancelled {
+		t.Fatalf("Stream() = %v, want ErrStreamCancelled", err)
+	}
+	if want := []string{"1", "2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+}
+
+func TestStreamStatus(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+
+	err := NewClient(ts.URL, 0).Stream(context.Background(), "/updates.json", func(e *Event) error { return nil })
+	if se, ok := err.(*StatusError); !ok || se.Code != http.StatusUnauthorized {
+		t.Errorf("Stream() = %v, want a 401 StatusError", err)
+	}
+}
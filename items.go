@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/ichinaski/hnnotifications/hnapi"
+)
+
+const (
+	defaultItemRetention = 7 * 24 * time.Hour // Age of the stored items dropped, unless configured.
+	maxSnapshots         = 2000               // Snapshots kept per item, by the backends storing them along with the item.
+
+	velocityWindow  = time.Hour        // Sliding window the item velocity is computed over.
+	minVelocitySpan = 10 * time.Minute // Minimum time covered by the snapshots for the velocity to be computed.
+)
+
+// StoredItem is the latest metadata of a fetched item, along with its score and
+// comment count history.
+type StoredItem struct {
+	Id        int        `bson:"_id"`
+	By        string     `bson:"by"`
+	Title     string     `bson:"title"`
+	Url       string     `bson:"url"`
+	Type      string     `bson:"type"`
+	Time      int64      `bson:"time"` // Creation date, in Unix Time.
+	Score     int        `bson:"score"`
+	Comments  int        `bson:"comments"`
+	FirstSeen time.Time  `bson:"firstSeen"` // Time of the first fetch.
+	FetchedAt time.Time  `bson:"fetchedAt"` // Time of the last fetch.
+	Snapshots []Snapshot `bson:"snapshots"` // Oldest first. Not loaded by findItems.
+}
+
+// Snapshot records the score and comment count of an item at a given time.
+type Snapshot struct {
+	At       time.Time `bson:"at"`
+	Score    int       `bson:"score"`
+	Comments int       `bson:"comments"`
+}
+
+// newStoredItem creates the StoredItem of the item, fetched at the given time.
+func newStoredItem(item *hnapi.Item, at time.Time) *StoredItem {
+	return &StoredItem{
+		Id:        item.Id,
+		By:        item.By,
+		Title:     item.Title,
+		Url:       item.Url,
+		Type:      item.Type,
+		Time:      item.Time,
+		Score:     item.Score,
+		Comments:  item.Descendants,
+		FirstSeen: at,
+		FetchedAt: at,
+	}
+}
+
+// item returns the stored metadata as an hnapi.Item. Comment ids are not stored.
+func (si *StoredItem) item() hnapi.Item {
+	return hnapi.Item{
+		Id:          si.Id,
+		By:          si.By,
+		Title:       si.Title,
+		Url:         si.Url,
+		Type:        si.Type,
+		Time:        si.Time,
+		Score:       si.Score,
+		Descendants: si.Comments,
+	}
+}
+
+// velocity returns the points per hour gained by the item over the velocityWindow,
+// from the oldest snapshot within the window up to its current score. It is zero
+// until the snapshots cover the minVelocitySpan.
+func velocity(db Store, item *hnapi.Item, now time.Time) float64 {
+	snapshots, err := db.findSnapshots(item.Id, now.Add(-velocityWindow))
+	if err != nil {
+		Logger.Println("Error: findSnapshots() - ", err)
+		return 0
+	}
+	if len(snapshots) == 0 {
+		return 0
+	}
+	span := now.Sub(snapshots[0].At)
+	if span < minVelocitySpan {
+		return 0
+	}
+	return float64(item.Score-snapshots[0].Score) / span.Hours()
+}
+
+// unchangedItems splits the ids into the items to fetch, and the stored items
+// reused instead: those fetched within the configured itemRefresh, and not listed
+// by the API as recently updated. Reuse is disabled unless itemRefresh is set.
+func unchangedItems(ctx context.Context, db Store, ids []int) ([]int, []hnapi.Item) {
+	refresh := config.ItemRefresh()
+	if refresh == 0 {
+		return ids, nil
+	}
+	updated, err := hn.Updates(ctx)
+	if err != nil {
+		Logger.Println("Error reading the updated items: ", err)
+		return ids, nil
+	}
+	stored, err := db.findItems(ids)
+	if err != nil {
+		Logger.Println("Error: findItems() - ", err)
+		return ids, nil
+	}
+
+	fresh := make(map[int]*StoredItem)
+	for i := range stored {
+		if si := &stored[i]; time.Since(si.FetchedAt) < refresh && !containsInt(updated, si.Id) {
+			fresh[si.Id] = si
+		}
+	}
+	var (
+		fetch  []int
+		reused []hnapi.Item
+	)
+	for _, id := range ids {
+		if si, ok := fresh[id]; ok {
+			reused = append(reused, si.item())
+		} else {
+			fetch = append(fetch, id)
+		}
+	}
+	return fetch, reused
+}
+
+// withItems returns a channel sending the given items, followed by the ones
+// received from in. It is closed once in is closed, or the context is done.
+func withItems(ctx context.Context, items []hnapi.Item, in <-chan hnapi.Item) <-chan hnapi.Item {
+	out := make(chan hnapi.Item)
+	go func() {
+		defer close(out)
+		for _, item := range items {
+			select {
+			case out <- item:
+			case <-ctx.Done():
+				return
+			}
+		}
+		for item := range in {
+			select {
+			case out <- item:
+			case <-ctx.Done():
+				// Drain in, so that its sender is not blocked.
+			}
+		}
+	}()
+	return out
+}
@@ -18,3 +18,40 @@ func Keywords(s string) []string {
 	}
 	return strings.FieldsFunc(s, f)
 }
+
+// defaultSynonyms maps canonical terms to their aliases. The "synonyms" config
+// setting extends it.
+var defaultSynonyms = map[string][]string{
+	"go":         {"golang"},
+	"postgres":   {"postgresql"},
+	"javascript": {"js"},
+	"kubernetes": {"k8s"},
+}
+
+// aliasTable builds the alias to canonical term lookup table from a synonyms
+// setting, on top of defaultSynonyms.
+func aliasTable(synonyms map[string][]string) map[string]string {
+	aliases := make(map[string]string)
+	for _, table := range []map[string][]string{defaultSynonyms, synonyms} {
+		for term, list := range table {
+			term = strings.ToLower(term)
+			for _, alias := range list {
+				aliases[strings.ToLower(alias)] = term
+			}
+		}
+	}
+	return aliases
+}
+
+// Normalize maps each word (as returned by Keywords) to its normalized term: aliases
+// are replaced by their canonical term, which is then reduced to its stem.
+func Normalize(words []string) []string {
+	terms := make([]string, len(words))
+	for i, w := range words {
+		if t, ok := config.aliases[w]; ok {
+			w = t
+		}
+		terms[i] = stem(w)
+	}
+	return terms
+}
@@ -44,6 +44,22 @@ func sendVerification(to, link string) {
 	}
 }
 
+// sendChannelVerification delivers an email with the verification link of an email channel.
+func sendChannelVerification(to, link string) error {
+	subject := "HN Notifications - Channel verification needed"
+	message, err := loadEmail("verify_channel_email", map[string]string{"link": link})
+	if err != nil {
+		return err
+	}
+
+	e := email.NewEmail()
+	e.From = config.Email
+	e.To = []string{to}
+	e.Subject = subject
+	e.HTML = message
+	return e.Send(config.SMTP.Addr, auth())
+}
+
 // sendUnsubscription delivers an email with the unsubscription link.
 func sendUnsubscription(to, link string) error {
 	subject := "HN Notifications - Unsubscribe"
@@ -60,14 +76,69 @@ func sendUnsubscription(to, link string) error {
 	return e.Send(config.SMTP.Addr, auth())
 }
 
-// sendItem delivers a notification email for the given item.
-func sendItem(id int, title, url string, bcc []string) error {
+// sendDeliveryLog delivers an email with the link to the webhook delivery log.
+func sendDeliveryLog(to, link string) error {
+	subject := "HN Notifications - Webhook delivery log"
+	message, err := loadEmail("webhooks_email", map[string]string{"link": link})
+	if err != nil {
+		return err
+	}
+
+	e := email.NewEmail()
+	e.From = config.Email
+	e.To = []string{to}
+	e.Subject = subject
+	e.HTML = message
+	return e.Send(config.SMTP.Addr, auth())
+}
+
+// sendTokensLink delivers an email with the link to the API tokens page.
+func sendTokensLink(to, link string) error {
+	subject := "HN Notifications - API tokens"
+	message, err := loadEmail("tokens_email", map[string]string{"link": link})
+	if err != nil {
+		return err
+	}
+
+	e := email.NewEmail()
+	e.From = config.Email
+	e.To = []string{to}
+	e.Subject = subject
+	e.HTML = message
+	return e.Send(config.SMTP.Addr, auth())
+}
+
+// sendFeedLinks delivers an email with the link to the feed links.
+func sendFeedLinks(to, link string) error {
+	subject := "HN Notifications - Your feeds"
+	message, err := loadEmail("feeds_email", map[string]string{"link": link})
+	if err != nil {
+		return err
+	}
+
+	e := email.NewEmail()
+	e.From = config.Email
+	e.To = []string{to}
+	e.Subject = subject
+	e.HTML = message
+	return e.Send(config.SMTP.Addr, auth())
+}
+
+// sendItem delivers a notification email for the given item, matched by the named rule.
+// The watch link, if any, (un)watches the item. See watchLink.
+func sendItem(id int, title, url, rule, to, watch string) error {
 	data := map[string]string{
 		"title":      title,
+		"rule":       rule,
 		"link":       url,
 		"discussion": fmt.Sprintf(commentsUrl, id),
+		"watch":      watch,
+		"unwatch":    "",
 		"settings":   config.Url + "/settings",
 	}
+	if rule == reasonWatch {
+		data["watch"], data["unwatch"] = "", watch
+	}
 	message, err := loadEmail("item_email", data)
 	if err != nil {
 		return err
@@ -75,12 +146,65 @@ func sendItem(id int, title, url string, bcc []string) error {
 
 	e := email.NewEmail()
 	e.From = config.Email
-	e.Bcc = bcc
+	e.To = []string{to}
 	e.Subject = title
 	e.HTML = message
 	return e.Send(config.SMTP.Addr, auth())
 }
 
+// sendComment delivers a comment alert email, along with the comment excerpt.
+func sendComment(to string, item QueuedItem, text string) error {
+	data := map[string]string{
+		"title":    item.Title,
+		"text":     text,
+		"link":     item.discussion(),
+		"reason":   item.Rule,
+		"settings": config.Url + "/settings",
+	}
+	message, err := loadEmail("comment_email", data)
+	if err != nil {
+		return err
+	}
+
+	e := email.NewEmail()
+	e.From = config.Email
+	e.To = []string{to}
+	e.Subject = item.Title
+	e.HTML = message
+	return e.Send(config.SMTP.Addr, auth())
+}
+
+// digestItem is a QueuedItem, as rendered in the digest template.
+type digestItem struct {
+	QueuedItem
+	Discussion string
+}
+
+// sendDigest delivers a digest email with the given items, already sorted. Items
+// held back from immediate delivery are sent the same way.
+func sendDigest(to, mode string, items []QueuedItem) error {
+	list := make([]digestItem, len(items))
+	for i, item := range items {
+		list[i] = digestItem{item, item.discussion()}
+	}
+	data := map[string]interface{}{
+		"mode":     mode,
+		"items":    list,
+		"settings": config.Url + "/settings",
+	}
+	message, err := loadEmail("digest_email", data)
+	if err != nil {
+		return err
+	}
+
+	e := email.NewEmail()
+	e.From = config.Email
+	e.To = []string{to}
+	e.Subject = "HN Notifications - " + digestMessage(mode, items).Subject
+	e.HTML = message
+	return e.Send(config.SMTP.Addr, auth())
+}
+
 // validateAddress is a simple email validation function.
 func validateAddress(email string) bool {
 	_, err := mail.ParseAddress(email)
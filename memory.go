@@ -0,0 +1,924 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ichinaski/hnnotifications/hnapi"
+)
+
+var errUserNotFound = errors.New("user not found")
+
+// memoryStore is a Store keeping all the data in memory. It is meant for tests
+// and small deployments, as nothing survives a restart.
+type memoryStore struct {
+	sync.Mutex
+	users      map[Id]*User
+	runs       map[Id]Run
+	deliveries map[Id]WebhookDelivery
+	items      map[int]*StoredItem
+	comments   map[int]time.Time // Seen comments.
+	accounts   map[string]int    // Newest item seen of the followed accounts.
+	pending    map[Id]Channel    // Channels awaiting the confirmation link.
+}
+
+// newMemoryStore creates an empty memoryStore.
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		users:      make(map[Id]*User),
+		runs:       make(map[Id]Run),
+		deliveries: make(map[Id]WebhookDelivery),
+		items:      make(map[int]*StoredItem),
+		comments:   make(map[int]time.Time),
+		accounts:   make(map[string]int),
+		pending:    make(map[Id]Channel),
+	}
+}
+
+// close is a no-op. The same memoryStore is shared by all the callers.
+func (ms *memoryStore) close() {}
+
+// upsertUser inserts/updates a user into the store.
+func (ms *memoryStore) upsertUser(u *User) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	c := *u
+	ms.users[u.Id] = &c
+	return nil
+}
+
+// validate checks whether the user and token pair is valid, returning the user if found.
+func (ms *memoryStore) validate(email, token string) *User {
+	ms.Lock()
+	defer ms.Unlock()
+
+	if u := ms.lookup(email, token); u != nil {
+		c := *u
+		return &c
+	}
+	Logger.Printf("User validation error: %s - %s\n", email, token)
+	return nil
+}
+
+// lookup finds the user matching the email and token pair. The lock must be held.
+func (ms *memoryStore) lookup(email, token string) *User {
+	if email == "" || token == "" {
+		return nil
+	}
+	for _, u := range ms.users {
+		if u.Email == email && u.Token == token {
+			return u
+		}
+	}
+	return nil
+}
+
+// activate sets the account status to 'active'.
+func (ms *memoryStore) activate(email, token string) bool {
+	ms.Lock()
+	defer ms.Unlock()
+
+	u := ms.lookup(email, token)
+	if u == nil {
+		return false
+	}
+	u.Active = true
+	u.Token = ""
+	return true
+}
+
+// unsubscribe completely removes the user account from the store.
+func (ms *memoryStore) unsubscribe(email, token string) bool {
+	ms.Lock()
+	defer ms.Unlock()
+
+	u := ms.lookup(email, token)
+	if u == nil {
+		return false
+	}
+	ms.remove(u.Id)
+	return true
+}
+
+// deleteUser completely removes the user account from the store. See unsubscribe.
+func (ms *memoryStore) deleteUser(uid Id) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	if _, ok := ms.users[uid]; !ok {
+		return errUserNotFound
+	}
+	ms.remove(uid)
+	return nil
+}
+
+// remove drops the user, along with its pending channel and webhook deliveries.
+// The lock must be held.
+func (ms *memoryStore) remove(uid Id) {
+	delete(ms.users, uid)
+	delete(ms.pending, uid)
+	for id, d := range ms.deliveries {
+		if d.UserId == uid {
+			delete(ms.deliveries, id)
+		}
+	}
+}
+
+// saveRule validates the user, adds the rule, replacing any rule with the same name,
+// and updates the delivery preferences, unless d is nil.
+func (ms *memoryStore) saveRule(email, token string, rule Rule, d *Delivery) bool {
+	ms.Lock()
+	defer ms.Unlock()
+
+	u := ms.lookup(email, token)
+	if u == nil {
+		return false
+	}
+	u.Rules = u.withRule(rule)
+	if d != nil {
+		u.Delivery = *d
+	}
+	u.Token = ""
+	u.Active = true
+	return true
+}
+
+// saveUserRule adds the rule to the user, replacing any rule with the same name, and
+// updates the delivery preferences, unless d is nil. See saveRule.
+func (ms *memoryStore) saveUserRule(uid Id, rule Rule, d *Delivery) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	u, ok := ms.users[uid]
+	if !ok {
+		return errUserNotFound
+	}
+	u.Rules = u.withRule(rule)
+	if d != nil {
+		u.Delivery = *d
+	}
+	return nil
+}
+
+// deleteRule validates the user and removes the named rule.
+func (ms *memoryStore) deleteRule(email, token, name string) bool {
+	ms.Lock()
+	defer ms.Unlock()
+
+	u := ms.lookup(email, token)
+	if u == nil {
+		return false
+	}
+	u.Rules = u.withoutRule(name)
+	u.Token = ""
+	u.Active = true
+	return true
+}
+
+// deleteUserRule removes the named rule from the user.
+func (ms *memoryStore) deleteUserRule(uid Id, name string) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	u, ok := ms.users[uid]
+	if !ok {
+		return errUserNotFound
+	}
+	u.Rules = u.withoutRule(name)
+	return nil
+}
+
+// addChannel validates the user and adds the (unverified) channel, activating the account.
+func (ms *memoryStore) addChannel(email, token string, c Channel) bool {
+	ms.Lock()
+	defer ms.Unlock()
+
+	u := ms.lookup(email, token)
+	if u == nil {
+		return false
+	}
+	u.Channels = append(u.Channels[:len(u.Channels):len(u.Channels)], c)
+	u.Token = ""
+	u.Active = true
+	return true
+}
+
+// addUserChannel adds the (unverified) channel to the user.
+func (ms *memoryStore) addUserChannel(uid Id, c Channel) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	u, ok := ms.users[uid]
+	if !ok {
+		return errUserNotFound
+	}
+	u.Channels = append(u.Channels[:len(u.Channels):len(u.Channels)], c)
+	return nil
+}
+
+// deleteChannel validates the user and removes the channel with the given id, along
+// with its pending webhook deliveries.
+func (ms *memoryStore) deleteChannel(email, token, id string) bool {
+	ms.Lock()
+	defer ms.Unlock()
+
+	u := ms.lookup(email, token)
+	if u == nil {
+		return false
+	}
+	ms.dropChannel(u, id)
+	u.Token = ""
+	u.Active = true
+	return true
+}
+
+// deleteUserChannel removes the user channel with the given id, along with its
+// pending webhook deliveries.
+func (ms *memoryStore) deleteUserChannel(uid Id, id string) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	u, ok := ms.users[uid]
+	if !ok {
+		return errUserNotFound
+	}
+	ms.dropChannel(u, id)
+	return nil
+}
+
+// dropChannel removes the user channel with the given id, along with its pending
+// webhook deliveries. The lock must be held.
+func (ms *memoryStore) dropChannel(u *User, id string) {
+	var channels []Channel
+	for _, c := range u.Channels {
+		if c.Id != id {
+			channels = append(channels, c)
+		}
+	}
+	u.Channels = channels
+	for did, d := range ms.deliveries {
+		if d.UserId == u.Id && d.ChannelId == id && d.Status == hookPending {
+			delete(ms.deliveries, did)
+		}
+	}
+}
+
+// verifyChannel marks the user channel as verified, if the verification token matches.
+func (ms *memoryStore) verifyChannel(email, id, token string) bool {
+	ms.Lock()
+	defer ms.Unlock()
+
+	u := ms.byEmail(email)
+	if u == nil || token == "" {
+		return false
+	}
+	channels := append([]Channel(nil), u.Channels...) // Copies handed out share the old slice.
+	for i := range channels {
+		if c := &channels[i]; c.Id == id && c.Token == token {
+			c.Verified = true
+			c.Token = ""
+			u.Channels = channels
+			return true
+		}
+	}
+	return false
+}
+
+// findUsersForItem queries all users entitled to receive a given story.
+func (ms *memoryStore) findUsersForItem(s *story) []User {
+	ms.Lock()
+	defer ms.Unlock()
+
+	var result []User
+	for _, u := range ms.users {
+		if u.matches(s) {
+			result = append(result, *u)
+		}
+	}
+	return result
+}
+
+// updateSentItems adds the given item to each user's item set.
+func (ms *memoryStore) updateSentItems(emails []string, item int) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	for _, email := range emails {
+		if u := ms.byEmail(email); u != nil && !u.hasSent(item) {
+			u.SentItems = append(u.SentItems, item)
+		}
+	}
+	return nil
+}
+
+// queueItem adds the given item to each user's queue, for digests and held items.
+func (ms *memoryStore) queueItem(emails []string, item QueuedItem) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	for _, email := range emails {
+		if u := ms.byEmail(email); u != nil {
+			u.Queue = append(u.Queue[:len(u.Queue):len(u.Queue)], item)
+		}
+	}
+	return nil
+}
+
+// findQueuedUsers queries the active users with queued items.
+func (ms *memoryStore) findQueuedUsers() ([]User, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	var result []User
+	for _, u := range ms.users {
+		if u.Active && len(u.Queue) > 0 {
+			result = append(result, *u)
+		}
+	}
+	return result, nil
+}
+
+// clearQueue removes the given items from the user's queue, recording the digest time.
+func (ms *memoryStore) clearQueue(uid Id, ids []int, at time.Time) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	u, ok := ms.users[uid]
+	if !ok {
+		return errUserNotFound
+	}
+	var queue []QueuedItem
+	for _, item := range u.Queue {
+		if !containsInt(ids, item.Id) {
+			queue = append(queue, item)
+		}
+	}
+	u.Queue = queue
+	u.LastDigest = at
+	return nil
+}
+
+// recordSend records an email sent to each user at the given time, for the email caps.
+// Records older than a day are dropped.
+func (ms *memoryStore) recordSend(emails []string, at time.Time) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	for _, email := range emails {
+		u := ms.byEmail(email)
+		if u == nil {
+			continue
+		}
+		var sends []time.Time
+		for _, t := range u.Sends {
+			if at.Sub(t) < 24*time.Hour {
+				sends = append(sends, t)
+			}
+		}
+		u.Sends = append(sends, at)
+	}
+	return nil
+}
+
+// recordMatch adds the given item to each user's match history, unless already there.
+// Only the last maxHistory items are kept.
+func (ms *memoryStore) recordMatch(emails []string, item QueuedItem) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	for _, email := range emails {
+		u := ms.byEmail(email)
+		if u == nil {
+			continue
+		}
+		seen := false
+		for _, h := range u.History {
+			seen = seen || h.Id == item.Id
+		}
+		if seen {
+			continue
+		}
+		history := append(u.History[:len(u.History):len(u.History)], item)
+		if len(history) > maxHistory {
+			history = history[len(history)-maxHistory:]
+		}
+		u.History = history
+	}
+	return nil
+}
+
+// findHistory queries the most recently matched items of the user, newest first.
+func (ms *memoryStore) findHistory(uid Id, limit int) ([]QueuedItem, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	u, ok := ms.users[uid]
+	if !ok {
+		return nil, errUserNotFound
+	}
+	var result []QueuedItem
+	for i := len(u.History) - 1; i >= 0 && len(result) < limit; i-- {
+		result = append(result, u.History[i])
+	}
+	return result, nil
+}
+
+// setFeedToken validates the user and assigns the feed token, activating the account.
+func (ms *memoryStore) setFeedToken(email, token, feedToken string) bool {
+	ms.Lock()
+	defer ms.Unlock()
+
+	u := ms.lookup(email, token)
+	if u == nil {
+		return false
+	}
+	u.FeedToken = feedToken
+	u.Token = ""
+	u.Active = true
+	return true
+}
+
+// findFeedUser queries a user by its feed token.
+func (ms *memoryStore) findFeedUser(feedToken string) (*User, bool) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	for _, u := range ms.users {
+		if feedToken != "" && u.FeedToken == feedToken {
+			c := *u
+			return &c, true
+		}
+	}
+	return &User{}, false
+}
+
+// saveWatch validates the user and replaces its comment watch, activating the account.
+func (ms *memoryStore) saveWatch(email, token string, w CommentWatch) bool {
+	ms.Lock()
+	defer ms.Unlock()
+
+	u := ms.lookup(email, token)
+	if u == nil {
+		return false
+	}
+	u.Watch = w
+	u.Token = ""
+	u.Active = true
+	return true
+}
+
+// findWatchers queries the active users watching comments.
+func (ms *memoryStore) findWatchers() ([]User, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	var result []User
+	for _, u := range ms.users {
+		if u.Active && u.Watch.active() {
+			result = append(result, *u)
+		}
+	}
+	return result, nil
+}
+
+// seenComments returns which of the given comments were seen before.
+func (ms *memoryStore) seenComments(ids []int) ([]int, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	var seen []int
+	for _, id := range ids {
+		if _, ok := ms.comments[id]; ok {
+			seen = append(seen, id)
+		}
+	}
+	return seen, nil
+}
+
+// markSeen records the given comments as seen at the given time. Records older
+// than commentRetention are dropped.
+func (ms *memoryStore) markSeen(ids []int, at time.Time) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	for _, id := range ids {
+		ms.comments[id] = at
+	}
+	for id, t := range ms.comments {
+		if t.Before(at.Add(-commentRetention)) {
+			delete(ms.comments, id)
+		}
+	}
+	return nil
+}
+
+// saveFollowing validates the user and replaces the followed accounts, activating the account.
+func (ms *memoryStore) saveFollowing(email, token string, usernames []string) bool {
+	ms.Lock()
+	defer ms.Unlock()
+
+	u := ms.lookup(email, token)
+	if u == nil {
+		return false
+	}
+	u.Following = usernames
+	u.Token = ""
+	u.Active = true
+	return true
+}
+
+// findFollowers queries the active users following any account.
+func (ms *memoryStore) findFollowers() ([]User, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	var result []User
+	for _, u := range ms.users {
+		if u.Active && len(u.Following) > 0 {
+			result = append(result, *u)
+		}
+	}
+	return result, nil
+}
+
+// lastSubmissions returns the newest item seen of each followed account.
+func (ms *memoryStore) lastSubmissions() (map[string]int, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	last := make(map[string]int, len(ms.accounts))
+	for name, id := range ms.accounts {
+		last[name] = id
+	}
+	return last, nil
+}
+
+// saveSubmissions replaces the newest item seen of the followed accounts. Accounts
+// left out are dropped.
+func (ms *memoryStore) saveSubmissions(last map[string]int) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	ms.accounts = make(map[string]int, len(last))
+	for name, id := range last {
+		ms.accounts[name] = id
+	}
+	return nil
+}
+
+// saveWatchedItem adds the watched story to the user, or updates it if already watched.
+func (ms *memoryStore) saveWatchedItem(uid Id, w WatchedItem) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	u, ok := ms.users[uid]
+	if !ok {
+		return errUserNotFound
+	}
+	watched := make([]WatchedItem, 0, len(u.Watched)+1)
+	for _, old := range u.Watched {
+		if old.Id != w.Id {
+			watched = append(watched, old)
+		}
+	}
+	u.Watched = append(watched, w)
+	return nil
+}
+
+// deleteWatchedItem removes the watched story from the user.
+func (ms *memoryStore) deleteWatchedItem(uid Id, id int) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	u, ok := ms.users[uid]
+	if !ok {
+		return errUserNotFound
+	}
+	var watched []WatchedItem
+	for _, w := range u.Watched {
+		if w.Id != id {
+			watched = append(watched, w)
+		}
+	}
+	u.Watched = watched
+	return nil
+}
+
+// findWatching queries the active users watching any story.
+func (ms *memoryStore) findWatching() ([]User, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	var result []User
+	for _, u := range ms.users {
+		if u.Active && len(u.Watched) > 0 {
+			result = append(result, *u)
+		}
+	}
+	return result, nil
+}
+
+// savePendingChannel replaces the channel of the user awaiting the confirmation link.
+func (ms *memoryStore) savePendingChannel(uid Id, c Channel) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	if _, ok := ms.users[uid]; !ok {
+		return errUserNotFound
+	}
+	ms.pending[uid] = c
+	return nil
+}
+
+// takePendingChannel removes and returns the channel of the user awaiting the
+// confirmation link, if its id matches.
+func (ms *memoryStore) takePendingChannel(uid Id, id string) (*Channel, bool) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	c, ok := ms.pending[uid]
+	if !ok || id == "" || c.Id != id {
+		return nil, false
+	}
+	delete(ms.pending, uid)
+	return &c, true
+}
+
+// saveAPIToken adds the API token to the user.
+func (ms *memoryStore) saveAPIToken(uid Id, t APIToken) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	u, ok := ms.users[uid]
+	if !ok {
+		return errUserNotFound
+	}
+	u.Tokens = append(u.Tokens[:len(u.Tokens):len(u.Tokens)], t)
+	return nil
+}
+
+// deleteAPIToken removes the API token with the given id from the user.
+func (ms *memoryStore) deleteAPIToken(uid Id, id string) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	u, ok := ms.users[uid]
+	if !ok {
+		return errUserNotFound
+	}
+	var tokens []APIToken
+	for _, t := range u.Tokens {
+		if t.Id != id {
+			tokens = append(tokens, t)
+		}
+	}
+	u.Tokens = tokens
+	return nil
+}
+
+// touchAPIToken records the last use of the user API token with the given id.
+func (ms *memoryStore) touchAPIToken(uid Id, id string, at time.Time) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	u, ok := ms.users[uid]
+	if !ok {
+		return errUserNotFound
+	}
+	tokens := make([]APIToken, len(u.Tokens))
+	copy(tokens, u.Tokens)
+	for i := range tokens {
+		if tokens[i].Id == id {
+			tokens[i].LastUsed = at
+		}
+	}
+	u.Tokens = tokens
+	return nil
+}
+
+// findTokenUser queries a user by the hash of one of its API tokens.
+func (ms *memoryStore) findTokenUser(hash string) (*User, bool) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	for _, u := range ms.users {
+		for _, t := range u.Tokens {
+			if t.Hash == hash {
+				c := *u
+				return &c, true
+			}
+		}
+	}
+	return &User{}, false
+}
+
+// saveItem stores the latest metadata of the item, fetched at the given time, and
+// records its score and comment count.
+func (ms *memoryStore) saveItem(item *hnapi.Item, at time.Time) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	si := newStoredItem(item, at)
+	if old, ok := ms.items[item.Id]; ok {
+		si.FirstSeen = old.FirstSeen
+		si.Snapshots = old.Snapshots
+	}
+	si.Snapshots = append(si.Snapshots[:len(si.Snapshots):len(si.Snapshots)], Snapshot{at, item.Score, item.Descendants})
+	if len(si.Snapshots) > maxSnapshots {
+		si.Snapshots = si.Snapshots[len(si.Snapshots)-maxSnapshots:]
+	}
+	ms.items[item.Id] = si
+	return nil
+}
+
+// saveSnapshot records the score and comment count of the stored item, leaving the
+// item itself, and its fetch time, untouched.
+func (ms *memoryStore) saveSnapshot(id int, s Snapshot) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	si, ok := ms.items[id]
+	if !ok {
+		return nil
+	}
+	c := *si
+	c.Snapshots = append(c.Snapshots[:len(c.Snapshots):len(c.Snapshots)], s)
+	if len(c.Snapshots) > maxSnapshots {
+		c.Snapshots = c.Snapshots[len(c.Snapshots)-maxSnapshots:]
+	}
+	ms.items[id] = &c
+	return nil
+}
+
+// findItems queries the stored items with the given ids, without their snapshots.
+func (ms *memoryStore) findItems(ids []int) ([]StoredItem, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	var result []StoredItem
+	for _, id := range ids {
+		if si, ok := ms.items[id]; ok {
+			c := *si
+			c.Snapshots = nil
+			result = append(result, c)
+		}
+	}
+	return result, nil
+}
+
+// findSnapshots queries the snapshots of the item taken since the given time, oldest first.
+func (ms *memoryStore) findSnapshots(id int, since time.Time) ([]Snapshot, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	var result []Snapshot
+	if si, ok := ms.items[id]; ok {
+		for _, snap := range si.Snapshots {
+			if !snap.At.Before(since) {
+				result = append(result, snap)
+			}
+		}
+	}
+	return result, nil
+}
+
+// pruneItems removes the items last fetched before the given time, and the snapshots
+// taken before then.
+func (ms *memoryStore) pruneItems(before time.Time) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	for id, si := range ms.items {
+		if si.FetchedAt.Before(before) {
+			delete(ms.items, id)
+			continue
+		}
+		var snapshots []Snapshot
+		for _, snap := range si.Snapshots {
+			if !snap.At.Before(before) {
+				snapshots = append(snapshots, snap)
+			}
+		}
+		si.Snapshots = snapshots
+	}
+	return nil
+}
+
+// saveDelivery inserts/updates a webhook delivery.
+func (ms *memoryStore) saveDelivery(d *WebhookDelivery) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	ms.deliveries[d.Id] = *d
+	return nil
+}
+
+// dueDeliveries queries the pending webhook deliveries due for a retry at the given time.
+func (ms *memoryStore) dueDeliveries(now time.Time) ([]WebhookDelivery, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	var result []WebhookDelivery
+	for _, d := range ms.deliveries {
+		if d.Status == hookPending && !d.NextAttempt.After(now) {
+			result = append(result, d)
+		}
+	}
+	return result, nil
+}
+
+// findDeliveries queries the most recent webhook deliveries of the user, newest first.
+func (ms *memoryStore) findDeliveries(uid Id, limit int) ([]WebhookDelivery, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	var result []WebhookDelivery
+	for _, d := range ms.deliveries {
+		if d.UserId == uid {
+			result = append(result, d)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].CreatedAt.After(result[j].CreatedAt) })
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+// pruneDeliveries removes the finished webhook deliveries last attempted before the given time.
+func (ms *memoryStore) pruneDeliveries(before time.Time) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	for id, d := range ms.deliveries {
+		if d.Status != hookPending && d.UpdatedAt.Before(before) {
+			delete(ms.deliveries, id)
+		}
+	}
+	return nil
+}
+
+// updateToken assigns the new token to the user.
+func (ms *memoryStore) updateToken(uid Id, token string) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	u, ok := ms.users[uid]
+	if !ok {
+		return errUserNotFound
+	}
+	u.Token = token
+	return nil
+}
+
+// findUser queries a user by its email field.
+func (ms *memoryStore) findUser(email string) (*User, bool) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	if u := ms.byEmail(email); u != nil {
+		c := *u
+		return &c, true
+	}
+	return &User{}, false
+}
+
+// byEmail finds a user by its email field. The lock must be held.
+func (ms *memoryStore) byEmail(email string) *User {
+	for _, u := range ms.users {
+		if u.Email == email {
+			return u
+		}
+	}
+	return nil
+}
+
+// saveRun inserts/updates a scheduler run.
+func (ms *memoryStore) saveRun(r *Run) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	ms.runs[r.Id] = *r
+	return nil
+}
+
+// lastRun returns the most recently started run of the given job.
+func (ms *memoryStore) lastRun(job string) (*Run, bool) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	var last *Run
+	for _, r := range ms.runs {
+		if r.Job == job && (last == nil || r.Start.After(last.Start)) {
+			c := r
+			last = &c
+		}
+	}
+	if last == nil {
+		return &Run{}, false
+	}
+	return last, true
+}
@@ -0,0 +1,977 @@
+package main
+
+import (
+	"time"
+
+	"github.com/ichinaski/hnnotifications/hnapi"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+var (
+	session *mgo.Session // Though global, this session is meant to be copied for each database instance.
+)
+
+// initMongo sets up the MongoDB connection and indexes. Panics upon error.
+func initMongo() {
+	var err error
+	session, err = mgo.Dial(config.DBAddr)
+	if err != nil {
+		panic(err)
+	}
+	Logger.Println("Connected to MongoDB")
+
+	session.EnsureSafe(&mgo.Safe{})
+
+	db := newDatabase()
+	defer db.close()
+
+	// ensure indexes
+	if err := db.users.EnsureIndex(mgo.Index{
+		Key:    []string{"email"},
+		Unique: true,
+	}); err != nil {
+		panic(err)
+	}
+
+	if err := db.users.EnsureIndex(mgo.Index{
+		Key:    []string{"email", "token"},
+		Unique: true,
+	}); err != nil {
+		panic(err)
+	}
+
+	// Rules and sent items are both arrays, which a compound index cannot span.
+	if err := db.users.EnsureIndex(mgo.Index{
+		Key: []string{"rules.score", "active"},
+	}); err != nil {
+		panic(err)
+	}
+
+	if err := db.users.EnsureIndex(mgo.Index{
+		Key: []string{"sentItems"},
+	}); err != nil {
+		panic(err)
+	}
+
+	if err := db.users.EnsureIndex(mgo.Index{
+		Key: []string{"rules.velocity", "active"},
+	}); err != nil {
+		panic(err)
+	}
+
+	if err := db.users.EnsureIndex(mgo.Index{
+		Key:    []string{"feedToken"},
+		Unique: true,
+		Sparse: true,
+	}); err != nil {
+		panic(err)
+	}
+
+	if err := db.users.EnsureIndex(mgo.Index{
+		Key: []string{"following", "active"},
+	}); err != nil {
+		panic(err)
+	}
+
+	if err := db.users.EnsureIndex(mgo.Index{
+		Key: []string{"watched.id", "active"},
+	}); err != nil {
+		panic(err)
+	}
+
+	if err := db.users.EnsureIndex(mgo.Index{
+		Key: []string{"tokens.hash"},
+	}); err != nil {
+		panic(err)
+	}
+
+	if err := db.migrateRules(); err != nil {
+		panic(err)
+	}
+
+	// Webhook secrets and feed tokens of the users created before webhooks were
+	// signed, and before the feeds were introduced. See sign and watchLink.
+	if err := db.migrateTokens("webhookSecret", "webhook secrets"); err != nil {
+		panic(err)
+	}
+
+	if err := db.migrateTokens("feedToken", "feed tokens"); err != nil {
+		panic(err)
+	}
+
+	if err := db.runs.EnsureIndex(mgo.Index{
+		Key: []string{"job", "-start"},
+	}); err != nil {
+		panic(err)
+	}
+
+	if err := db.items.EnsureIndex(mgo.Index{
+		Key: []string{"fetchedAt"},
+	}); err != nil {
+		panic(err)
+	}
+
+	if err := db.comments.EnsureIndex(mgo.Index{
+		Key: []string{"seenAt"},
+	}); err != nil {
+		panic(err)
+	}
+
+	if err := db.deliveries.EnsureIndex(mgo.Index{
+		Key: []string{"status", "nextAttempt"},
+	}); err != nil {
+		panic(err)
+	}
+
+	if err := db.deliveries.EnsureIndex(mgo.Index{
+		Key: []string{"userId", "-createdAt"},
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// legacySettings lists the fields of the users created before rules were introduced,
+// when each user had a single set of Settings.
+var legacySettings = []string{
+	"score", "query", "keywords", "exact", "article", "feeds", "types", "authors",
+	"maxAge", "minComments", "domains", "blockedDomains",
+}
+
+// migrateRules moves the settings of the users created before rules were introduced
+// into a rule named defaultRule.
+func (db *Database) migrateRules() error {
+	type legacyUser struct {
+		Id       bson.ObjectId `bson:"_id"`
+		Settings `bson:",inline"`
+	}
+	unset := bson.M{}
+	for _, field := range legacySettings {
+		unset[field] = ""
+	}
+
+	iter := db.users.Find(bson.M{"rules": bson.M{"$exists": false}}).Iter()
+	n := 0
+	for {
+		var legacy legacyUser
+		if !iter.Next(&legacy) {
+			break
+		}
+		update := bson.M{
+			"$set":   bson.M{"rules": []Rule{{Name: defaultRule, Settings: legacy.Settings}}},
+			"$unset": unset,
+		}
+		if err := db.users.UpdateId(legacy.Id, update); err != nil {
+			iter.Close()
+			return err
+		}
+		n++
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	if n > 0 {
+		Logger.Printf("Migrated %d users to rules\n", n)
+	}
+	return nil
+}
+
+// migrateTokens assigns a new token to the given field of the users missing it.
+func (db *Database) migrateTokens(field, name string) error {
+	query := bson.M{"$or": []bson.M{{field: bson.M{"$exists": false}}, {field: ""}}}
+	iter := db.users.Find(query).Select(bson.M{"_id": 1}).Iter()
+	n := 0
+	var u struct {
+		Id Id `bson:"_id"`
+	}
+	for iter.Next(&u) {
+		if err := db.users.UpdateId(u.Id, bson.M{"$set": bson.M{field: newToken()}}); err != nil {
+			iter.Close()
+			return err
+		}
+		n++
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	if n > 0 {
+		Logger.Printf("Assigned %s to %d users\n", name, n)
+	}
+	return nil
+}
+
+// GetBSON stores the ids as ObjectIds, as they were before Id was introduced.
+func (id Id) GetBSON() (interface{}, error) {
+	if !bson.IsObjectIdHex(string(id)) {
+		return string(id), nil
+	}
+	return bson.ObjectIdHex(string(id)), nil
+}
+
+// SetBSON loads the ObjectIds stored by GetBSON.
+func (id *Id) SetBSON(raw bson.Raw) error {
+	var oid bson.ObjectId
+	if err := raw.Unmarshal(&oid); err != nil {
+		return err
+	}
+	*id = Id(oid.Hex())
+	return nil
+}
+
+// Database is the MongoDB Store. It wraps the mgo collection(s).
+type Database struct {
+	mdb        *mgo.Database
+	users      *mgo.Collection
+	runs       *mgo.Collection
+	deliveries *mgo.Collection
+	items      *mgo.Collection
+	comments   *mgo.Collection // Seen comments.
+	accounts   *mgo.Collection // Newest item seen of the followed accounts.
+}
+
+// newDatabase created a new Database, cloning the initial mgo.Session.
+// The caller *must* call close() before disposing the Database.
+func newDatabase() *Database {
+	s := session.Copy()
+	mdb := s.DB("hnnotifications")
+	return &Database{
+		mdb:        mdb,
+		users:      mdb.C("users"),
+		runs:       mdb.C("runs"),
+		deliveries: mdb.C("deliveries"),
+		items:      mdb.C("items"),
+		comments:   mdb.C("comments"),
+		accounts:   mdb.C("accounts"),
+	}
+}
+
+// close handles the underlying session closure.
+func (db *Database) close() {
+	db.mdb.Session.Close()
+}
+
+// upsertUser inserts/updates a user into the database.
+func (db *Database) upsertUser(u *User) (err error) {
+	_, err = db.users.UpsertId(u.Id, u)
+	return
+}
+
+// validate checks whether the user and token pair is valid, returning the user if found.
+func (db *Database) validate(email, token string) *User {
+	if email == "" || token == "" {
+		Logger.Printf("User validation error: %s - %s\n", email, token)
+		return nil
+	}
+
+	var u User
+	if err := db.users.Find(bson.M{"email": email, "token": token}).One(&u); err != nil {
+		Logger.Printf("User validation error: %s - %s. %v\n", email, token, err)
+		return nil
+	}
+	return &u
+}
+
+// activate sets the account status to 'active'.
+func (db *Database) activate(email, token string) bool {
+	u := db.validate(email, token)
+	if u == nil {
+		return false
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"active": true,
+			"token":  nil,
+		},
+	}
+	err := db.users.UpdateId(u.Id, update)
+	if err != nil {
+		Logger.Println("Error: activate() - ", err)
+	}
+	return err == nil
+}
+
+// unsubscribe completely removes the user account from the database.
+func (db *Database) unsubscribe(email, token string) bool {
+	u := db.validate(email, token)
+	if u == nil {
+		return false
+	}
+
+	if err := db.deleteUser(u.Id); err != nil {
+		Logger.Println("Error: unsubscribe() - ", err)
+		return false
+	}
+	return true
+}
+
+// deleteUser completely removes the user account from the database. See unsubscribe.
+func (db *Database) deleteUser(uid Id) error {
+	if err := db.users.RemoveId(uid); err != nil {
+		return err
+	}
+	_, err := db.deliveries.RemoveAll(bson.M{"userId": uid})
+	return err
+}
+
+// saveRule validates the user, adds the rule, replacing any rule with the same name,
+// and updates the delivery preferences, unless d is nil.
+func (db *Database) saveRule(email, token string, rule Rule, d *Delivery) bool {
+	u := db.validate(email, token)
+	if u == nil {
+		return false
+	}
+	return db.setRules(u, u.withRule(rule), deliveryFields(d))
+}
+
+// saveUserRule adds the rule to the user, replacing any rule with the same name, and
+// updates the delivery preferences, unless d is nil. See saveRule.
+func (db *Database) saveUserRule(uid Id, rule Rule, d *Delivery) error {
+	fields := deliveryFields(d)
+	fields["rules.$"] = rule
+	err := db.users.Update(bson.M{"_id": uid, "rules.name": rule.Name}, bson.M{"$set": fields})
+	if err != mgo.ErrNotFound {
+		return err
+	}
+	delete(fields, "rules.$")
+	update := bson.M{"$push": bson.M{"rules": rule}}
+	if len(fields) > 0 {
+		update["$set"] = fields
+	}
+	return db.users.UpdateId(uid, update)
+}
+
+// deliveryFields returns the user fields of the delivery preferences, or none if d is nil.
+func deliveryFields(d *Delivery) bson.M {
+	if d == nil {
+		return bson.M{}
+	}
+	return bson.M{
+		"delivery":      d.Mode,
+		"digestHour":    d.Hour,
+		"digestWeekday": d.Weekday,
+		"timezone":      d.Timezone,
+		"quietStart":    d.QuietStart,
+		"quietEnd":      d.QuietEnd,
+		"maxPerHour":    d.MaxPerHour,
+		"maxPerDay":     d.MaxPerDay,
+		"muteEmail":     d.MuteEmail,
+	}
+}
+
+// deleteRule validates the user and removes the named rule.
+func (db *Database) deleteRule(email, token, name string) bool {
+	u := db.validate(email, token)
+	if u == nil {
+		return false
+	}
+	return db.setRules(u, u.withoutRule(name), bson.M{})
+}
+
+// deleteUserRule removes the named rule from the user.
+func (db *Database) deleteUserRule(uid Id, name string) error {
+	return db.users.UpdateId(uid, bson.M{"$pull": bson.M{"rules": bson.M{"name": name}}})
+}
+
+// setRules replaces the user rules, along with the given fields, activating the account.
+func (db *Database) setRules(u *User, rules []Rule, fields bson.M) bool {
+	fields["rules"] = rules
+	fields["token"] = nil
+	fields["active"] = true
+	err := db.users.UpdateId(u.Id, bson.M{"$set": fields})
+	if err != nil {
+		Logger.Println("Error: setRules() - ", err)
+	}
+	return err == nil
+}
+
+// addChannel validates the user and adds the (unverified) channel, activating the account.
+func (db *Database) addChannel(email, token string, c Channel) bool {
+	u := db.validate(email, token)
+	if u == nil {
+		return false
+	}
+
+	update := bson.M{
+		"$push": bson.M{"channels": c},
+		"$set":  bson.M{"token": nil, "active": true},
+	}
+	err := db.users.UpdateId(u.Id, update)
+	if err != nil {
+		Logger.Println("Error: addChannel() - ", err)
+	}
+	return err == nil
+}
+
+// addUserChannel adds the (unverified) channel to the user.
+func (db *Database) addUserChannel(uid Id, c Channel) error {
+	return db.users.UpdateId(uid, bson.M{"$push": bson.M{"channels": c}})
+}
+
+// deleteChannel validates the user and removes the channel with the given id, along
+// with its pending webhook deliveries.
+func (db *Database) deleteChannel(email, token, id string) bool {
+	u := db.validate(email, token)
+	if u == nil {
+		return false
+	}
+
+	update := bson.M{
+		"$pull": bson.M{"channels": bson.M{"id": id}},
+		"$set":  bson.M{"token": nil, "active": true},
+	}
+	err := db.users.UpdateId(u.Id, update)
+	if err == nil {
+		_, err = db.deliveries.RemoveAll(bson.M{"userId": u.Id, "channelId": id, "status": hookPending})
+	}
+	if err != nil {
+		Logger.Println("Error: deleteChannel() - ", err)
+	}
+	return err == nil
+}
+
+// deleteUserChannel removes the user channel with the given id, along with its
+// pending webhook deliveries.
+func (db *Database) deleteUserChannel(uid Id, id string) error {
+	if err := db.users.UpdateId(uid, bson.M{"$pull": bson.M{"channels": bson.M{"id": id}}}); err != nil {
+		return err
+	}
+	_, err := db.deliveries.RemoveAll(bson.M{"userId": uid, "channelId": id, "status": hookPending})
+	return err
+}
+
+// verifyChannel marks the user channel as verified, if the verification token matches.
+func (db *Database) verifyChannel(email, id, token string) bool {
+	if token == "" {
+		return false
+	}
+
+	selector := bson.M{
+		"email":    email,
+		"channels": bson.M{"$elemMatch": bson.M{"id": id, "token": token}},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"channels.$.verified": true,
+			"channels.$.token":    "",
+		},
+	}
+	err := db.users.Update(selector, update)
+	if err != nil && err != mgo.ErrNotFound {
+		Logger.Println("Error: verifyChannel() - ", err)
+	}
+	return err == nil
+}
+
+// findUsersForItem queries all users entitled to receive a given story.
+// Keywords, story lists and item filters are matched once the candidates are loaded.
+func (db *Database) findUsersForItem(s *story) []User {
+	query := bson.M{
+		"$or": []bson.M{
+			{"rules.score": bson.M{"$lte": s.Score}},
+			{"rules.velocity": bson.M{"$gt": 0, "$lte": s.Velocity}},
+		},
+		"sentItems": bson.M{"$ne": s.Id},
+		"active":    true,
+	}
+
+	var candidates []User
+	err := db.users.Find(query).Select(noHistory).All(&candidates)
+	if err != nil {
+		Logger.Println(err)
+	}
+
+	var result []User
+	for _, u := range candidates {
+		if u.matches(s) {
+			result = append(result, u)
+		}
+	}
+	return result
+}
+
+// updateSentItems adds the given item to each user's item set.
+func (db *Database) updateSentItems(emails []string, item int) error {
+	selector := bson.M{"email": bson.M{"$in": emails}}
+
+	update := bson.M{
+		"$addToSet": bson.M{
+			"sentItems": item,
+		},
+	}
+
+	_, err := db.users.UpdateAll(selector, update)
+	return err
+}
+
+// queueItem adds the given item to each user's queue, for digests and held items.
+func (db *Database) queueItem(emails []string, item QueuedItem) error {
+	selector := bson.M{"email": bson.M{"$in": emails}}
+
+	update := bson.M{
+		"$push": bson.M{
+			"queue": item,
+		},
+	}
+
+	_, err := db.users.UpdateAll(selector, update)
+	return err
+}
+
+// findQueuedUsers queries the active users with queued items.
+func (db *Database) findQueuedUsers() ([]User, error) {
+	query := bson.M{
+		"active":  true,
+		"queue.0": bson.M{"$exists": true},
+	}
+
+	var users []User
+	err := db.users.Find(query).Select(noHistory).All(&users)
+	return users, err
+}
+
+// clearQueue removes the given items from the user's queue, recording the digest time.
+func (db *Database) clearQueue(uid Id, ids []int, at time.Time) error {
+	update := bson.M{
+		"$pull": bson.M{
+			"queue": bson.M{"id": bson.M{"$in": ids}},
+		},
+		"$set": bson.M{
+			"lastDigest": at,
+		},
+	}
+	return db.users.UpdateId(uid, update)
+}
+
+// recordSend records an email sent to each user at the given time, for the email caps.
+// Records older than a day are dropped.
+func (db *Database) recordSend(emails []string, at time.Time) error {
+	selector := bson.M{"email": bson.M{"$in": emails}}
+
+	if _, err := db.users.UpdateAll(selector, bson.M{"$push": bson.M{"sends": at}}); err != nil {
+		return err
+	}
+	prune := bson.M{
+		"$pull": bson.M{
+			"sends": bson.M{"$lt": at.Add(-24 * time.Hour)},
+		},
+	}
+	_, err := db.users.UpdateAll(selector, prune)
+	return err
+}
+
+// noHistory is the projection leaving the match history out of the users loaded.
+var noHistory = bson.M{"history": 0}
+
+// recordMatch adds the given item to each user's match history, unless already there.
+// Only the last maxHistory items are kept.
+func (db *Database) recordMatch(emails []string, item QueuedItem) error {
+	selector := bson.M{
+		"email":      bson.M{"$in": emails},
+		"history.id": bson.M{"$ne": item.Id},
+	}
+
+	update := bson.M{
+		"$push": bson.M{
+			"history": bson.M{"$each": []QueuedItem{item}, "$slice": -maxHistory},
+		},
+	}
+
+	_, err := db.users.UpdateAll(selector, update)
+	return err
+}
+
+// findHistory queries the most recently matched items of the user, newest first.
+func (db *Database) findHistory(uid Id, limit int) ([]QueuedItem, error) {
+	var u User
+	err := db.users.FindId(uid).Select(bson.M{"history": bson.M{"$slice": -limit}}).One(&u)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]QueuedItem, len(u.History))
+	for i, item := range u.History {
+		items[len(items)-1-i] = item
+	}
+	return items, nil
+}
+
+// setFeedToken validates the user and assigns the feed token, activating the account.
+func (db *Database) setFeedToken(email, token, feedToken string) bool {
+	u := db.validate(email, token)
+	if u == nil {
+		return false
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"feedToken": feedToken,
+			"token":     nil,
+			"active":    true,
+		},
+	}
+	err := db.users.UpdateId(u.Id, update)
+	if err != nil {
+		Logger.Println("Error: setFeedToken() - ", err)
+	}
+	return err == nil
+}
+
+// findFeedUser queries a user by its feed token.
+func (db *Database) findFeedUser(feedToken string) (*User, bool) {
+	var u User
+	if feedToken == "" {
+		return &u, false
+	}
+	err := db.users.Find(bson.M{"feedToken": feedToken}).Select(noHistory).One(&u)
+	if err != nil && err != mgo.ErrNotFound {
+		Logger.Println("Error: findFeedUser() - ", err)
+	}
+	return &u, err == nil
+}
+
+// saveWatch validates the user and replaces its comment watch, activating the account.
+func (db *Database) saveWatch(email, token string, w CommentWatch) bool {
+	u := db.validate(email, token)
+	if u == nil {
+		return false
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"watch":  w,
+			"token":  nil,
+			"active": true,
+		},
+	}
+	err := db.users.UpdateId(u.Id, update)
+	if err != nil {
+		Logger.Println("Error: saveWatch() - ", err)
+	}
+	return err == nil
+}
+
+// findWatchers queries the active users watching comments.
+func (db *Database) findWatchers() ([]User, error) {
+	selector := bson.M{
+		"active": true,
+		"$or": []bson.M{
+			{"watch.username": bson.M{"$gt": ""}, "watch.replies": true},
+			{"watch.username": bson.M{"$gt": ""}, "watch.mentions": true},
+			{"watch.threads.0": bson.M{"$exists": true}},
+		},
+	}
+	var users []User
+	err := db.users.Find(selector).Select(noHistory).All(&users)
+	return users, err
+}
+
+// seenComments returns which of the given comments were seen before.
+func (db *Database) seenComments(ids []int) ([]int, error) {
+	var docs []struct {
+		Id int `bson:"_id"`
+	}
+	if err := db.comments.Find(bson.M{"_id": bson.M{"$in": ids}}).Select(bson.M{"_id": 1}).All(&docs); err != nil {
+		return nil, err
+	}
+	seen := make([]int, len(docs))
+	for i, doc := range docs {
+		seen[i] = doc.Id
+	}
+	return seen, nil
+}
+
+// markSeen records the given comments as seen at the given time. Records older
+// than commentRetention are dropped.
+func (db *Database) markSeen(ids []int, at time.Time) error {
+	for _, id := range ids {
+		if _, err := db.comments.UpsertId(id, bson.M{"$set": bson.M{"seenAt": at}}); err != nil {
+			return err
+		}
+	}
+	_, err := db.comments.RemoveAll(bson.M{"seenAt": bson.M{"$lt": at.Add(-commentRetention)}})
+	return err
+}
+
+// saveFollowing validates the user and replaces the followed accounts, activating the account.
+func (db *Database) saveFollowing(email, token string, usernames []string) bool {
+	u := db.validate(email, token)
+	if u == nil {
+		return false
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"following": usernames,
+			"token":     nil,
+			"active":    true,
+		},
+	}
+	err := db.users.UpdateId(u.Id, update)
+	if err != nil {
+		Logger.Println("Error: saveFollowing() - ", err)
+	}
+	return err == nil
+}
+
+// findFollowers queries the active users following any account.
+func (db *Database) findFollowers() ([]User, error) {
+	var users []User
+	err := db.users.Find(bson.M{"following.0": bson.M{"$exists": true}, "active": true}).Select(noHistory).All(&users)
+	return users, err
+}
+
+// account is the newest item seen of a followed account.
+type account struct {
+	Username string `bson:"_id"`
+	LastItem int    `bson:"lastItem"`
+}
+
+// lastSubmissions returns the newest item seen of each followed account.
+func (db *Database) lastSubmissions() (map[string]int, error) {
+	var accounts []account
+	if err := db.accounts.Find(nil).All(&accounts); err != nil {
+		return nil, err
+	}
+	last := make(map[string]int, len(accounts))
+	for _, a := range accounts {
+		last[a.Username] = a.LastItem
+	}
+	return last, nil
+}
+
+// saveSubmissions replaces the newest item seen of the followed accounts. Accounts
+// left out are dropped.
+func (db *Database) saveSubmissions(last map[string]int) error {
+	names := make([]string, 0, len(last))
+	for name, id := range last {
+		if _, err := db.accounts.UpsertId(name, account{name, id}); err != nil {
+			return err
+		}
+		names = append(names, name)
+	}
+	_, err := db.accounts.RemoveAll(bson.M{"_id": bson.M{"$nin": names}})
+	return err
+}
+
+// saveWatchedItem adds the watched story to the user, or updates it if already watched.
+func (db *Database) saveWatchedItem(uid Id, w WatchedItem) error {
+	err := db.users.Update(bson.M{"_id": uid, "watched.id": w.Id}, bson.M{"$set": bson.M{"watched.$": w}})
+	if err == mgo.ErrNotFound {
+		err = db.users.UpdateId(uid, bson.M{"$push": bson.M{"watched": w}})
+	}
+	return err
+}
+
+// deleteWatchedItem removes the watched story from the user.
+func (db *Database) deleteWatchedItem(uid Id, id int) error {
+	return db.users.UpdateId(uid, bson.M{"$pull": bson.M{"watched": bson.M{"id": id}}})
+}
+
+// findWatching queries the active users watching any story.
+func (db *Database) findWatching() ([]User, error) {
+	var users []User
+	err := db.users.Find(bson.M{"watched.0": bson.M{"$exists": true}, "active": true}).Select(noHistory).All(&users)
+	return users, err
+}
+
+// savePendingChannel replaces the channel of the user awaiting the confirmation link.
+func (db *Database) savePendingChannel(uid Id, c Channel) error {
+	return db.users.UpdateId(uid, bson.M{"$set": bson.M{"pendingChannel": c}})
+}
+
+// takePendingChannel removes and returns the channel of the user awaiting the
+// confirmation link, if its id matches.
+func (db *Database) takePendingChannel(uid Id, id string) (*Channel, bool) {
+	if id == "" {
+		return nil, false
+	}
+	var u struct {
+		Pending Channel `bson:"pendingChannel"`
+	}
+	change := mgo.Change{Update: bson.M{"$unset": bson.M{"pendingChannel": ""}}}
+	_, err := db.users.Find(bson.M{"_id": uid, "pendingChannel.id": id}).Select(bson.M{"pendingChannel": 1}).Apply(change, &u)
+	if err != nil {
+		if err != mgo.ErrNotFound {
+			Logger.Println("Error: takePendingChannel() - ", err)
+		}
+		return nil, false
+	}
+	return &u.Pending, true
+}
+
+// saveAPIToken adds the API token to the user.
+func (db *Database) saveAPIToken(uid Id, t APIToken) error {
+	return db.users.UpdateId(uid, bson.M{"$push": bson.M{"tokens": t}})
+}
+
+// deleteAPIToken removes the API token with the given id from the user.
+func (db *Database) deleteAPIToken(uid Id, id string) error {
+	return db.users.UpdateId(uid, bson.M{"$pull": bson.M{"tokens": bson.M{"id": id}}})
+}
+
+// touchAPIToken records the last use of the user API token with the given id.
+func (db *Database) touchAPIToken(uid Id, id string, at time.Time) error {
+	return db.users.Update(bson.M{"_id": uid, "tokens.id": id}, bson.M{"$set": bson.M{"tokens.$.lastUsed": at}})
+}
+
+// findTokenUser queries a user by the hash of one of its API tokens.
+func (db *Database) findTokenUser(hash string) (*User, bool) {
+	var u User
+	if hash == "" {
+		return &u, false
+	}
+	err := db.users.Find(bson.M{"tokens.hash": hash}).Select(noHistory).One(&u)
+	if err != nil && err != mgo.ErrNotFound {
+		Logger.Println("Error: findTokenUser() - ", err)
+	}
+	return &u, err == nil
+}
+
+// saveItem stores the latest metadata of the item, fetched at the given time, and
+// records its score and comment count.
+func (db *Database) saveItem(item *hnapi.Item, at time.Time) error {
+	si := newStoredItem(item, at)
+	update := bson.M{
+		"$set": bson.M{
+			"by":        si.By,
+			"title":     si.Title,
+			"url":       si.Url,
+			"type":      si.Type,
+			"time":      si.Time,
+			"score":     si.Score,
+			"comments":  si.Comments,
+			"fetchedAt": si.FetchedAt,
+		},
+		"$setOnInsert": bson.M{
+			"firstSeen": si.FirstSeen,
+		},
+		"$push": bson.M{
+			"snapshots": bson.M{"$each": []Snapshot{{at, item.Score, item.Descendants}}, "$slice": -maxSnapshots},
+		},
+	}
+	_, err := db.items.UpsertId(item.Id, update)
+	return err
+}
+
+// saveSnapshot records the score and comment count of the stored item, leaving the
+// item itself, and its fetch time, untouched.
+func (db *Database) saveSnapshot(id int, s Snapshot) error {
+	err := db.items.UpdateId(id, bson.M{
+		"$push": bson.M{"snapshots": bson.M{"$each": []Snapshot{s}, "$slice": -maxSnapshots}},
+	})
+	if err == mgo.ErrNotFound {
+		return nil // Pruned meanwhile.
+	}
+	return err
+}
+
+// findItems queries the stored items with the given ids, without their snapshots.
+func (db *Database) findItems(ids []int) ([]StoredItem, error) {
+	var items []StoredItem
+	err := db.items.Find(bson.M{"_id": bson.M{"$in": ids}}).Select(bson.M{"snapshots": 0}).All(&items)
+	return items, err
+}
+
+// findSnapshots queries the snapshots of the item taken since the given time, oldest first.
+func (db *Database) findSnapshots(id int, since time.Time) ([]Snapshot, error) {
+	var si StoredItem
+	err := db.items.FindId(id).Select(bson.M{"snapshots": 1}).One(&si)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var result []Snapshot
+	for _, snap := range si.Snapshots {
+		if !snap.At.Before(since) {
+			result = append(result, snap)
+		}
+	}
+	return result, nil
+}
+
+// pruneItems removes the items last fetched before the given time, and the snapshots
+// taken before then.
+func (db *Database) pruneItems(before time.Time) error {
+	if _, err := db.items.RemoveAll(bson.M{"fetchedAt": bson.M{"$lt": before}}); err != nil {
+		return err
+	}
+	prune := bson.M{
+		"$pull": bson.M{
+			"snapshots": bson.M{"at": bson.M{"$lt": before}},
+		},
+	}
+	_, err := db.items.UpdateAll(bson.M{"snapshots.at": bson.M{"$lt": before}}, prune)
+	return err
+}
+
+// saveDelivery inserts/updates a webhook delivery.
+func (db *Database) saveDelivery(d *WebhookDelivery) error {
+	_, err := db.deliveries.UpsertId(d.Id, d)
+	return err
+}
+
+// dueDeliveries queries the pending webhook deliveries due for a retry at the given time.
+func (db *Database) dueDeliveries(now time.Time) ([]WebhookDelivery, error) {
+	query := bson.M{
+		"status":      hookPending,
+		"nextAttempt": bson.M{"$lte": now},
+	}
+
+	var deliveries []WebhookDelivery
+	err := db.deliveries.Find(query).All(&deliveries)
+	return deliveries, err
+}
+
+// findDeliveries queries the most recent webhook deliveries of the user, newest first.
+func (db *Database) findDeliveries(uid Id, limit int) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	err := db.deliveries.Find(bson.M{"userId": uid}).Sort("-createdAt").Limit(limit).All(&deliveries)
+	return deliveries, err
+}
+
+// pruneDeliveries removes the finished webhook deliveries last attempted before the given time.
+func (db *Database) pruneDeliveries(before time.Time) error {
+	selector := bson.M{
+		"status":    bson.M{"$ne": hookPending},
+		"updatedAt": bson.M{"$lt": before},
+	}
+	_, err := db.deliveries.RemoveAll(selector)
+	return err
+}
+
+// updateToken assigns the new token to the user.
+func (db *Database) updateToken(uid Id, token string) error {
+	update := bson.M{
+		"$set": bson.M{
+			"token": token,
+		},
+	}
+	return db.users.UpdateId(uid, update)
+}
+
+// findUser queries a user by its email field.
+func (db *Database) findUser(email string) (*User, bool) {
+	var u User
+	err := db.users.Find(bson.M{"email": email}).One(&u)
+	if err != nil && err != mgo.ErrNotFound {
+		Logger.Println("Error: findUser() - ", err)
+	}
+	return &u, err == nil
+}
+
+// saveRun inserts/updates a scheduler run.
+func (db *Database) saveRun(r *Run) (err error) {
+	_, err = db.runs.UpsertId(r.Id, r)
+	return
+}
+
+// lastRun returns the most recently started run of the given job.
+func (db *Database) lastRun(job string) (*Run, bool) {
+	var r Run
+	err := db.runs.Find(bson.M{"job": job}).Sort("-start").One(&r)
+	if err != nil && err != mgo.ErrNotFound {
+		Logger.Println("Error: lastRun() - ", err)
+	}
+	return &r, err == nil
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Channel kinds.
+const (
+	chanEmail   = "email"   // Email address, besides the account one.
+	chanWebhook = "webhook" // Generic outgoing webhook, receiving a JSON POST.
+	chanSlack   = "slack"   // Slack-compatible incoming webhook.
+	chanDiscord = "discord" // Discord webhook.
+	chanMatrix  = "matrix"  // Matrix room, posted to through a homeserver.
+	chanNtfy    = "ntfy"    // ntfy topic.
+	chanGotify  = "gotify"  // Gotify server.
+
+	maxChannels = 10 // Channels per user.
+)
+
+// Message kinds.
+const (
+	msgItem         = "item"         // A single matched item.
+	msgDigest       = "digest"       // Several queued items. See runDigests.
+	msgComment      = "comment"      // A comment alert. See runComments.
+	msgVerification = "verification" // A channel verification link.
+)
+
+var (
+	errNoChannels = errors.New("no channel delivered the message")
+
+	// Shared by the HTTP based notifiers. Channel targets are set by any visitor,
+	// so private addresses are refused.
+	notifyClient = &http.Client{Timeout: 10 * time.Second, Transport: publicTransport(10 * time.Second)}
+)
+
+// Channel is a destination registered by a user for their notifications. Channels
+// must be verified before they receive anything but the verification message.
+type Channel struct {
+	Id       string `bson:"id"`       // Random identifier.
+	Kind     string `bson:"kind"`     // One of the chan* kinds.
+	Target   string `bson:"target"`   // Email address, webhook URL, topic URL, or server URL (Matrix, Gotify).
+	Room     string `bson:"room"`     // Matrix room id.
+	Secret   string `bson:"secret"`   // Access token (Matrix, ntfy, Gotify).
+	Verified bool   `bson:"verified"` // Verification status.
+	Token    string `bson:"token"`    // Verification token.
+}
+
+// Message is a notification, as handed to the Notifier implementations.
+type Message struct {
+	Kind    string       // One of the msg* kinds.
+	Subject string       // Short summary, e.g. the story title.
+	Items   []QueuedItem // Stories, sorted by score for digests.
+	Mode    string       // Delivery mode of digests. See Delivery.
+	Link    string       // Verification link.
+	Text    string       // Comment excerpt.
+}
+
+// itemMessage creates the message for a story, matched by the named rule.
+func itemMessage(s *story, rule string) *Message {
+	return &Message{Kind: msgItem, Subject: s.Title, Items: []QueuedItem{newQueuedItem(s, rule)}}
+}
+
+// digestMessage creates the message for the queued items, already sorted.
+func digestMessage(mode string, items []QueuedItem) *Message {
+	subject := fmt.Sprintf("Your %s digest (%d stories)", mode, len(items))
+	if mode == deliverImmediate {
+		subject = fmt.Sprintf("%d stories held back", len(items))
+	}
+	return &Message{Kind: msgDigest, Subject: subject, Items: items, Mode: mode}
+}
+
+// text renders the message as plain text, for the chat and push channels.
+func (m *Message) text() string {
+	var b strings.Builder
+	switch m.Kind {
+	case msgVerification:
+		fmt.Fprintf(&b, "HN Notifications: use the link below to verify this channel.\n%s\n", m.Link)
+	case msgDigest:
+		fmt.Fprintf(&b, "HN Notifications - %s\n", m.Subject)
+		for _, item := range m.Items {
+			fmt.Fprintf(&b, "\n%s\n%s\n%d points, %d comments: %s\n", item.Title, item.link(), item.Score, item.Comments, item.discussion())
+		}
+	case msgComment:
+		item := m.Items[0]
+		fmt.Fprintf(&b, "%s\n\"%s\"\n%s\n", item.Title, m.Text, item.discussion())
+	default:
+		item := m.Items[0]
+		fmt.Fprintf(&b, "%s\n%s\nHacker News discussion: %s\nMatched by your rule: %s\n", item.Title, item.link(), item.discussion(), item.Rule)
+	}
+	return b.String()
+}
+
+// Notifier delivers messages to a channel.
+type Notifier interface {
+	// notify delivers the message.
+	notify(m *Message) error
+}
+
+// notifierFor returns the Notifier of the user channel.
+func notifierFor(u *User, c *Channel) Notifier {
+	switch c.Kind {
+	case chanEmail:
+		return emailNotifier{c.Target, u}
+	case chanWebhook:
+		return webhookNotifier{c.Target, u.WebhookSecret, u.Id.Hex()}
+	case chanSlack:
+		return slackNotifier{c.Target}
+	case chanDiscord:
+		return discordNotifier{c.Target}
+	case chanMatrix:
+		return matrixNotifier{c.Target, c.Room, c.Secret}
+	case chanNtfy:
+		return ntfyNotifier{c.Target, c.Secret}
+	case chanGotify:
+		return gotifyNotifier{c.Target, c.Secret}
+	}
+	return nil
+}
+
+// channels returns the verified channels of the user, starting with the account
+// email. The account email is skipped if muted, unless no other channel is verified.
+func (u *User) channels() []Channel {
+	var channels []Channel
+	for _, c := range u.Channels {
+		if c.Verified {
+			channels = append(channels, c)
+		}
+	}
+	if !u.MuteEmail || len(channels) == 0 {
+		channels = append([]Channel{{Kind: chanEmail, Target: u.Email, Verified: true}}, channels...)
+	}
+	return channels
+}
+
+// channel returns the channel with the given id, or nil if the user has no such channel.
+func (u *User) channel(id string) *Channel {
+	for i := range u.Channels {
+		if u.Channels[i].Id == id {
+			return &u.Channels[i]
+		}
+	}
+	return nil
+}
+
+// findChannel returns the user channel with the same kind and destination as c, or nil.
+func (u *User) findChannel(c *Channel) *Channel {
+	for i := range u.Channels {
+		if e := &u.Channels[i]; e.Kind == c.Kind && e.Target == c.Target && e.Room == c.Room {
+			return e
+		}
+	}
+	return nil
+}
+
+// deliver fans the message out to all the user channels. It succeeds if any of
+// the channels got the message; failures are logged. Webhook deliveries go through
+// the retry queue instead (see deliverWebhook).
+func deliver(db Store, u *User, m *Message) error {
+	delivered := false
+	for _, c := range u.channels() {
+		if c.Kind == chanWebhook {
+			if err := deliverWebhook(db, u, &c, m); err != nil {
+				Logger.Printf("Error queuing webhook delivery of user %s: %v\n", u.Email, err)
+				continue
+			}
+			delivered = true
+			continue
+		}
+		n := notifierFor(u, &c)
+		if n == nil {
+			continue
+		}
+		if err := n.notify(m); err != nil {
+			Logger.Printf("Error notifying %s channel of user %s: %v\n", c.Kind, u.Email, err)
+			continue
+		}
+		delivered = true
+	}
+	if !delivered {
+		return errNoChannels
+	}
+	return nil
+}
+
+// postJSON sends v, JSON encoded, to the given URL.
+func postJSON(url string, v interface{}, header http.Header) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Content-Type", "application/json")
+	return send("POST", url, body, header)
+}
+
+// send performs an HTTP request, failing on non 2xx responses.
+func send(method, url string, body []byte, header http.Header) error {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+// emailNotifier delivers messages by email. Item emails link to watching the
+// item on behalf of the user, if set.
+type emailNotifier struct {
+	to string
+	u  *User
+}
+
+func (n emailNotifier) notify(m *Message) error {
+	switch m.Kind {
+	case msgVerification:
+		return sendChannelVerification(n.to, m.Link)
+	case msgDigest:
+		return sendDigest(n.to, m.Mode, m.Items)
+	case msgComment:
+		return sendComment(n.to, m.Items[0], m.Text)
+	}
+	item := m.Items[0]
+	return sendItem(item.Id, item.Title, item.Url, item.Rule, n.to, watchLink(n.u, item.Id, item.Rule == reasonWatch))
+}
+
+// webhookNotifier POSTs the messages, JSON encoded and signed with the user
+// webhook secret, to a URL. It is not retried; see deliverWebhook.
+type webhookNotifier struct {
+	url, secret, subscriber string
+}
+
+// webhookItem is a QueuedItem, as sent to webhooks.
+type webhookItem struct {
+	Id         int    `json:"id"`
+	Title      string `json:"title"`
+	Url        string `json:"url"`
+	Discussion string `json:"discussion"`
+	Score      int    `json:"score"`
+	Comments   int    `json:"comments"`
+	Rule       string `json:"rule"`
+}
+
+// webhookPayload is the JSON document POSTed to webhooks.
+type webhookPayload struct {
+	Type       string        `json:"type"` // One of the msg* kinds.
+	Subject    string        `json:"subject"`
+	Items      []webhookItem `json:"items,omitempty"`
+	Mode       string        `json:"mode,omitempty"`
+	Link       string        `json:"link,omitempty"`
+	Text       string        `json:"text,omitempty"`
+	Subscriber string        `json:"subscriber"` // User id.
+	CreatedAt  time.Time     `json:"created_at"` // Time of the first attempt, for receivers to reject replays.
+}
+
+// payload returns the webhook representation of the message.
+func (m *Message) payload() *webhookPayload {
+	p := &webhookPayload{Type: m.Kind, Subject: m.Subject, Mode: m.Mode, Link: m.Link, Text: m.Text}
+	for _, item := range m.Items {
+		p.Items = append(p.Items, webhookItem{item.Id, item.Title, item.Url, item.discussion(), item.Score, item.Comments, item.Rule})
+	}
+	return p
+}
+
+func (n webhookNotifier) notify(m *Message) error {
+	p := m.payload()
+	p.Subscriber = n.subscriber
+	p.CreatedAt = time.Now()
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	signature, err := sign(n.secret, body)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set(signatureHeader, signature)
+	return send("POST", n.url, body, header)
+}
+
+// slackNotifier posts the messages to a Slack-compatible incoming webhook.
+type slackNotifier struct {
+	url string
+}
+
+func (n slackNotifier) notify(m *Message) error {
+	return postJSON(n.url, map[string]string{"text": m.text()}, nil)
+}
+
+// discordNotifier posts the messages to a Discord webhook.
+type discordNotifier struct {
+	url string
+}
+
+const maxDiscordContent = 2000 // Characters per Discord message.
+
+func (n discordNotifier) notify(m *Message) error {
+	content := []rune(m.text())
+	if len(content) > maxDiscordContent {
+		content = append(content[:maxDiscordContent-1], '…')
+	}
+	return postJSON(n.url, map[string]string{"content": string(content)}, nil)
+}
+
+// matrixNotifier sends the messages to a Matrix room, through the client-server API.
+type matrixNotifier struct {
+	server, room, token string
+}
+
+func (n matrixNotifier) notify(m *Message) error {
+	body, err := json.Marshal(map[string]string{"msgtype": "m.text", "body": m.text()})
+	if err != nil {
+		return err
+	}
+	endpoint := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s",
+		strings.TrimSuffix(n.server, "/"), url.PathEscape(n.room), newToken())
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("Authorization", "Bearer "+n.token)
+	return send("PUT", endpoint, body, header)
+}
+
+// ntfyNotifier publishes the messages to a ntfy topic.
+type ntfyNotifier struct {
+	url, token string
+}
+
+func (n ntfyNotifier) notify(m *Message) error {
+	header := http.Header{}
+	header.Set("Title", mime.QEncoding.Encode("utf-8", "HN Notifications - "+m.Subject))
+	if m.Kind == msgItem || m.Kind == msgComment {
+		header.Set("Click", m.Items[0].link())
+	} else if m.Link != "" {
+		header.Set("Click", m.Link)
+	}
+	if n.token != "" {
+		header.Set("Authorization", "Bearer "+n.token)
+	}
+	return send("POST", n.url, []byte(m.text()), header)
+}
+
+// gotifyNotifier pushes the messages to a Gotify server.
+type gotifyNotifier struct {
+	server, token string
+}
+
+func (n gotifyNotifier) notify(m *Message) error {
+	msg := map[string]interface{}{
+		"title":    "HN Notifications - " + m.Subject,
+		"message":  m.text(),
+		"priority": 5,
+	}
+	return postJSON(strings.TrimSuffix(n.server, "/")+"/message?token="+url.QueryEscape(n.token), msg, nil)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/ichinaski/hnnotifications/hnapi"
+)
+
+const defaultWorkers = 10 // Concurrent item fetches, unless configured.
+
+// fetchError records the failure to fetch an item.
+type fetchError struct {
+	id  int
+	err error
+}
+
+func (e *fetchError) Error() string {
+	return fmt.Sprintf("fetching item %d: %v", e.id, e.err)
+}
+
+// fetchItems fetches the given items with a pool of workers, so that no more
+// than the given number of requests are in flight at once. Fetched items are
+// sent to the first channel, and failures to the second one. Items not found
+// (e.g. deleted ones) are quietly skipped. Both channels are closed once all the
+// items have been handled, or the context is done. The caller must keep receiving
+// from both channels until they are closed.
+func fetchItems(ctx context.Context, ids []int, workers int) (<-chan hnapi.Item, <-chan error) {
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+
+	in := make(chan int)
+	out := make(chan hnapi.Item)
+	errc := make(chan error)
+
+	// Feed the workers with the ids, until done or cancelled.
+	go func() {
+		defer close(in)
+		for _, id := range ids {
+			select {
+			case in <- id:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for id := range in {
+				item, err := hn.Item(ctx, id)
+				if err == hnapi.ErrNotFound {
+					continue // Deleted items might show up as null.
+				}
+				if err != nil {
+					select {
+					case errc <- &fetchError{id: id, err: err}:
+					case <-ctx.Done():
+						return
+					}
+					continue
+				}
+				select {
+				case out <- *item:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	// Close the output channels once all the workers are done.
+	go func() {
+		wg.Wait()
+		close(out)
+		close(errc)
+	}()
+	return out, errc
+}
+
+// fetchLogged fetches the given items as fetchItems does, logging the failures.
+// Their count is sent to the second channel once all the items have been handled,
+// so the caller must receive from it after draining the items.
+func fetchLogged(ctx context.Context, ids []int, workers int) (<-chan hnapi.Item, <-chan int) {
+	items, errc := fetchItems(ctx, ids, workers)
+	failed := make(chan int, 1)
+	go func() {
+		n := 0
+		for err := range errc {
+			Logger.Println(err)
+			n++
+		}
+		failed <- n
+	}()
+	return items, failed
+}
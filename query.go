@@ -0,0 +1,390 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// A keyword query selects items by the words in their titles. Its syntax is:
+//
+//	query   = group
+//	group   = item { item }
+//	item    = clause { "OR" clause }
+//	clause  = primary { "AND" primary }
+//	primary = ( "-" | "NOT" ) primary | word | '"' phrase '"' | "(" group ")"
+//
+// Words are case insensitive, alphanumeric strings. A phrase matches its words
+// appearing consecutively. Adjacent items in a group are OR'ed, which keeps the
+// plain, space-separated keyword lists working as before, except for negated
+// items ("-crypto"), which exclude whatever they match from the whole group:
+//
+//	rust AND (async OR tokio) -crypto
+//	"machine learning" postgres
+//
+// Operators must be written in upper case; "and", "or" and "not" are plain words.
+
+// queryError reports a syntax error, along with its position (in characters) in the query.
+type queryError struct {
+	pos int
+	msg string
+}
+
+func (e *queryError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.msg, e.pos+1)
+}
+
+// Query token kinds.
+const (
+	tokEOF = iota
+	tokWord
+	tokPhrase
+	tokAnd
+	tokOr
+	tokNot // Either "NOT" or "-".
+	tokLParen
+	tokRParen
+)
+
+type token struct {
+	kind  int
+	pos   int
+	text  string   // Original text, for error messages.
+	words []string // Normalized words of tokWord and tokPhrase tokens.
+}
+
+// lex splits the query into tokens.
+func lex(q string) ([]token, error) {
+	var (
+		tokens []token
+		rs     = []rune(q)
+	)
+	isWordRune := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsNumber(r) }
+
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{kind: tokLParen, pos: i, text: "("})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{kind: tokRParen, pos: i, text: ")"})
+			i++
+		case r == '-':
+			if i > 0 && !unicode.IsSpace(rs[i-1]) && rs[i-1] != '(' {
+				return nil, &queryError{i, "unexpected '-' inside a word"}
+			}
+			if i+1 == len(rs) || unicode.IsSpace(rs[i+1]) || rs[i+1] == ')' {
+				return nil, &queryError{i, "missing term after '-'"}
+			}
+			tokens = append(tokens, token{kind: tokNot, pos: i, text: "-"})
+			i++
+		case r == '"':
+			end := i + 1
+			for end < len(rs) && rs[end] != '"' {
+				end++
+			}
+			if end == len(rs) {
+				return nil, &queryError{i, "unterminated phrase"}
+			}
+			text := string(rs[i+1 : end])
+			words := Keywords(text)
+			if len(words) == 0 {
+				return nil, &queryError{i, "empty phrase"}
+			}
+			tokens = append(tokens, token{kind: tokPhrase, pos: i, text: `"` + text + `"`, words: words})
+			i = end + 1
+		case isWordRune(r):
+			end := i
+			for end < len(rs) && isWordRune(rs[end]) {
+				end++
+			}
+			text := string(rs[i:end])
+			t := token{kind: tokWord, pos: i, text: text}
+			switch text {
+			case "AND":
+				t.kind = tokAnd
+			case "OR":
+				t.kind = tokOr
+			case "NOT":
+				t.kind = tokNot
+			default:
+				t.words = []string{strings.ToLower(text)}
+			}
+			tokens = append(tokens, t)
+			i = end
+		default:
+			return nil, &queryError{i, fmt.Sprintf("unexpected character '%c'", r)}
+		}
+	}
+	return append(tokens, token{kind: tokEOF, pos: len(rs), text: "end of query"}), nil
+}
+
+// expr is a node of a parsed query.
+type expr interface {
+	// eval reports whether the expression matches the given words.
+	eval(words []string) bool
+}
+
+type (
+	termExpr  []string // A word, or the consecutive words of a phrase.
+	notExpr   struct{ x expr }
+	andExpr   []expr
+	orExpr    []expr
+	matchAll  struct{}
+	groupExpr struct{ any, none []expr } // Any of the items must match, and none of the exclusions.
+)
+
+func (t termExpr) eval(words []string) bool {
+	for i := 0; i+len(t) <= len(words); i++ {
+		match := true
+		for j, w := range t {
+			if words[i+j] != w {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+func (n notExpr) eval(words []string) bool { return !n.x.eval(words) }
+
+func (a andExpr) eval(words []string) bool {
+	for _, x := range a {
+		if !x.eval(words) {
+			return false
+		}
+	}
+	return true
+}
+
+func (o orExpr) eval(words []string) bool {
+	for _, x := range o {
+		if x.eval(words) {
+			return true
+		}
+	}
+	return false
+}
+
+func (matchAll) eval(words []string) bool { return true }
+
+func (g groupExpr) eval(words []string) bool {
+	for _, x := range g.none {
+		if x.eval(words) {
+			return false
+		}
+	}
+	return len(g.any) == 0 || orExpr(g.any).eval(words)
+}
+
+// parser is a recursive descent parser for keyword queries.
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token { return p.tokens[p.pos] }
+func (p *parser) next() token { t := p.tokens[p.pos]; p.pos++; return t }
+
+// parseQuery parses and validates a keyword query. An empty query matches everything.
+func parseQuery(q string) (expr, error) {
+	tokens, err := lex(q)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 1 {
+		return matchAll{}, nil
+	}
+
+	p := &parser{tokens: tokens}
+	x, err := p.group()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, &queryError{t.pos, fmt.Sprintf("unexpected '%s'", t.text)}
+	}
+	return x, nil
+}
+
+// group = item { item }
+func (p *parser) group() (expr, error) {
+	var g groupExpr
+	for {
+		switch p.peek().kind {
+		case tokEOF, tokRParen:
+			if len(g.any)+len(g.none) == 0 {
+				t := p.peek()
+				return nil, &queryError{t.pos, fmt.Sprintf("missing term before '%s'", t.text)}
+			}
+			return g, nil
+		}
+
+		x, err := p.item()
+		if err != nil {
+			return nil, err
+		}
+		if n, ok := x.(notExpr); ok {
+			g.none = append(g.none, n.x)
+		} else {
+			g.any = append(g.any, x)
+		}
+	}
+}
+
+// item = clause { "OR" clause }
+func (p *parser) item() (expr, error) {
+	x, err := p.clause()
+	if err != nil {
+		return nil, err
+	}
+	or := orExpr{x}
+	for p.peek().kind == tokOr {
+		p.next()
+		if x, err = p.clause(); err != nil {
+			return nil, err
+		}
+		or = append(or, x)
+	}
+	if len(or) == 1 {
+		return or[0], nil
+	}
+	return or, nil
+}
+
+// clause = primary { "AND" primary }
+func (p *parser) clause() (expr, error) {
+	x, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	and := andExpr{x}
+	for p.peek().kind == tokAnd {
+		p.next()
+		if x, err = p.primary(); err != nil {
+			return nil, err
+		}
+		and = append(and, x)
+	}
+	if len(and) == 1 {
+		return and[0], nil
+	}
+	return and, nil
+}
+
+// primary = ( "-" | "NOT" ) primary | word | '"' phrase '"' | "(" group ")"
+func (p *parser) primary() (expr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNot:
+		x, err := p.primary()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{x}, nil
+	case tokWord, tokPhrase:
+		return termExpr(t.words), nil
+	case tokLParen:
+		x, err := p.group()
+		if err != nil {
+			return nil, err
+		}
+		if c := p.next(); c.kind != tokRParen {
+			return nil, &queryError{t.pos, "unbalanced '('"}
+		}
+		return x, nil
+	case tokEOF:
+		return nil, &queryError{t.pos, "missing term"}
+	}
+	return nil, &queryError{t.pos, fmt.Sprintf("unexpected '%s'", t.text)}
+}
+
+// narrows reports whether the expression only matches the items containing some of
+// its terms. Queries made of exclusions ("-crypto") match nearly everything.
+func narrows(x expr) bool {
+	switch x := x.(type) {
+	case termExpr:
+		return true
+	case andExpr:
+		for _, x := range x {
+			if narrows(x) {
+				return true
+			}
+		}
+	case orExpr:
+		for _, x := range x {
+			if !narrows(x) {
+				return false
+			}
+		}
+		return len(x) > 0
+	case groupExpr:
+		return narrows(orExpr(x.any))
+	}
+	return false
+}
+
+// normalizeTerms returns a copy of the expression with its terms normalized. See Normalize.
+func normalizeTerms(x expr) expr {
+	normalizeAll := func(xs []expr) []expr {
+		out := make([]expr, len(xs))
+		for i, x := range xs {
+			out[i] = normalizeTerms(x)
+		}
+		return out
+	}
+
+	switch x := x.(type) {
+	case termExpr:
+		return termExpr(Normalize(x))
+	case notExpr:
+		return notExpr{normalizeTerms(x.x)}
+	case andExpr:
+		return andExpr(normalizeAll(x))
+	case orExpr:
+		return orExpr(normalizeAll(x))
+	case groupExpr:
+		return groupExpr{any: normalizeAll(x.any), none: normalizeAll(x.none)}
+	}
+	return x
+}
+
+type queryKey struct {
+	q     string
+	exact bool
+}
+
+var (
+	queryCache   = make(map[queryKey]expr) // Parsed queries, shared by all the users subscribed to them.
+	queryCacheMu sync.Mutex
+)
+
+// compileQuery returns the parsed query, caching the result. Unless exact is set,
+// the terms are normalized, and must be evaluated against normalized words.
+// Invalid queries, which should have been rejected upon subscription, never match.
+func compileQuery(q string, exact bool) expr {
+	queryCacheMu.Lock()
+	defer queryCacheMu.Unlock()
+
+	key := queryKey{q, exact}
+	if x, ok := queryCache[key]; ok {
+		return x
+	}
+	x, err := parseQuery(q)
+	if err != nil {
+		Logger.Printf("Invalid query %q: %v\n", q, err)
+		x = orExpr{} // Matches nothing.
+	} else if !exact {
+		x = normalizeTerms(x)
+	}
+	queryCache[key] = x
+	return x
+}
@@ -0,0 +1,120 @@
+package main
+
+import "testing"
+
+func TestQueryEval(t *testing.T) {
+	tests := []struct {
+		query string
+		exact bool
+		title string
+		want  bool
+	}{
+		// Plain keyword lists match any of their words.
+		{"rust postgres", true, "Writing a Postgres extension", true},
+		{"rust postgres", true, "Go 1.22 released", false},
+		{"", true, "Anything at all", true},
+		{"  ", true, "Anything at all", true},
+
+		// AND binds tighter than OR, which binds tighter than adjacency.
+		{"rust AND async OR tokio", true, "Tokio 2.0", true},
+		{"rust AND async OR tokio", true, "Rust 2024 edition", false},
+		{"rust AND async OR tokio", true, "Async Rust in practice", true},
+		{"rust AND (async OR tokio)", true, "Rust and Tokio", true},
+		{"rust AND (async OR tokio)", true, "Tokio internals", false},
+		{"go rust AND wasm", true, "Go generics", true},
+		{"go rust AND wasm", true, "Rust compiler", false},
+		{"and or not", true, "To be or not to be", true},
+
+		// Phrases match consecutive words.
+		{`"machine learning"`, true, "Machine Learning for dummies", true},
+		{`"machine learning"`, true, "Learning about the machine", false},
+		{`"machine learning" postgres`, true, "Postgres 17", true},
+
+		// Negations exclude what they match from the whole group.
+		{"rust AND (async OR tokio) -crypto", true, "Async Rust and crypto", false},
+		{"rust AND (async OR tokio) -crypto", true, "Async Rust", true},
+		{"-crypto", true, "Show HN: A new editor", true},
+		{"-crypto", true, "Crypto winter", false},
+		{"NOT crypto", true, "Crypto winter", false},
+		{"rust -(crypto OR blockchain)", true, "Rust on the blockchain", false},
+		{"rust AND NOT async", true, "Async Rust", false},
+		{"rust AND NOT async", true, "Rust 2024", true},
+
+		// Normalized terms match stems and aliases.
+		{"database", false, "Databases for beginners", true},
+		{"database", true, "Databases for beginners", false},
+		{"golang", false, "Go 1.22 released", true},
+		{`"running databases"`, false, "Run database servers", true},
+
+		// Invalid queries match nothing.
+		{"(rust", true, "Rust", false},
+	}
+
+	for _, tt := range tests {
+		words := Keywords(tt.title)
+		if !tt.exact {
+			words = Normalize(words)
+		}
+		if got := compileQuery(tt.query, tt.exact).eval(words); got != tt.want {
+			t.Errorf("query %q (exact %v) on %q = %v, want %v", tt.query, tt.exact, tt.title, got, tt.want)
+		}
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		err   string
+	}{
+		{"(rust", "unbalanced '(' at position 1"},
+		{"(rust AND (go)", "unbalanced '(' at position 1"},
+		{"rust)", "unexpected ')' at position 5"},
+		{"()", "missing term before ')' at position 2"},
+		{"rust AND", "missing term at position 9"},
+		{"OR rust", "unexpected 'OR' at position 1"},
+		{"rust AND OR go", "unexpected 'OR' at position 10"},
+		{"-", "missing term after '-' at position 1"},
+		{"rust -", "missing term after '-' at position 6"},
+		{"e-mail", "unexpected '-' inside a word at position 2"},
+		{`"machine learning`, "unterminated phrase at position 1"},
+		{`""`, "empty phrase at position 1"},
+		{"c++", "unexpected character '+' at position 2"},
+	}
+
+	for _, tt := range tests {
+		_, err := parseQuery(tt.query)
+		if err == nil {
+			t.Errorf("parseQuery(%q) succeeded, want error %q", tt.query, tt.err)
+		} else if err.Error() != tt.err {
+			t.Errorf("parseQuery(%q) error = %q, want %q", tt.query, err, tt.err)
+		}
+	}
+}
+
+func TestNarrows(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"", false},
+		{"rust", true},
+		{`"machine learning"`, true},
+		{"rust -crypto", true},
+		{"rust AND NOT crypto", true},
+		{"-crypto", false},
+		{"NOT crypto -blockchain", false},
+		{"(-crypto)", false},
+		{"rust OR NOT crypto", false},
+		{"rust OR (go AND -crypto)", true},
+	}
+
+	for _, tt := range tests {
+		x, err := parseQuery(tt.query)
+		if err != nil {
+			t.Fatalf("parseQuery(%q) error: %v", tt.query, err)
+		}
+		if got := narrows(x); got != tt.want {
+			t.Errorf("narrows(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
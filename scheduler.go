@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Run statuses.
+const (
+	runRunning     = "running"
+	runOK          = "ok"
+	runFailed      = "failed"
+	runInterrupted = "interrupted" // The process stopped before the run finished.
+)
+
+// Run records an execution of a scheduled job.
+type Run struct {
+	Id     Id        `bson:"_id"`
+	Job    string    `bson:"job"`    // Job name.
+	Start  time.Time `bson:"start"`  // Start time.
+	End    time.Time `bson:"end"`    // End time. Zero while running.
+	Status string    `bson:"status"` // One of the run* statuses.
+	Error  string    `bson:"error"`  // Error message of failed runs.
+}
+
+var (
+	jobs sync.WaitGroup // Running job loops. See schedule().
+)
+
+// job is a task executed periodically by the scheduler.
+type job struct {
+	name     string
+	interval time.Duration
+	fn       func(ctx context.Context) error
+	last     time.Time // Start time of the last run executed by this process.
+}
+
+// schedule starts running fn every interval, in its own goroutine. Runs are
+// recorded in the Store, so the schedule is kept across restarts: a job whose
+// last run is older than the interval (e.g. after some downtime) is run straight
+// away, once. Runs of the same job never overlap; a run lasting longer than the
+// interval just delays the next one.
+//
+// The job stops once ctx is done. fn is expected to return early then, and the
+// run is recorded as interrupted. Wait on jobs for the stopped jobs to finish.
+func schedule(ctx context.Context, name string, interval time.Duration, fn func(ctx context.Context) error) {
+	j := &job{name: name, interval: interval, fn: fn}
+	jobs.Add(1)
+	go func() {
+		defer jobs.Done()
+		j.loop(ctx)
+	}()
+}
+
+// loop waits for the next scheduled time and executes the job, until ctx is done.
+func (j *job) loop(ctx context.Context) {
+	for {
+		timer := time.NewTimer(j.next().Sub(time.Now()))
+		select {
+		case <-timer.C:
+			j.execute(ctx)
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// next computes the time of the next run from the last one executed by this process
+// or, upon start, from the last recorded one.
+func (j *job) next() time.Time {
+	if !j.last.IsZero() {
+		// Recording the runs may fail, so the in-memory start time is the reliable one.
+		return j.last.Add(j.interval)
+	}
+
+	db := openStore()
+	defer db.close()
+
+	last, ok := db.lastRun(j.name)
+	if !ok {
+		return time.Now() // Nothing recorded yet, or the Store is failing.
+	}
+	if last.Status == runRunning {
+		// Only one run is active at a time, so this is a leftover from a previous process.
+		last.Status = runInterrupted
+		last.End = time.Now()
+		if err := db.saveRun(last); err != nil {
+			Logger.Println("Error: saveRun() - ", err)
+		}
+		return time.Now()
+	}
+	return last.Start.Add(j.interval)
+}
+
+// execute runs the job, recording its start, end and status.
+func (j *job) execute(ctx context.Context) {
+	db := openStore()
+	defer db.close()
+
+	j.last = time.Now()
+	r := &Run{
+		Id:     newId(),
+		Job:    j.name,
+		Start:  j.last,
+		Status: runRunning,
+	}
+	if err := db.saveRun(r); err != nil {
+		Logger.Println("Error: saveRun() - ", err)
+	}
+
+	err := j.fn(ctx)
+
+	r.End = time.Now()
+	r.Status = runOK
+	if ctx.Err() != nil {
+		Logger.Printf("Job %s interrupted\n", j.name)
+		r.Status = runInterrupted
+	} else if err != nil {
+		Logger.Printf("Job %s failed: %v\n", j.name, err)
+		r.Status = runFailed
+		r.Error = err.Error()
+	}
+	if err := db.saveRun(r); err != nil {
+		Logger.Println("Error: saveRun() - ", err)
+	}
+}
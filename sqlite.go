@@ -0,0 +1,1638 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/ichinaski/hnnotifications/hnapi"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// migrations holds the SQLite schema changes, in order. The schema version is the
+// number of applied migrations. Existing entries must never be modified; append a new one instead.
+var migrations = []string{
+	// 1: initial schema.
+	`CREATE TABLE users (
+		id         TEXT PRIMARY KEY,
+		email      TEXT NOT NULL UNIQUE,
+		score      INTEGER NOT NULL,
+		keywords   TEXT NOT NULL DEFAULT '',
+		token      TEXT,
+		active     INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL
+	);
+	CREATE TABLE sent_items (
+		user_id TEXT NOT NULL,
+		item    INTEGER NOT NULL,
+		PRIMARY KEY (user_id, item)
+	);
+	CREATE INDEX users_score_active ON users (score, active);`,
+	// 2: scheduler runs.
+	`CREATE TABLE runs (
+		id         TEXT PRIMARY KEY,
+		job        TEXT NOT NULL,
+		started_at DATETIME NOT NULL,
+		ended_at   DATETIME,
+		status     TEXT NOT NULL,
+		error      TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX runs_job_started_at ON runs (job, started_at);`,
+	// 3: story lists.
+	`ALTER TABLE users ADD COLUMN feeds TEXT NOT NULL DEFAULT '';`,
+	// 4: item filters.
+	`ALTER TABLE users ADD COLUMN types TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN authors TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN max_age INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN min_comments INTEGER NOT NULL DEFAULT 0;`,
+	// 5: keyword queries.
+	`ALTER TABLE users ADD COLUMN query TEXT NOT NULL DEFAULT '';`,
+	// 6: exact matching switch.
+	`ALTER TABLE users ADD COLUMN exact INTEGER NOT NULL DEFAULT 0;`,
+	// 7: article matching switch.
+	`ALTER TABLE users ADD COLUMN article INTEGER NOT NULL DEFAULT 0;`,
+	// 8: domain rules.
+	`ALTER TABLE users ADD COLUMN domains TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN blocked_domains TEXT NOT NULL DEFAULT '';`,
+	// 9: named rules. The user settings become their "default" rule.
+	`CREATE TABLE rules (
+		user_id         TEXT NOT NULL,
+		name            TEXT NOT NULL,
+		score           INTEGER NOT NULL,
+		query           TEXT NOT NULL DEFAULT '',
+		keywords        TEXT NOT NULL DEFAULT '',
+		exact           INTEGER NOT NULL DEFAULT 0,
+		article         INTEGER NOT NULL DEFAULT 0,
+		feeds           TEXT NOT NULL DEFAULT '',
+		types           TEXT NOT NULL DEFAULT '',
+		authors         TEXT NOT NULL DEFAULT '',
+		max_age         INTEGER NOT NULL DEFAULT 0,
+		min_comments    INTEGER NOT NULL DEFAULT 0,
+		domains         TEXT NOT NULL DEFAULT '',
+		blocked_domains TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (user_id, name)
+	);
+	CREATE INDEX rules_score ON rules (score);
+	INSERT INTO rules (user_id, name, score, query, keywords, exact, article, feeds, types, authors, max_age, min_comments, domains, blocked_domains)
+		SELECT id, 'default', score, query, keywords, exact, article, feeds, types, authors, max_age, min_comments, domains, blocked_domains FROM users;
+	DROP INDEX users_score_active;
+	ALTER TABLE users DROP COLUMN score;
+	ALTER TABLE users DROP COLUMN query;
+	ALTER TABLE users DROP COLUMN keywords;
+	ALTER TABLE users DROP COLUMN exact;
+	ALTER TABLE users DROP COLUMN article;
+	ALTER TABLE users DROP COLUMN feeds;
+	ALTER TABLE users DROP COLUMN types;
+	ALTER TABLE users DROP COLUMN authors;
+	ALTER TABLE users DROP COLUMN max_age;
+	ALTER TABLE users DROP COLUMN min_comments;
+	ALTER TABLE users DROP COLUMN domains;
+	ALTER TABLE users DROP COLUMN blocked_domains;
+	CREATE INDEX users_active ON users (active);`,
+	// 10: digests.
+	`ALTER TABLE users ADD COLUMN delivery TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN digest_hour INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN digest_weekday INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN timezone TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN last_digest DATETIME;
+	CREATE TABLE queue (
+		user_id   TEXT NOT NULL,
+		item      INTEGER NOT NULL,
+		title     TEXT NOT NULL,
+		url       TEXT NOT NULL,
+		score     INTEGER NOT NULL,
+		comments  INTEGER NOT NULL,
+		rule      TEXT NOT NULL,
+		queued_at DATETIME NOT NULL,
+		PRIMARY KEY (user_id, item)
+	);`,
+	// 11: quiet hours and email caps.
+	`ALTER TABLE users ADD COLUMN quiet_start INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN quiet_end INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN max_per_hour INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN max_per_day INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE sends (
+		user_id TEXT NOT NULL,
+		sent_at DATETIME NOT NULL
+	);
+	CREATE INDEX sends_user_id ON sends (user_id, sent_at);`,
+	// 12: notification channels.
+	`ALTER TABLE users ADD COLUMN mute_email INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE channels (
+		user_id  TEXT NOT NULL,
+		id       TEXT NOT NULL,
+		kind     TEXT NOT NULL,
+		target   TEXT NOT NULL,
+		room     TEXT NOT NULL DEFAULT '',
+		secret   TEXT NOT NULL DEFAULT '',
+		verified INTEGER NOT NULL DEFAULT 0,
+		token    TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (user_id, id)
+	);`,
+	// 13: signed webhook deliveries.
+	`ALTER TABLE users ADD COLUMN webhook_secret TEXT NOT NULL DEFAULT '';
+	CREATE TABLE webhook_deliveries (
+		id           TEXT PRIMARY KEY,
+		user_id      TEXT NOT NULL,
+		channel_id   TEXT NOT NULL,
+		url          TEXT NOT NULL,
+		payload      TEXT NOT NULL,
+		signature    TEXT NOT NULL,
+		status       TEXT NOT NULL,
+		attempts     INTEGER NOT NULL DEFAULT 0,
+		last_error   TEXT NOT NULL DEFAULT '',
+		created_at   DATETIME NOT NULL,
+		updated_at   DATETIME NOT NULL,
+		next_attempt DATETIME NOT NULL
+	);
+	CREATE INDEX webhook_deliveries_status ON webhook_deliveries (status, next_attempt);
+	CREATE INDEX webhook_deliveries_user_id ON webhook_deliveries (user_id, created_at);`,
+	// 14: match history and feeds.
+	`ALTER TABLE users ADD COLUMN feed_token TEXT NOT NULL DEFAULT '';
+	CREATE INDEX users_feed_token ON users (feed_token);
+	CREATE TABLE history (
+		user_id    TEXT NOT NULL,
+		item       INTEGER NOT NULL,
+		title      TEXT NOT NULL,
+		url        TEXT NOT NULL,
+		score      INTEGER NOT NULL,
+		comments   INTEGER NOT NULL,
+		rule       TEXT NOT NULL,
+		matched_at DATETIME NOT NULL,
+		PRIMARY KEY (user_id, item)
+	);`,
+	// 15: stored items and their score history.
+	`CREATE TABLE items (
+		id         INTEGER PRIMARY KEY,
+		author     TEXT NOT NULL,
+		title      TEXT NOT NULL,
+		url        TEXT NOT NULL,
+		type       TEXT NOT NULL,
+		time       INTEGER NOT NULL,
+		score      INTEGER NOT NULL,
+		comments   INTEGER NOT NULL,
+		first_seen DATETIME NOT NULL,
+		fetched_at DATETIME NOT NULL
+	);
+	CREATE INDEX items_fetched_at ON items (fetched_at);
+	CREATE TABLE item_snapshots (
+		item     INTEGER NOT NULL,
+		taken_at DATETIME NOT NULL,
+		score    INTEGER NOT NULL,
+		comments INTEGER NOT NULL,
+		PRIMARY KEY (item, taken_at)
+	);
+	CREATE INDEX item_snapshots_taken_at ON item_snapshots (taken_at);`,
+	// 16: velocity rules.
+	`ALTER TABLE rules ADD COLUMN velocity INTEGER NOT NULL DEFAULT 0;`,
+	// 17: comment alerts.
+	`ALTER TABLE users ADD COLUMN hn_username TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN watch_replies INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN watch_mentions INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN watch_since DATETIME;
+	ALTER TABLE users ADD COLUMN watch_keywords TEXT NOT NULL DEFAULT '';
+	CREATE TABLE watched_threads (
+		user_id TEXT NOT NULL,
+		item    INTEGER NOT NULL,
+		since   DATETIME NOT NULL,
+		PRIMARY KEY (user_id, item)
+	);
+	CREATE TABLE seen_comments (
+		id      INTEGER PRIMARY KEY,
+		seen_at DATETIME NOT NULL
+	);
+	CREATE INDEX seen_comments_seen_at ON seen_comments (seen_at);`,
+	// 18: followed accounts.
+	`CREATE TABLE follows (
+		user_id  TEXT NOT NULL,
+		username TEXT NOT NULL,
+		PRIMARY KEY (user_id, username)
+	);
+	CREATE TABLE followed_accounts (
+		username  TEXT PRIMARY KEY,
+		last_item INTEGER NOT NULL
+	);`,
+	// 19: watched stories.
+	`CREATE TABLE watched_items (
+		user_id    TEXT NOT NULL,
+		item       INTEGER NOT NULL,
+		title      TEXT NOT NULL,
+		score      INTEGER NOT NULL,
+		comments   INTEGER NOT NULL,
+		front_page INTEGER NOT NULL,
+		since      DATETIME NOT NULL,
+		PRIMARY KEY (user_id, item)
+	);`,
+	// 20: personal API tokens.
+	`CREATE TABLE api_tokens (
+		id         TEXT PRIMARY KEY,
+		user_id    TEXT NOT NULL,
+		name       TEXT NOT NULL,
+		hash       TEXT NOT NULL UNIQUE,
+		scopes     TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		last_used  DATETIME
+	);
+	CREATE INDEX api_tokens_user ON api_tokens (user_id);`,
+	// 21: channels awaiting the confirmation link.
+	`CREATE TABLE pending_channels (
+		user_id TEXT PRIMARY KEY,
+		id      TEXT NOT NULL,
+		kind    TEXT NOT NULL,
+		target  TEXT NOT NULL,
+		room    TEXT NOT NULL DEFAULT '',
+		secret  TEXT NOT NULL DEFAULT ''
+	);`,
+	// 22: webhook secrets of the users created before webhooks were signed.
+	`UPDATE users SET webhook_secret = lower(hex(randomblob(16))) WHERE webhook_secret = '';`,
+	// 23: feed tokens of the users created before the feeds were introduced, keying their watch links.
+	`UPDATE users SET feed_token = lower(hex(randomblob(16))) WHERE feed_token = '';`,
+}
+
+// sqliteStore is a Store backed by an embedded SQLite database.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// openSQLite opens the database file at path, and applies any pending migration.
+func openSQLite(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer. Serializing access avoids "database is locked" errors.
+	db.SetMaxOpenConns(1)
+
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+// migrate brings the database schema up to date.
+func migrate(db *sql.DB) error {
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)"); err != nil {
+		return err
+	}
+
+	var version int
+	err := db.QueryRow("SELECT version FROM schema_version").Scan(&version)
+	if err == sql.ErrNoRows {
+		if _, err = db.Exec("INSERT INTO schema_version (version) VALUES (0)"); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[version]); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec("UPDATE schema_version SET version = ?", version+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		Logger.Printf("Applied SQLite migration %d\n", version+1)
+	}
+	return nil
+}
+
+// close is a no-op. The underlying sql.DB is shared by all the callers.
+func (s *sqliteStore) close() {}
+
+// userColumns lists the users columns read by scanUser, in order.
+const userColumns = "id, email, token, active, created_at, delivery, digest_hour, digest_weekday, timezone, last_digest, " +
+	"quiet_start, quiet_end, max_per_hour, max_per_day, mute_email, webhook_secret, feed_token, " +
+	"hn_username, watch_replies, watch_mentions, watch_since, watch_keywords"
+
+// ruleColumns lists the rules columns read by scanRule, in order, but the user_id.
+const ruleColumns = "name, score, query, keywords, exact, article, feeds, types, authors, max_age, min_comments, domains, blocked_domains, velocity"
+
+// scanner is implemented by both sql.Row and sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// userRow holds the values of a row selecting userColumns.
+type userRow struct {
+	u          User
+	id         string
+	token      sql.NullString
+	lastDigest *time.Time
+	watchSince *time.Time
+}
+
+// dest returns the scan destinations, matching userColumns.
+func (r *userRow) dest() []interface{} {
+	return []interface{}{&r.id, &r.u.Email, &r.token, &r.u.Active, &r.u.CreatedAt,
+		&r.u.Mode, &r.u.Hour, &r.u.Weekday, &r.u.Timezone, &r.lastDigest,
+		&r.u.QuietStart, &r.u.QuietEnd, &r.u.MaxPerHour, &r.u.MaxPerDay, &r.u.MuteEmail, &r.u.WebhookSecret, &r.u.FeedToken,
+		&r.u.Watch.Username, &r.u.Watch.Replies, &r.u.Watch.Mentions, &r.watchSince, &r.u.Watch.Keywords}
+}
+
+// user returns the scanned User.
+func (r *userRow) user() *User {
+	u := r.u
+	u.Id = Id(r.id)
+	u.Token = r.token.String
+	if r.lastDigest != nil {
+		u.LastDigest = *r.lastDigest
+	}
+	if r.watchSince != nil {
+		u.Watch.Since = *r.watchSince
+	}
+	return &u
+}
+
+// scanUser reads a User from a row selecting userColumns. Rules, watched threads,
+// followed accounts, watched stories and API tokens are not loaded.
+func scanUser(row scanner) (*User, error) {
+	var r userRow
+	if err := row.Scan(r.dest()...); err != nil {
+		return nil, err
+	}
+	return r.user(), nil
+}
+
+// scanRule reads a Rule from a row selecting ruleColumns, preceded by the given columns.
+func scanRule(row scanner, dest ...interface{}) (Rule, error) {
+	var (
+		r        Rule
+		keywords string
+		feeds    string
+		types    string
+		authors  string
+		domains  string
+		blocked  string
+	)
+	dest = append(dest, &r.Name, &r.Score, &r.Query, &keywords, &r.Exact, &r.Article, &feeds, &types, &authors,
+		&r.MaxAge, &r.MinComments, &domains, &blocked, &r.Velocity)
+	if err := row.Scan(dest...); err != nil {
+		return r, err
+	}
+	r.Keywords = Keywords(keywords)
+	r.Feeds = strings.Fields(feeds)
+	r.Types = strings.Fields(types)
+	r.Authors = strings.Fields(authors)
+	r.Domains = strings.Fields(domains)
+	r.BlockedDomains = strings.Fields(blocked)
+	return r, nil
+}
+
+// ruleArgs returns the values of the rule, matching ruleColumns.
+func ruleArgs(r *Rule) []interface{} {
+	return []interface{}{r.Name, r.Score, r.Query, strings.Join(r.Keywords, " "), r.Exact, r.Article,
+		strings.Join(r.Feeds, " "), strings.Join(r.Types, " "), strings.Join(r.Authors, " "), r.MaxAge,
+		r.MinComments, strings.Join(r.Domains, " "), strings.Join(r.BlockedDomains, " "), r.Velocity}
+}
+
+// execer is implemented by both sql.DB and sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// upsertRule inserts/updates a rule of the given user, keeping its position.
+func upsertRule(db execer, uid string, r *Rule) error {
+	_, err := db.Exec(`INSERT INTO rules (user_id, `+ruleColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id, name) DO UPDATE SET score = excluded.score, query = excluded.query,
+		keywords = excluded.keywords, exact = excluded.exact, article = excluded.article, feeds = excluded.feeds,
+		types = excluded.types, authors = excluded.authors, max_age = excluded.max_age,
+		min_comments = excluded.min_comments, domains = excluded.domains, blocked_domains = excluded.blocked_domains,
+		velocity = excluded.velocity`,
+		append([]interface{}{uid}, ruleArgs(r)...)...)
+	return err
+}
+
+// loadRules reads the user rules, in order.
+func (s *sqliteStore) loadRules(u *User) error {
+	rows, err := s.db.Query("SELECT "+ruleColumns+" FROM rules WHERE user_id = ? ORDER BY rowid", u.Id.Hex())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	u.Rules = nil
+	for rows.Next() {
+		r, err := scanRule(rows)
+		if err != nil {
+			return err
+		}
+		u.Rules = append(u.Rules, r)
+	}
+	return rows.Err()
+}
+
+// queryUser reads a single user, along with its rules, channels, watched threads, followed
+// accounts, watched stories and API tokens.
+func (s *sqliteStore) queryUser(where string, args ...interface{}) (*User, error) {
+	u, err := scanUser(s.db.QueryRow("SELECT "+userColumns+" FROM users WHERE "+where, args...))
+	if err != nil {
+		return nil, err
+	}
+	if err := s.loadRules(u); err != nil {
+		return nil, err
+	}
+	if err := s.loadThreads(u); err != nil {
+		return nil, err
+	}
+	if err := s.loadFollowing(u); err != nil {
+		return nil, err
+	}
+	if err := s.loadWatched(u); err != nil {
+		return nil, err
+	}
+	if err := s.loadTokens(u); err != nil {
+		return nil, err
+	}
+	return u, s.loadChannels(u)
+}
+
+// insertChannel inserts a channel of the given user.
+func insertChannel(db execer, uid string, c *Channel) error {
+	_, err := db.Exec("INSERT INTO channels (user_id, id, kind, target, room, secret, verified, token) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		uid, c.Id, c.Kind, c.Target, c.Room, c.Secret, c.Verified, c.Token)
+	return err
+}
+
+// loadChannels reads the user channels, in order.
+func (s *sqliteStore) loadChannels(u *User) error {
+	rows, err := s.db.Query("SELECT id, kind, target, room, secret, verified, token FROM channels WHERE user_id = ? ORDER BY rowid", u.Id.Hex())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	u.Channels = nil
+	for rows.Next() {
+		var c Channel
+		if err := rows.Scan(&c.Id, &c.Kind, &c.Target, &c.Room, &c.Secret, &c.Verified, &c.Token); err != nil {
+			return err
+		}
+		u.Channels = append(u.Channels, c)
+	}
+	return rows.Err()
+}
+
+// insertThread inserts a watched thread of the given user.
+func insertThread(db execer, uid string, t *WatchedThread) error {
+	_, err := db.Exec("INSERT INTO watched_threads (user_id, item, since) VALUES (?, ?, ?)", uid, t.Id, t.Since)
+	return err
+}
+
+// loadThreads reads the user watched threads, in order.
+func (s *sqliteStore) loadThreads(u *User) error {
+	rows, err := s.db.Query("SELECT item, since FROM watched_threads WHERE user_id = ? ORDER BY rowid", u.Id.Hex())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	u.Watch.Threads = nil
+	for rows.Next() {
+		var t WatchedThread
+		if err := rows.Scan(&t.Id, &t.Since); err != nil {
+			return err
+		}
+		u.Watch.Threads = append(u.Watch.Threads, t)
+	}
+	return rows.Err()
+}
+
+// insertFollows inserts the followed accounts of the given user.
+func insertFollows(db execer, uid string, usernames []string) error {
+	for _, name := range usernames {
+		if _, err := db.Exec("INSERT OR IGNORE INTO follows (user_id, username) VALUES (?, ?)", uid, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadFollowing reads the user followed accounts, in order.
+func (s *sqliteStore) loadFollowing(u *User) error {
+	rows, err := s.db.Query("SELECT username FROM follows WHERE user_id = ? ORDER BY rowid", u.Id.Hex())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	u.Following = nil
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		u.Following = append(u.Following, name)
+	}
+	return rows.Err()
+}
+
+// upsertWatchedItem inserts/updates a watched story of the given user.
+func upsertWatchedItem(db execer, uid string, w *WatchedItem) error {
+	_, err := db.Exec(`INSERT OR REPLACE INTO watched_items (user_id, item, title, score, comments, front_page, since)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, uid, w.Id, w.Title, w.Score, w.Comments, w.FrontPage, w.Since)
+	return err
+}
+
+// loadWatched reads the user watched stories, in order.
+func (s *sqliteStore) loadWatched(u *User) error {
+	rows, err := s.db.Query("SELECT item, title, score, comments, front_page, since FROM watched_items WHERE user_id = ? ORDER BY rowid",
+		u.Id.Hex())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	u.Watched = nil
+	for rows.Next() {
+		var w WatchedItem
+		if err := rows.Scan(&w.Id, &w.Title, &w.Score, &w.Comments, &w.FrontPage, &w.Since); err != nil {
+			return err
+		}
+		u.Watched = append(u.Watched, w)
+	}
+	return rows.Err()
+}
+
+// insertAPIToken inserts an API token of the given user.
+func insertAPIToken(db execer, uid string, t *APIToken) error {
+	_, err := db.Exec("INSERT INTO api_tokens (id, user_id, name, hash, scopes, created_at, last_used) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		t.Id, uid, t.Name, t.Hash, strings.Join(t.Scopes, " "), t.CreatedAt, nullTime(t.LastUsed))
+	return err
+}
+
+// loadTokens reads the user API tokens, oldest first.
+func (s *sqliteStore) loadTokens(u *User) error {
+	rows, err := s.db.Query("SELECT id, name, hash, scopes, created_at, last_used FROM api_tokens WHERE user_id = ? ORDER BY created_at",
+		u.Id.Hex())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	u.Tokens = nil
+	for rows.Next() {
+		var (
+			t        APIToken
+			scopes   string
+			lastUsed *time.Time
+		)
+		if err := rows.Scan(&t.Id, &t.Name, &t.Hash, &scopes, &t.CreatedAt, &lastUsed); err != nil {
+			return err
+		}
+		t.Scopes = strings.Fields(scopes)
+		if lastUsed != nil {
+			t.LastUsed = *lastUsed
+		}
+		u.Tokens = append(u.Tokens, t)
+	}
+	return rows.Err()
+}
+
+// nullTime converts zero times into NULL values.
+func nullTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// nullString converts empty strings into NULL values.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// upsertUser inserts/updates a user, along with its rules, channels, watched threads,
+// followed accounts, watched stories and API tokens, into the database.
+func (s *sqliteStore) upsertUser(u *User) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	var lastDigest *time.Time
+	if !u.LastDigest.IsZero() {
+		lastDigest = &u.LastDigest
+	}
+	_, err = tx.Exec(`INSERT OR REPLACE INTO users (`+userColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		u.Id.Hex(), u.Email, nullString(u.Token), u.Active, u.CreatedAt,
+		u.Mode, u.Hour, u.Weekday, u.Timezone, lastDigest,
+		u.QuietStart, u.QuietEnd, u.MaxPerHour, u.MaxPerDay, u.MuteEmail, u.WebhookSecret, u.FeedToken,
+		u.Watch.Username, u.Watch.Replies, u.Watch.Mentions, nullTime(u.Watch.Since), u.Watch.Keywords)
+	for _, table := range []string{"rules", "channels", "watched_threads", "follows", "watched_items", "api_tokens"} {
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM "+table+" WHERE user_id = ?", u.Id.Hex())
+		}
+	}
+	for i := 0; err == nil && i < len(u.Rules); i++ {
+		err = upsertRule(tx, u.Id.Hex(), &u.Rules[i])
+	}
+	for i := 0; err == nil && i < len(u.Channels); i++ {
+		err = insertChannel(tx, u.Id.Hex(), &u.Channels[i])
+	}
+	for i := 0; err == nil && i < len(u.Watch.Threads); i++ {
+		err = insertThread(tx, u.Id.Hex(), &u.Watch.Threads[i])
+	}
+	if err == nil {
+		err = insertFollows(tx, u.Id.Hex(), u.Following)
+	}
+	for i := 0; err == nil && i < len(u.Watched); i++ {
+		err = upsertWatchedItem(tx, u.Id.Hex(), &u.Watched[i])
+	}
+	for i := 0; err == nil && i < len(u.Tokens); i++ {
+		err = insertAPIToken(tx, u.Id.Hex(), &u.Tokens[i])
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// validate checks whether the user and token pair is valid, returning the user if found.
+func (s *sqliteStore) validate(email, token string) *User {
+	if email == "" || token == "" {
+		Logger.Printf("User validation error: %s - %s\n", email, token)
+		return nil
+	}
+
+	u, err := s.queryUser("email = ? AND token = ?", email, token)
+	if err != nil {
+		Logger.Printf("User validation error: %s - %s. %v\n", email, token, err)
+		return nil
+	}
+	return u
+}
+
+// activate sets the account status to 'active'.
+func (s *sqliteStore) activate(email, token string) bool {
+	u := s.validate(email, token)
+	if u == nil {
+		return false
+	}
+
+	_, err := s.db.Exec("UPDATE users SET active = 1, token = NULL WHERE id = ?", u.Id.Hex())
+	if err != nil {
+		Logger.Println("Error: activate() - ", err)
+	}
+	return err == nil
+}
+
+// unsubscribe completely removes the user account from the database.
+func (s *sqliteStore) unsubscribe(email, token string) bool {
+	u := s.validate(email, token)
+	if u == nil {
+		return false
+	}
+
+	if err := s.update(u.Id.Hex(), removeUser); err != nil {
+		Logger.Println("Error: unsubscribe() - ", err)
+		return false
+	}
+	return true
+}
+
+// deleteUser completely removes the user account from the database. See unsubscribe.
+func (s *sqliteStore) deleteUser(uid Id) error {
+	return s.update(uid.Hex(), removeUser)
+}
+
+// removeUser deletes the user, along with all its rows.
+func removeUser(tx *sql.Tx, uid string) error {
+	for _, table := range []string{"sent_items", "rules", "queue", "sends", "channels", "webhook_deliveries", "history", "watched_threads", "follows", "watched_items", "api_tokens", "pending_channels"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE user_id = ?", uid); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec("DELETE FROM users WHERE id = ?", uid)
+	return err
+}
+
+// saveRule validates the user, adds the rule, replacing any rule with the same name,
+// and updates the delivery preferences, unless d is nil.
+func (s *sqliteStore) saveRule(email, token string, rule Rule, d *Delivery) bool {
+	return s.updateValidated(email, token, func(tx *sql.Tx, uid string) error {
+		return writeRule(tx, uid, &rule, d)
+	})
+}
+
+// saveUserRule adds the rule to the user, replacing any rule with the same name, and
+// updates the delivery preferences, unless d is nil. See saveRule.
+func (s *sqliteStore) saveUserRule(uid Id, rule Rule, d *Delivery) error {
+	return s.update(uid.Hex(), func(tx *sql.Tx, uid string) error {
+		return writeRule(tx, uid, &rule, d)
+	})
+}
+
+// writeRule upserts the user rule, and updates the delivery preferences, unless d is nil.
+func writeRule(tx *sql.Tx, uid string, rule *Rule, d *Delivery) error {
+	if err := upsertRule(tx, uid, rule); err != nil || d == nil {
+		return err
+	}
+	_, err := tx.Exec(`UPDATE users SET delivery = ?, digest_hour = ?, digest_weekday = ?, timezone = ?,
+		quiet_start = ?, quiet_end = ?, max_per_hour = ?, max_per_day = ?, mute_email = ? WHERE id = ?`,
+		d.Mode, d.Hour, d.Weekday, d.Timezone, d.QuietStart, d.QuietEnd, d.MaxPerHour, d.MaxPerDay, d.MuteEmail, uid)
+	return err
+}
+
+// deleteRule validates the user and removes the named rule.
+func (s *sqliteStore) deleteRule(email, token, name string) bool {
+	return s.updateValidated(email, token, func(tx *sql.Tx, uid string) error {
+		_, err := tx.Exec("DELETE FROM rules WHERE user_id = ? AND name = ?", uid, name)
+		return err
+	})
+}
+
+// deleteUserRule removes the named rule from the user.
+func (s *sqliteStore) deleteUserRule(uid Id, name string) error {
+	_, err := s.db.Exec("DELETE FROM rules WHERE user_id = ? AND name = ?", uid.Hex(), name)
+	return err
+}
+
+// updateValidated validates the user, and applies the change along with the
+// account activation, in a single transaction.
+func (s *sqliteStore) updateValidated(email, token string, change func(tx *sql.Tx, uid string) error) bool {
+	u := s.validate(email, token)
+	if u == nil {
+		return false
+	}
+
+	err := s.update(u.Id.Hex(), func(tx *sql.Tx, uid string) error {
+		if err := change(tx, uid); err != nil {
+			return err
+		}
+		_, err := tx.Exec("UPDATE users SET token = NULL, active = 1 WHERE id = ?", uid)
+		return err
+	})
+	if err != nil {
+		Logger.Println("Error: updateValidated() - ", err)
+	}
+	return err == nil
+}
+
+// update applies the change to the user in a single transaction.
+func (s *sqliteStore) update(uid string, change func(tx *sql.Tx, uid string) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := change(tx, uid); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// addChannel validates the user and adds the (unverified) channel, activating the account.
+func (s *sqliteStore) addChannel(email, token string, c Channel) bool {
+	return s.updateValidated(email, token, func(tx *sql.Tx, uid string) error {
+		return insertChannel(tx, uid, &c)
+	})
+}
+
+// addUserChannel adds the (unverified) channel to the user.
+func (s *sqliteStore) addUserChannel(uid Id, c Channel) error {
+	return s.update(uid.Hex(), func(tx *sql.Tx, uid string) error {
+		return insertChannel(tx, uid, &c)
+	})
+}
+
+// deleteChannel validates the user and removes the channel with the given id, along
+// with its pending webhook deliveries.
+func (s *sqliteStore) deleteChannel(email, token, id string) bool {
+	return s.updateValidated(email, token, func(tx *sql.Tx, uid string) error {
+		return removeChannel(tx, uid, id)
+	})
+}
+
+// deleteUserChannel removes the user channel with the given id, along with its
+// pending webhook deliveries.
+func (s *sqliteStore) deleteUserChannel(uid Id, id string) error {
+	return s.update(uid.Hex(), func(tx *sql.Tx, uid string) error {
+		return removeChannel(tx, uid, id)
+	})
+}
+
+// removeChannel deletes the user channel with the given id, along with its pending
+// webhook deliveries.
+func removeChannel(tx *sql.Tx, uid, id string) error {
+	_, err := tx.Exec("DELETE FROM channels WHERE user_id = ? AND id = ?", uid, id)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM webhook_deliveries WHERE user_id = ? AND channel_id = ? AND status = ?", uid, id, hookPending)
+	}
+	return err
+}
+
+// verifyChannel marks the user channel as verified, if the verification token matches.
+func (s *sqliteStore) verifyChannel(email, id, token string) bool {
+	if token == "" {
+		return false
+	}
+	res, err := s.db.Exec(`UPDATE channels SET verified = 1, token = ''
+		WHERE id = ? AND token = ? AND user_id = (SELECT id FROM users WHERE email = ?)`, id, token, email)
+	if err != nil {
+		Logger.Println("Error: verifyChannel() - ", err)
+		return false
+	}
+	n, err := res.RowsAffected()
+	return err == nil && n == 1
+}
+
+// findUsersForItem queries all users entitled to receive a given story.
+// Score, status and sent items are filtered by the query; the rest is matched afterwards.
+// Only the rules within the score threshold, or the velocity one, are loaded.
+func (s *sqliteStore) findUsersForItem(item *story) []User {
+	rows, err := s.db.Query(`SELECT `+userColumns+`, `+ruleColumns+` FROM users JOIN rules ON rules.user_id = users.id
+		WHERE active = 1 AND (score <= ? OR (velocity > 0 AND velocity <= ?))
+		AND NOT EXISTS (SELECT 1 FROM sent_items WHERE user_id = users.id AND item = ?)
+		ORDER BY users.id, rules.rowid`,
+		item.Score, item.Velocity, item.Id)
+	if err != nil {
+		Logger.Println(err)
+		return nil
+	}
+	defer rows.Close()
+
+	var (
+		candidates []*User
+		last       *User
+	)
+	for rows.Next() {
+		var ur userRow
+		r, err := scanRule(rows, ur.dest()...)
+		if err != nil {
+			Logger.Println(err)
+			continue
+		}
+		if last == nil || last.Id.Hex() != ur.id {
+			last = ur.user()
+			candidates = append(candidates, last)
+		}
+		last.Rules = append(last.Rules, r)
+	}
+	if err := rows.Err(); err != nil {
+		Logger.Println(err)
+	}
+
+	var result []User
+	for _, u := range candidates {
+		if !u.matches(item) {
+			continue
+		}
+		if err := s.loadSends(u); err != nil {
+			Logger.Println(err)
+		}
+		if err := s.loadChannels(u); err != nil {
+			Logger.Println(err)
+		}
+		result = append(result, *u)
+	}
+	return result
+}
+
+// updateSentItems adds the given item to each user's item set.
+func (s *sqliteStore) updateSentItems(emails []string, item int) error {
+	if len(emails) == 0 {
+		return nil
+	}
+
+	args := make([]interface{}, 0, len(emails)+1)
+	args = append(args, item)
+	for _, email := range emails {
+		args = append(args, email)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(emails)), ", ")
+
+	_, err := s.db.Exec(`INSERT OR IGNORE INTO sent_items (user_id, item)
+		SELECT id, ? FROM users WHERE email IN (`+placeholders+`)`, args...)
+	return err
+}
+
+// queueItem adds the given item to each user's queue, for digests and held items.
+func (s *sqliteStore) queueItem(emails []string, item QueuedItem) error {
+	if len(emails) == 0 {
+		return nil
+	}
+
+	args := []interface{}{item.Id, item.Title, item.Url, item.Score, item.Comments, item.Rule, item.QueuedAt}
+	for _, email := range emails {
+		args = append(args, email)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(emails)), ", ")
+
+	_, err := s.db.Exec(`INSERT OR IGNORE INTO queue (user_id, item, title, url, score, comments, rule, queued_at)
+		SELECT id, ?, ?, ?, ?, ?, ?, ? FROM users WHERE email IN (`+placeholders+`)`, args...)
+	return err
+}
+
+// findQueuedUsers queries the active users with queued items.
+func (s *sqliteStore) findQueuedUsers() ([]User, error) {
+	rows, err := s.db.Query(`SELECT ` + userColumns + ` FROM users
+		WHERE active = 1 AND EXISTS (SELECT 1 FROM queue WHERE user_id = users.id)`)
+	if err != nil {
+		return nil, err
+	}
+	var users []User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		users = append(users, *u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range users {
+		if err := s.loadQueue(&users[i]); err != nil {
+			return nil, err
+		}
+		if err := s.loadSends(&users[i]); err != nil {
+			return nil, err
+		}
+		if err := s.loadChannels(&users[i]); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+// loadQueue reads the user digest queue.
+func (s *sqliteStore) loadQueue(u *User) error {
+	rows, err := s.db.Query("SELECT item, title, url, score, comments, rule, queued_at FROM queue WHERE user_id = ? ORDER BY rowid", u.Id.Hex())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	u.Queue = nil
+	for rows.Next() {
+		var item QueuedItem
+		if err := rows.Scan(&item.Id, &item.Title, &item.Url, &item.Score, &item.Comments, &item.Rule, &item.QueuedAt); err != nil {
+			return err
+		}
+		u.Queue = append(u.Queue, item)
+	}
+	return rows.Err()
+}
+
+// clearQueue removes the given items from the user's queue, recording the digest time.
+func (s *sqliteStore) clearQueue(uid Id, ids []int, at time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for i := 0; err == nil && i < len(ids); i++ {
+		_, err = tx.Exec("DELETE FROM queue WHERE user_id = ? AND item = ?", uid.Hex(), ids[i])
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE users SET last_digest = ? WHERE id = ?", at, uid.Hex())
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// loadSends reads the times of the emails sent to the user over the last day,
+// unless the user has no email caps.
+func (s *sqliteStore) loadSends(u *User) error {
+	u.Sends = nil
+	if u.MaxPerHour == 0 && u.MaxPerDay == 0 {
+		return nil
+	}
+	rows, err := s.db.Query("SELECT sent_at FROM sends WHERE user_id = ? AND sent_at >= ?",
+		u.Id.Hex(), time.Now().UTC().Add(-24*time.Hour))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t time.Time
+		if err := rows.Scan(&t); err != nil {
+			return err
+		}
+		u.Sends = append(u.Sends, t)
+	}
+	return rows.Err()
+}
+
+// recordSend records an email sent to each user at the given time, for the email caps.
+// Records older than a day are dropped.
+func (s *sqliteStore) recordSend(emails []string, at time.Time) error {
+	if len(emails) == 0 {
+		return nil
+	}
+
+	args := make([]interface{}, 0, len(emails)+1)
+	args = append(args, at.UTC()) // Times are compared as strings; keep them all in UTC.
+	for _, email := range emails {
+		args = append(args, email)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(emails)), ", ")
+
+	if _, err := s.db.Exec(`INSERT INTO sends (user_id, sent_at)
+		SELECT id, ? FROM users WHERE email IN (`+placeholders+`)`, args...); err != nil {
+		return err
+	}
+	_, err := s.db.Exec("DELETE FROM sends WHERE sent_at < ?", at.UTC().Add(-24*time.Hour))
+	return err
+}
+
+// recordMatch adds the given item to each user's match history, unless already there.
+// Only the last maxHistory items are kept.
+func (s *sqliteStore) recordMatch(emails []string, item QueuedItem) error {
+	if len(emails) == 0 {
+		return nil
+	}
+
+	args := []interface{}{item.Id, item.Title, item.Url, item.Score, item.Comments, item.Rule, item.QueuedAt.UTC()}
+	for _, email := range emails {
+		args = append(args, email)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(emails)), ", ")
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT OR IGNORE INTO history (user_id, item, title, url, score, comments, rule, matched_at)
+		SELECT id, ?, ?, ?, ?, ?, ?, ? FROM users WHERE email IN (`+placeholders+`)`, args...)
+	// Drop the items older than the last maxHistory ones.
+	for i := 0; err == nil && i < len(emails); i++ {
+		_, err = tx.Exec(`DELETE FROM history WHERE user_id = (SELECT id FROM users WHERE email = ?1)
+			AND rowid <= (SELECT history.rowid FROM history JOIN users ON users.id = history.user_id
+			WHERE users.email = ?1 ORDER BY history.rowid DESC LIMIT 1 OFFSET ?2)`, emails[i], maxHistory)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// findHistory queries the most recently matched items of the user, newest first.
+func (s *sqliteStore) findHistory(uid Id, limit int) ([]QueuedItem, error) {
+	rows, err := s.db.Query(`SELECT item, title, url, score, comments, rule, matched_at FROM history
+		WHERE user_id = ? ORDER BY rowid DESC LIMIT ?`, uid.Hex(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []QueuedItem
+	for rows.Next() {
+		var item QueuedItem
+		if err := rows.Scan(&item.Id, &item.Title, &item.Url, &item.Score, &item.Comments, &item.Rule, &item.QueuedAt); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// setFeedToken validates the user and assigns the feed token, activating the account.
+func (s *sqliteStore) setFeedToken(email, token, feedToken string) bool {
+	return s.updateValidated(email, token, func(tx *sql.Tx, uid string) error {
+		_, err := tx.Exec("UPDATE users SET feed_token = ? WHERE id = ?", feedToken, uid)
+		return err
+	})
+}
+
+// findFeedUser queries a user by its feed token.
+func (s *sqliteStore) findFeedUser(feedToken string) (*User, bool) {
+	if feedToken == "" {
+		return &User{}, false
+	}
+	u, err := s.queryUser("feed_token = ?", feedToken)
+	if err == sql.ErrNoRows {
+		return &User{}, false
+	} else if err != nil {
+		Logger.Println("Error: findFeedUser() - ", err)
+		return &User{}, false
+	}
+	return u, true
+}
+
+// saveWatch validates the user and replaces its comment watch, activating the account.
+func (s *sqliteStore) saveWatch(email, token string, w CommentWatch) bool {
+	return s.updateValidated(email, token, func(tx *sql.Tx, uid string) error {
+		_, err := tx.Exec(`UPDATE users SET hn_username = ?, watch_replies = ?, watch_mentions = ?, watch_since = ?,
+			watch_keywords = ? WHERE id = ?`, w.Username, w.Replies, w.Mentions, nullTime(w.Since), w.Keywords, uid)
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM watched_threads WHERE user_id = ?", uid)
+		}
+		for i := 0; err == nil && i < len(w.Threads); i++ {
+			err = insertThread(tx, uid, &w.Threads[i])
+		}
+		return err
+	})
+}
+
+// findWatchers queries the active users watching comments.
+func (s *sqliteStore) findWatchers() ([]User, error) {
+	rows, err := s.db.Query(`SELECT ` + userColumns + ` FROM users
+		WHERE active = 1 AND ((hn_username != '' AND (watch_replies = 1 OR watch_mentions = 1))
+		OR EXISTS (SELECT 1 FROM watched_threads WHERE user_id = users.id))`)
+	if err != nil {
+		return nil, err
+	}
+	var users []User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		users = append(users, *u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range users {
+		if err := s.loadThreads(&users[i]); err != nil {
+			return nil, err
+		}
+		if err := s.loadSends(&users[i]); err != nil {
+			return nil, err
+		}
+		if err := s.loadChannels(&users[i]); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+// saveFollowing validates the user and replaces the followed accounts, activating the account.
+func (s *sqliteStore) saveFollowing(email, token string, usernames []string) bool {
+	return s.updateValidated(email, token, func(tx *sql.Tx, uid string) error {
+		if _, err := tx.Exec("DELETE FROM follows WHERE user_id = ?", uid); err != nil {
+			return err
+		}
+		return insertFollows(tx, uid, usernames)
+	})
+}
+
+// findFollowers queries the active users following any account.
+func (s *sqliteStore) findFollowers() ([]User, error) {
+	rows, err := s.db.Query(`SELECT ` + userColumns + ` FROM users
+		WHERE active = 1 AND EXISTS (SELECT 1 FROM follows WHERE user_id = users.id)`)
+	if err != nil {
+		return nil, err
+	}
+	var users []User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		users = append(users, *u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range users {
+		if err := s.loadFollowing(&users[i]); err != nil {
+			return nil, err
+		}
+		if err := s.loadSends(&users[i]); err != nil {
+			return nil, err
+		}
+		if err := s.loadChannels(&users[i]); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+// lastSubmissions returns the newest item seen of each followed account.
+func (s *sqliteStore) lastSubmissions() (map[string]int, error) {
+	rows, err := s.db.Query("SELECT username, last_item FROM followed_accounts")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	last := make(map[string]int)
+	for rows.Next() {
+		var (
+			name string
+			id   int
+		)
+		if err := rows.Scan(&name, &id); err != nil {
+			return nil, err
+		}
+		last[name] = id
+	}
+	return last, rows.Err()
+}
+
+// saveSubmissions replaces the newest item seen of the followed accounts. Accounts
+// left out are dropped.
+func (s *sqliteStore) saveSubmissions(last map[string]int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM followed_accounts")
+	for name, id := range last {
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec("INSERT INTO followed_accounts (username, last_item) VALUES (?, ?)", name, id)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// saveWatchedItem adds the watched story to the user, or updates it if already watched.
+func (s *sqliteStore) saveWatchedItem(uid Id, w WatchedItem) error {
+	return upsertWatchedItem(s.db, uid.Hex(), &w)
+}
+
+// deleteWatchedItem removes the watched story from the user.
+func (s *sqliteStore) deleteWatchedItem(uid Id, id int) error {
+	_, err := s.db.Exec("DELETE FROM watched_items WHERE user_id = ? AND item = ?", uid.Hex(), id)
+	return err
+}
+
+// findWatching queries the active users watching any story.
+func (s *sqliteStore) findWatching() ([]User, error) {
+	rows, err := s.db.Query(`SELECT ` + userColumns + ` FROM users
+		WHERE active = 1 AND EXISTS (SELECT 1 FROM watched_items WHERE user_id = users.id)`)
+	if err != nil {
+		return nil, err
+	}
+	var users []User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		users = append(users, *u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range users {
+		if err := s.loadWatched(&users[i]); err != nil {
+			return nil, err
+		}
+		if err := s.loadSends(&users[i]); err != nil {
+			return nil, err
+		}
+		if err := s.loadChannels(&users[i]); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+// savePendingChannel replaces the channel of the user awaiting the confirmation link.
+func (s *sqliteStore) savePendingChannel(uid Id, c Channel) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO pending_channels (user_id, id, kind, target, room, secret) VALUES (?, ?, ?, ?, ?, ?)",
+		uid.Hex(), c.Id, c.Kind, c.Target, c.Room, c.Secret)
+	return err
+}
+
+// takePendingChannel removes and returns the channel of the user awaiting the
+// confirmation link, if its id matches.
+func (s *sqliteStore) takePendingChannel(uid Id, id string) (*Channel, bool) {
+	if id == "" {
+		return nil, false
+	}
+	var c Channel
+	err := s.db.QueryRow("SELECT id, kind, target, room, secret FROM pending_channels WHERE user_id = ? AND id = ?",
+		uid.Hex(), id).Scan(&c.Id, &c.Kind, &c.Target, &c.Room, &c.Secret)
+	if err == nil {
+		var res sql.Result
+		if res, err = s.db.Exec("DELETE FROM pending_channels WHERE user_id = ? AND id = ?", uid.Hex(), id); err == nil {
+			if n, _ := res.RowsAffected(); n == 0 {
+				err = sql.ErrNoRows // Taken concurrently.
+			}
+		}
+	}
+	if err != nil {
+		if err != sql.ErrNoRows {
+			Logger.Println("Error: takePendingChannel() - ", err)
+		}
+		return nil, false
+	}
+	return &c, true
+}
+
+// saveAPIToken adds the API token to the user.
+func (s *sqliteStore) saveAPIToken(uid Id, t APIToken) error {
+	return insertAPIToken(s.db, uid.Hex(), &t)
+}
+
+// deleteAPIToken removes the API token with the given id from the user.
+func (s *sqliteStore) deleteAPIToken(uid Id, id string) error {
+	_, err := s.db.Exec("DELETE FROM api_tokens WHERE user_id = ? AND id = ?", uid.Hex(), id)
+	return err
+}
+
+// touchAPIToken records the last use of the user API token with the given id.
+func (s *sqliteStore) touchAPIToken(uid Id, id string, at time.Time) error {
+	_, err := s.db.Exec("UPDATE api_tokens SET last_used = ? WHERE user_id = ? AND id = ?", at, uid.Hex(), id)
+	return err
+}
+
+// findTokenUser queries a user by the hash of one of its API tokens.
+func (s *sqliteStore) findTokenUser(hash string) (*User, bool) {
+	if hash == "" {
+		return &User{}, false
+	}
+	u, err := s.queryUser("id = (SELECT user_id FROM api_tokens WHERE hash = ?)", hash)
+	if err == sql.ErrNoRows {
+		return &User{}, false
+	} else if err != nil {
+		Logger.Println("Error: findTokenUser() - ", err)
+		return &User{}, false
+	}
+	return u, true
+}
+
+// maxSeenArgs is the number of comment ids looked up per seen_comments query,
+// within the SQLite limit of host parameters.
+const maxSeenArgs = 500
+
+// seenComments returns which of the given comments were seen before.
+func (s *sqliteStore) seenComments(ids []int) ([]int, error) {
+	var seen []int
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > maxSeenArgs {
+			n = maxSeenArgs
+		}
+		args := make([]interface{}, n)
+		for i, id := range ids[:n] {
+			args[i] = id
+		}
+		ids = ids[n:]
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+
+		rows, err := s.db.Query("SELECT id FROM seen_comments WHERE id IN ("+placeholders+")", args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			seen = append(seen, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return seen, nil
+}
+
+// markSeen records the given comments as seen at the given time. Records older
+// than commentRetention are dropped.
+func (s *sqliteStore) markSeen(ids []int, at time.Time) error {
+	at = at.UTC() // Times are compared as strings; keep them all in UTC.
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for i := 0; err == nil && i < len(ids); i++ {
+		_, err = tx.Exec("INSERT OR REPLACE INTO seen_comments (id, seen_at) VALUES (?, ?)", ids[i], at)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM seen_comments WHERE seen_at < ?", at.Add(-commentRetention))
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// saveItem stores the latest metadata of the item, fetched at the given time, and
+// records its score and comment count.
+func (s *sqliteStore) saveItem(item *hnapi.Item, at time.Time) error {
+	at = at.UTC() // Times are compared as strings; keep them all in UTC.
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO items (id, author, title, url, type, time, score, comments, first_seen, fetched_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET author = excluded.author, title = excluded.title, url = excluded.url,
+		type = excluded.type, time = excluded.time, score = excluded.score, comments = excluded.comments,
+		fetched_at = excluded.fetched_at`,
+		item.Id, item.By, item.Title, item.Url, item.Type, item.Time, item.Score, item.Descendants, at, at)
+	if err == nil {
+		_, err = tx.Exec("INSERT OR REPLACE INTO item_snapshots (item, taken_at, score, comments) VALUES (?, ?, ?, ?)",
+			item.Id, at, item.Score, item.Descendants)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// saveSnapshot records the score and comment count of the stored item, leaving the
+// item itself, and its fetch time, untouched.
+func (s *sqliteStore) saveSnapshot(id int, sn Snapshot) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO item_snapshots (item, taken_at, score, comments)
+		SELECT ?, ?, ?, ? WHERE EXISTS (SELECT 1 FROM items WHERE id = ?)`,
+		id, sn.At.UTC(), sn.Score, sn.Comments, id)
+	return err
+}
+
+// findItems queries the stored items with the given ids, without their snapshots.
+func (s *sqliteStore) findItems(ids []int) ([]StoredItem, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+
+	rows, err := s.db.Query(`SELECT id, author, title, url, type, time, score, comments, first_seen, fetched_at
+		FROM items WHERE id IN (`+placeholders+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []StoredItem
+	for rows.Next() {
+		var si StoredItem
+		if err := rows.Scan(&si.Id, &si.By, &si.Title, &si.Url, &si.Type, &si.Time, &si.Score, &si.Comments,
+			&si.FirstSeen, &si.FetchedAt); err != nil {
+			return nil, err
+		}
+		items = append(items, si)
+	}
+	return items, rows.Err()
+}
+
+// findSnapshots queries the snapshots of the item taken since the given time, oldest first.
+func (s *sqliteStore) findSnapshots(id int, since time.Time) ([]Snapshot, error) {
+	rows, err := s.db.Query("SELECT taken_at, score, comments FROM item_snapshots WHERE item = ? AND taken_at >= ? ORDER BY taken_at",
+		id, since.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var snapshots []Snapshot
+	for rows.Next() {
+		var snap Snapshot
+		if err := rows.Scan(&snap.At, &snap.Score, &snap.Comments); err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snap)
+	}
+	return snapshots, rows.Err()
+}
+
+// pruneItems removes the items last fetched before the given time, and the snapshots
+// taken before then.
+func (s *sqliteStore) pruneItems(before time.Time) error {
+	if _, err := s.db.Exec("DELETE FROM items WHERE fetched_at < ?", before.UTC()); err != nil {
+		return err
+	}
+	_, err := s.db.Exec("DELETE FROM item_snapshots WHERE taken_at < ? OR item NOT IN (SELECT id FROM items)", before.UTC())
+	return err
+}
+
+// deliveryColumns lists the webhook_deliveries columns read by queryDeliveries, in order.
+const deliveryColumns = "id, user_id, channel_id, url, payload, signature, status, attempts, last_error, created_at, updated_at, next_attempt"
+
+// saveDelivery inserts/updates a webhook delivery.
+func (s *sqliteStore) saveDelivery(d *WebhookDelivery) error {
+	// Times are compared as strings; keep them all in UTC.
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO webhook_deliveries (`+deliveryColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		d.Id.Hex(), d.UserId.Hex(), d.ChannelId, d.Url, d.Payload, d.Signature, d.Status, d.Attempts, d.LastError,
+		d.CreatedAt.UTC(), d.UpdatedAt.UTC(), d.NextAttempt.UTC())
+	return err
+}
+
+// dueDeliveries queries the pending webhook deliveries due for a retry at the given time.
+func (s *sqliteStore) dueDeliveries(now time.Time) ([]WebhookDelivery, error) {
+	return s.queryDeliveries("status = ? AND next_attempt <= ? ORDER BY next_attempt", hookPending, now.UTC())
+}
+
+// findDeliveries queries the most recent webhook deliveries of the user, newest first.
+func (s *sqliteStore) findDeliveries(uid Id, limit int) ([]WebhookDelivery, error) {
+	return s.queryDeliveries("user_id = ? ORDER BY created_at DESC LIMIT ?", uid.Hex(), limit)
+}
+
+// queryDeliveries reads the webhook deliveries matching the given condition.
+func (s *sqliteStore) queryDeliveries(where string, args ...interface{}) ([]WebhookDelivery, error) {
+	rows, err := s.db.Query("SELECT "+deliveryColumns+" FROM webhook_deliveries WHERE "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var (
+			d       WebhookDelivery
+			id, uid string
+		)
+		if err := rows.Scan(&id, &uid, &d.ChannelId, &d.Url, &d.Payload, &d.Signature, &d.Status, &d.Attempts,
+			&d.LastError, &d.CreatedAt, &d.UpdatedAt, &d.NextAttempt); err != nil {
+			return nil, err
+		}
+		d.Id, d.UserId = Id(id), Id(uid)
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// pruneDeliveries removes the finished webhook deliveries last attempted before the given time.
+func (s *sqliteStore) pruneDeliveries(before time.Time) error {
+	_, err := s.db.Exec("DELETE FROM webhook_deliveries WHERE status != ? AND updated_at < ?", hookPending, before.UTC())
+	return err
+}
+
+// updateToken assigns the new token to the user.
+func (s *sqliteStore) updateToken(uid Id, token string) error {
+	_, err := s.db.Exec("UPDATE users SET token = ? WHERE id = ?", nullString(token), uid.Hex())
+	return err
+}
+
+// findUser queries a user by its email field. Sent items are not loaded.
+func (s *sqliteStore) findUser(email string) (*User, bool) {
+	u, err := s.queryUser("email = ?", email)
+	if err == sql.ErrNoRows {
+		return &User{}, false
+	} else if err != nil {
+		Logger.Println("Error: findUser() - ", err)
+		return &User{}, false
+	}
+	return u, true
+}
+
+// saveRun inserts/updates a scheduler run.
+func (s *sqliteStore) saveRun(r *Run) error {
+	var end *time.Time
+	if !r.End.IsZero() {
+		utc := r.End.UTC()
+		end = &utc
+	}
+	_, err := s.db.Exec("INSERT OR REPLACE INTO runs (id, job, started_at, ended_at, status, error) VALUES (?, ?, ?, ?, ?, ?)",
+		r.Id.Hex(), r.Job, r.Start.UTC(), end, r.Status, r.Error)
+	return err
+}
+
+// lastRun returns the most recently started run of the given job.
+func (s *sqliteStore) lastRun(job string) (*Run, bool) {
+	var (
+		r   Run
+		id  string
+		end *time.Time
+	)
+	err := s.db.QueryRow("SELECT id, job, started_at, ended_at, status, error FROM runs WHERE job = ? ORDER BY started_at DESC LIMIT 1", job).
+		Scan(&id, &r.Job, &r.Start, &end, &r.Status, &r.Error)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			Logger.Println("Error: lastRun() - ", err)
+		}
+		return &r, false
+	}
+	r.Id = Id(id)
+	if end != nil {
+		r.End = *end
+	}
+	return &r, true
+}
@@ -0,0 +1,230 @@
+package main
+
+import "strings"
+
+// stem reduces an English word to its stem, following the Porter stemming
+// algorithm (https://tartarus.org/martin/PorterStemmer/def.txt), so that
+// "database" and "databases", or "connect" and "connected", share the same stem.
+// The word is expected in lower case. Short words and words with non ASCII
+// letters are returned untouched.
+func stem(word string) string {
+	if len(word) <= 2 {
+		return word
+	}
+	for i := 0; i < len(word); i++ {
+		if word[i] < 'a' || word[i] > 'z' {
+			return word
+		}
+	}
+
+	w := []byte(word)
+	w = step1a(w)
+	w = step1b(w)
+	w = step1c(w)
+	w = step2(w)
+	w = step3(w)
+	w = step4(w)
+	w = step5(w)
+	return string(w)
+}
+
+// isConsonant reports whether w[i] is a consonant. 'y' is a consonant when
+// preceded by a vowel, or at the beginning of the word.
+func isConsonant(w []byte, i int) bool {
+	switch w[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !isConsonant(w, i-1)
+	}
+	return true
+}
+
+// measure computes m, the number of vowel-consonant sequences in w: [C](VC)^m[V].
+func measure(w []byte) int {
+	m, i, n := 0, 0, len(w)
+	for i < n && isConsonant(w, i) {
+		i++
+	}
+	for i < n {
+		for i < n && !isConsonant(w, i) {
+			i++
+		}
+		if i == n {
+			break
+		}
+		for i < n && isConsonant(w, i) {
+			i++
+		}
+		m++
+	}
+	return m
+}
+
+// hasVowel reports whether w contains a vowel.
+func hasVowel(w []byte) bool {
+	for i := range w {
+		if !isConsonant(w, i) {
+			return true
+		}
+	}
+	return false
+}
+
+// endsDoubleConsonant reports whether w ends with a double consonant (e.g. -tt).
+func endsDoubleConsonant(w []byte) bool {
+	n := len(w)
+	return n >= 2 && w[n-1] == w[n-2] && isConsonant(w, n-1)
+}
+
+// endsCVC reports whether w ends with consonant-vowel-consonant, the last one not
+// being w, x or y (e.g. -hop, -fil).
+func endsCVC(w []byte) bool {
+	n := len(w)
+	if n < 3 || !isConsonant(w, n-3) || isConsonant(w, n-2) || !isConsonant(w, n-1) {
+		return false
+	}
+	c := w[n-1]
+	return c != 'w' && c != 'x' && c != 'y'
+}
+
+// replace swaps suffix for repl if w ends with suffix, and the stem measure is
+// greater than min. The second value reports whether w ended with suffix.
+func replace(w []byte, suffix, repl string, min int) ([]byte, bool) {
+	if !strings.HasSuffix(string(w), suffix) {
+		return w, false
+	}
+	base := w[:len(w)-len(suffix)]
+	if measure(base) > min {
+		return append(base[:len(base):len(base)], repl...), true
+	}
+	return w, true
+}
+
+func step1a(w []byte) []byte {
+	s := string(w)
+	switch {
+	case strings.HasSuffix(s, "sses"), strings.HasSuffix(s, "ies"):
+		return w[:len(w)-2]
+	case strings.HasSuffix(s, "ss"):
+		return w
+	case strings.HasSuffix(s, "s"):
+		return w[:len(w)-1]
+	}
+	return w
+}
+
+func step1b(w []byte) []byte {
+	s := string(w)
+	if strings.HasSuffix(s, "eed") {
+		if measure(w[:len(w)-3]) > 0 {
+			return w[:len(w)-1]
+		}
+		return w
+	}
+
+	var base []byte
+	switch {
+	case strings.HasSuffix(s, "ed") && hasVowel(w[:len(w)-2]):
+		base = w[:len(w)-2]
+	case strings.HasSuffix(s, "ing") && hasVowel(w[:len(w)-3]):
+		base = w[:len(w)-3]
+	default:
+		return w
+	}
+
+	b := string(base)
+	switch {
+	case strings.HasSuffix(b, "at"), strings.HasSuffix(b, "bl"), strings.HasSuffix(b, "iz"):
+		return append(base[:len(base):len(base)], 'e')
+	case endsDoubleConsonant(base):
+		if c := base[len(base)-1]; c != 'l' && c != 's' && c != 'z' {
+			return base[:len(base)-1]
+		}
+	case measure(base) == 1 && endsCVC(base):
+		return append(base[:len(base):len(base)], 'e')
+	}
+	return base
+}
+
+func step1c(w []byte) []byte {
+	if n := len(w); w[n-1] == 'y' && hasVowel(w[:n-1]) {
+		return append(w[:n-1:n-1], 'i')
+	}
+	return w
+}
+
+var step2Suffixes = []struct{ suffix, repl string }{
+	{"ational", "ate"}, {"tional", "tion"}, {"enci", "ence"}, {"anci", "ance"},
+	{"izer", "ize"}, {"abli", "able"}, {"alli", "al"}, {"entli", "ent"},
+	{"eli", "e"}, {"ousli", "ous"}, {"ization", "ize"}, {"ation", "ate"},
+	{"ator", "ate"}, {"alism", "al"}, {"iveness", "ive"}, {"fulness", "ful"},
+	{"ousness", "ous"}, {"aliti", "al"}, {"iviti", "ive"}, {"biliti", "ble"},
+}
+
+func step2(w []byte) []byte {
+	for _, s := range step2Suffixes {
+		if r, ok := replace(w, s.suffix, s.repl, 0); ok {
+			return r
+		}
+	}
+	return w
+}
+
+var step3Suffixes = []struct{ suffix, repl string }{
+	{"icate", "ic"}, {"ative", ""}, {"alize", "al"}, {"iciti", "ic"},
+	{"ical", "ic"}, {"ful", ""}, {"ness", ""},
+}
+
+func step3(w []byte) []byte {
+	for _, s := range step3Suffixes {
+		if r, ok := replace(w, s.suffix, s.repl, 0); ok {
+			return r
+		}
+	}
+	return w
+}
+
+var step4Suffixes = []string{
+	"al", "ance", "ence", "er", "ic", "able", "ible", "ant", "ement", "ment",
+	"ent", "ion", "ou", "ism", "ate", "iti", "ous", "ive", "ize",
+}
+
+func step4(w []byte) []byte {
+	// Pick the longest matching suffix.
+	best := ""
+	for _, suffix := range step4Suffixes {
+		if len(suffix) > len(best) && strings.HasSuffix(string(w), suffix) {
+			best = suffix
+		}
+	}
+	if best == "" {
+		return w
+	}
+
+	base := w[:len(w)-len(best)]
+	if measure(base) <= 1 {
+		return w
+	}
+	if best == "ion" {
+		if n := len(base); n == 0 || (base[n-1] != 's' && base[n-1] != 't') {
+			return w
+		}
+	}
+	return base
+}
+
+func step5(w []byte) []byte {
+	// Step 5a: remove a final -e.
+	if n := len(w); w[n-1] == 'e' {
+		base := w[:n-1]
+		if m := measure(base); m > 1 || (m == 1 && !endsCVC(base)) {
+			w = base
+		}
+	}
+	// Step 5b: -ll to -l.
+	if measure(w) > 1 && endsDoubleConsonant(w) && w[len(w)-1] == 'l' {
+		w = w[:len(w)-1]
+	}
+	return w
+}
@@ -0,0 +1,125 @@
+package main
+
+import "testing"
+
+// Word and stem pairs from the examples of the Porter stemming algorithm definition.
+var porterPairs = []struct{ word, stem string }{
+	// Step 1a.
+	{"caresses", "caress"},
+	{"ponies", "poni"},
+	{"ties", "ti"},
+	{"caress", "caress"},
+	{"cats", "cat"},
+
+	// Step 1b.
+	{"feed", "feed"},
+	{"agreed", "agre"},
+	{"plastered", "plaster"},
+	{"bled", "bled"},
+	{"motoring", "motor"},
+	{"sing", "sing"},
+	{"conflated", "conflat"},
+	{"troubled", "troubl"},
+	{"sized", "size"},
+	{"hopping", "hop"},
+	{"tanned", "tan"},
+	{"falling", "fall"},
+	{"hissing", "hiss"},
+	{"fizzed", "fizz"},
+	{"failing", "fail"},
+	{"filing", "file"},
+
+	// Step 1c.
+	{"happy", "happi"},
+	{"sky", "sky"},
+
+	// Step 2.
+	{"relational", "relat"},
+	{"conditional", "condit"},
+	{"rational", "ration"},
+	{"valenci", "valenc"},
+	{"digitizer", "digit"},
+	{"conformabli", "conform"},
+	{"radicalli", "radic"},
+	{"differentli", "differ"},
+	{"vileli", "vile"},
+	{"analogousli", "analog"},
+	{"vietnamization", "vietnam"},
+	{"predication", "predic"},
+	{"operator", "oper"},
+	{"feudalism", "feudal"},
+	{"decisiveness", "decis"},
+	{"hopefulness", "hope"},
+	{"callousness", "callous"},
+	{"formaliti", "formal"},
+	{"sensitiviti", "sensit"},
+	{"sensibiliti", "sensibl"},
+
+	// Step 3.
+	{"triplicate", "triplic"},
+	{"formative", "form"},
+	{"formalize", "formal"},
+	{"electriciti", "electr"},
+	{"electrical", "electr"},
+	{"hopeful", "hope"},
+	{"goodness", "good"},
+
+	// Step 4.
+	{"revival", "reviv"},
+	{"allowance", "allow"},
+	{"inference", "infer"},
+	{"airliner", "airlin"},
+	{"gyroscopic", "gyroscop"},
+	{"adjustable", "adjust"},
+	{"defensible", "defens"},
+	{"irritant", "irrit"},
+	{"replacement", "replac"},
+	{"adjustment", "adjust"},
+	{"dependent", "depend"},
+	{"adoption", "adopt"},
+	{"homologou", "homolog"},
+	{"communism", "commun"},
+	{"activate", "activ"},
+	{"angulariti", "angular"},
+	{"homologous", "homolog"},
+	{"effective", "effect"},
+	{"bowdlerize", "bowdler"},
+
+	// Step 5.
+	{"probate", "probat"},
+	{"rate", "rate"},
+	{"cease", "ceas"},
+	{"controll", "control"},
+	{"roll", "roll"},
+}
+
+func TestStem(t *testing.T) {
+	for _, p := range porterPairs {
+		if got := stem(p.word); got != p.stem {
+			t.Errorf("stem(%q) = %q, want %q", p.word, got, p.stem)
+		}
+	}
+}
+
+func TestStemConflation(t *testing.T) {
+	groups := [][]string{
+		{"database", "databases"},
+		{"connect", "connected", "connecting", "connection", "connections"},
+		{"generalize", "generalization", "generalizations"},
+	}
+	for _, g := range groups {
+		for _, w := range g[1:] {
+			if stem(w) != stem(g[0]) {
+				t.Errorf("stem(%q) = %q, want %q, as stem(%q)", w, stem(w), stem(g[0]), g[0])
+			}
+		}
+	}
+}
+
+func TestStemUntouched(t *testing.T) {
+	for _, w := range []string{"", "a", "is", "go", "k8s", "web3", "café", "naïve"} {
+		if got := stem(w); got != w {
+			t.Errorf("stem(%q) = %q, want it untouched", w, got)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ichinaski/hnnotifications/hnapi"
+)
+
+// backends opens an empty Store of each kind tested: in memory, and SQLite in a
+// temporary file.
+var backends = []struct {
+	name string
+	open func(t *testing.T) Store
+}{
+	{"memory", func(t *testing.T) Store { return newMemoryStore() }},
+	{"sqlite", func(t *testing.T) Store {
+		s, err := openSQLite(t.TempDir() + "/test.db")
+		if err != nil {
+			t.Fatalf("openSQLite() error: %v", err)
+		}
+		t.Cleanup(s.close)
+		return s
+	}},
+}
+
+// storeTests are run against all the backends, so that they behave the same.
+var storeTests = []struct {
+	name string
+	run  func(t *testing.T, db Store)
+}{
+	{"users", testStoreUsers},
+	{"findUsersForItem", testStoreFindUsersForItem},
+	{"rules", testStoreRules},
+	{"queue", testStoreQueue},
+	{"history", testStoreHistory},
+	{"deliveries", testStoreDeliveries},
+	{"tokens", testStoreTokens},
+	{"runs", testStoreRuns},
+}
+
+func TestStores(t *testing.T) {
+	for _, b := range backends {
+		for _, tt := range storeTests {
+			b, tt := b, tt
+			t.Run(b.name+"/"+tt.name, func(t *testing.T) {
+				tt.run(t, b.open(t))
+			})
+		}
+	}
+}
+
+// addUser stores an active user with the given rules.
+func addUser(t *testing.T, db Store, email string, rules ...Rule) *User {
+	t.Helper()
+	u := newUser(email, rules[0], Delivery{})
+	u.Rules = rules
+	u.Active = true
+	u.Token = ""
+	if err := db.upsertUser(u); err != nil {
+		t.Fatalf("upsertUser() error: %v", err)
+	}
+	return u
+}
+
+// setToken assigns a known token to the user, as the emailed links do.
+func setToken(t *testing.T, db Store, u *User) string {
+	t.Helper()
+	token := newToken()
+	if err := db.updateToken(u.Id, token); err != nil {
+		t.Fatalf("updateToken() error: %v", err)
+	}
+	return token
+}
+
+func testStoreUsers(t *testing.T, db Store) {
+	u := newUser("a@example.com", Rule{Name: defaultRule, Settings: Settings{Score: 300, Query: "rust"}}, Delivery{Mode: deliverDaily, Hour: 8})
+	if err := db.upsertUser(u); err != nil {
+		t.Fatalf("upsertUser() error: %v", err)
+	}
+
+	got, found := db.findUser("a@example.com")
+	if !found {
+		t.Fatal("findUser() found no user")
+	}
+	if got.Id != u.Id || got.Active || len(got.Rules) != 1 || got.Rules[0].Score != 300 || got.Rules[0].Query != "rust" {
+		t.Errorf("findUser() = %+v", got)
+	}
+	if got.Mode != deliverDaily || got.Hour != 8 || got.FeedToken != u.FeedToken || got.WebhookSecret != u.WebhookSecret {
+		t.Errorf("findUser() delivery and tokens = %+v", got)
+	}
+	if _, found := db.findUser("b@example.com"); found {
+		t.Error("findUser() found an unknown user")
+	}
+
+	if db.validate("a@example.com", "wrong") != nil || db.validate("a@example.com", "") != nil {
+		t.Error("validate() accepted a wrong token")
+	}
+	if !db.activate("a@example.com", u.Token) {
+		t.Fatal("activate() failed")
+	}
+	if db.activate("a@example.com", u.Token) {
+		t.Error("activate() accepted a spent token")
+	}
+	if got, _ := db.findUser("a@example.com"); !got.Active {
+		t.Error("activate() left the user inactive")
+	}
+
+	token := setToken(t, db, u)
+	if !db.unsubscribe("a@example.com", token) {
+		t.Fatal("unsubscribe() failed")
+	}
+	if _, found := db.findUser("a@example.com"); found {
+		t.Error("unsubscribe() kept the user")
+	}
+}
+
+func testStoreFindUsersForItem(t *testing.T, db Store) {
+	addUser(t, db, "low@example.com", Rule{Name: defaultRule, Settings: Settings{Score: 50}})
+	addUser(t, db, "high@example.com", Rule{Name: defaultRule, Settings: Settings{Score: 500}})
+	addUser(t, db, "rust@example.com",
+		Rule{Name: defaultRule, Settings: Settings{Score: 500}},
+		Rule{Name: "rust", Settings: Settings{Score: 10, Query: "rust"}})
+	addUser(t, db, "rising@example.com", Rule{Name: defaultRule, Settings: Settings{Score: 500, Velocity: 100}})
+	inactive := addUser(t, db, "inactive@example.com", Rule{Name: defaultRule, Settings: Settings{Score: 1}})
+	inactive.Active = false
+	if err := db.upsertUser(inactive); err != nil {
+		t.Fatalf("upsertUser() error: %v", err)
+	}
+	if err := db.updateSentItems([]string{"low@example.com"}, 2); err != nil {
+		t.Fatalf("updateSentItems() error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		story    story
+		expected []string
+	}{
+		{"score", story{Item: hnapi.Item{Id: 1, Title: "Go 2", Score: 100}, Feeds: []string{hnapi.Top}}, []string{"low@example.com"}},
+		{"already sent", story{Item: hnapi.Item{Id: 2, Title: "Go 2", Score: 100}, Feeds: []string{hnapi.Top}}, nil},
+		{"keywords", story{Item: hnapi.Item{Id: 3, Title: "Rust 2", Score: 20}, Feeds: []string{hnapi.Top}}, []string{"rust@example.com"}},
+		{"velocity", story{Item: hnapi.Item{Id: 4, Title: "Go 2", Score: 40}, Feeds: []string{hnapi.Top}, Velocity: 150}, []string{"rising@example.com"}},
+		{"other feed", story{Item: hnapi.Item{Id: 5, Title: "Go 2", Score: 1000}, Feeds: []string{hnapi.New}}, nil},
+		{"everyone", story{Item: hnapi.Item{Id: 6, Title: "Rust 2", Score: 1000}, Feeds: []string{hnapi.Top}},
+			[]string{"low@example.com", "high@example.com", "rust@example.com", "rising@example.com"}},
+	}
+
+	for _, tt := range tests {
+		users := db.findUsersForItem(&tt.story)
+		var emails []string
+		for _, u := range users {
+			emails = append(emails, u.Email)
+		}
+		if len(emails) != len(tt.expected) {
+			t.Errorf("%s: findUsersForItem() = %v, want %v", tt.name, emails, tt.expected)
+			continue
+		}
+		for _, email := range tt.expected {
+			if !contains(emails, email) {
+				t.Errorf("%s: findUsersForItem() = %v, want %v", tt.name, emails, tt.expected)
+				break
+			}
+		}
+	}
+}
+
+func testStoreRules(t *testing.T, db Store) {
+	u := addUser(t, db, "a@example.com", Rule{Name: defaultRule, Settings: Settings{Score: 300}})
+
+	token := setToken(t, db, u)
+	jobs := Rule{Name: "jobs", Settings: Settings{Score: 10, Types: []string{hnapi.JobType}}}
+	if !db.saveRule("a@example.com", token, jobs, &Delivery{Mode: deliverWeekly, Weekday: 1}) {
+		t.Fatal("saveRule() failed")
+	}
+	if db.saveRule("a@example.com", token, jobs, nil) {
+		t.Error("saveRule() accepted a spent token")
+	}
+	got, _ := db.findUser("a@example.com")
+	if len(got.Rules) != 2 || got.rule("jobs") == nil || got.rule("jobs").Types[0] != hnapi.JobType {
+		t.Errorf("saveRule() rules = %+v", got.Rules)
+	}
+	if got.Mode != deliverWeekly || got.Weekday != 1 {
+		t.Errorf("saveRule() delivery = %+v", got.Delivery)
+	}
+
+	// Nil deliveries are left untouched.
+	jobs.Settings.Score = 20
+	if err := db.saveUserRule(u.Id, jobs, nil); err != nil {
+		t.Fatalf("saveUserRule() error: %v", err)
+	}
+	got, _ = db.findUser("a@example.com")
+	if len(got.Rules) != 2 || got.rule("jobs").Score != 20 || got.Mode != deliverWeekly {
+		t.Errorf("saveUserRule() = %+v, %+v", got.Rules, got.Delivery)
+	}
+
+	token = setToken(t, db, u)
+	if !db.deleteRule("a@example.com", token, defaultRule) {
+		t.Fatal("deleteRule() failed")
+	}
+	if err := db.deleteUserRule(u.Id, "missing"); err != nil {
+		t.Fatalf("deleteUserRule() error: %v", err)
+	}
+	got, _ = db.findUser("a@example.com")
+	if len(got.Rules) != 1 || got.Rules[0].Name != "jobs" {
+		t.Errorf("deleteRule() rules = %+v", got.Rules)
+	}
+}
+
+func testStoreQueue(t *testing.T, db Store) {
+	u := addUser(t, db, "a@example.com", Rule{Name: defaultRule, Settings: Settings{Score: 300}})
+	addUser(t, db, "b@example.com", Rule{Name: defaultRule, Settings: Settings{Score: 300}})
+
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, id := range []int{1, 2, 3} {
+		if err := db.queueItem([]string{"a@example.com"}, QueuedItem{Id: id, Title: "Story", Rule: defaultRule, QueuedAt: now}); err != nil {
+			t.Fatalf("queueItem() error: %v", err)
+		}
+	}
+	users, err := db.findQueuedUsers()
+	if err != nil {
+		t.Fatalf("findQueuedUsers() error: %v", err)
+	}
+	if len(users) != 1 || users[0].Email != "a@example.com" || len(users[0].Queue) != 3 {
+		t.Fatalf("findQueuedUsers() = %+v", users)
+	}
+	if q := users[0].Queue[0]; q.Id != 1 || q.Title != "Story" || q.Rule != defaultRule || !q.QueuedAt.Equal(now) {
+		t.Errorf("findQueuedUsers() queue = %+v", users[0].Queue)
+	}
+
+	if err := db.clearQueue(u.Id, []int{1, 3}, now); err != nil {
+		t.Fatalf("clearQueue() error: %v", err)
+	}
+	users, _ = db.findQueuedUsers()
+	if len(users) != 1 || len(users[0].Queue) != 1 || users[0].Queue[0].Id != 2 {
+		t.Errorf("clearQueue() left %+v", users)
+	}
+	if err := db.clearQueue(u.Id, []int{2}, now); err != nil {
+		t.Fatalf("clearQueue() error: %v", err)
+	}
+	if users, _ = db.findQueuedUsers(); len(users) != 0 {
+		t.Errorf("findQueuedUsers() = %+v, want none", users)
+	}
+}
+
+func testStoreHistory(t *testing.T, db Store) {
+	u := addUser(t, db, "a@example.com", Rule{Name: defaultRule, Settings: Settings{Score: 300}})
+
+	now := time.Now().UTC().Truncate(time.Second)
+	for i, id := range []int{1, 2, 3, 2} { // Matched items are recorded once.
+		item := QueuedItem{Id: id, Title: "Story", Rule: defaultRule, QueuedAt: now.Add(time.Duration(i) * time.Minute)}
+		if err := db.recordMatch([]string{"a@example.com"}, item); err != nil {
+			t.Fatalf("recordMatch() error: %v", err)
+		}
+	}
+
+	tests := []struct {
+		limit    int
+		expected []int
+	}{
+		{10, []int{3, 2, 1}},
+		{2, []int{3, 2}},
+	}
+	for _, tt := range tests {
+		history, err := db.findHistory(u.Id, tt.limit)
+		if err != nil {
+			t.Fatalf("findHistory() error: %v", err)
+		}
+		var ids []int
+		for _, h := range history {
+			ids = append(ids, h.Id)
+		}
+		if len(ids) != len(tt.expected) {
+			t.Errorf("findHistory(%d) = %v, want %v", tt.limit, ids, tt.expected)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != tt.expected[i] {
+				t.Errorf("findHistory(%d) = %v, want %v", tt.limit, ids, tt.expected)
+				break
+			}
+		}
+	}
+}
+
+func testStoreDeliveries(t *testing.T, db Store) {
+	u := addUser(t, db, "a@example.com", Rule{Name: defaultRule, Settings: Settings{Score: 300}})
+
+	now := time.Now().UTC().Truncate(time.Second)
+	deliveries := []WebhookDelivery{
+		{Status: hookPending, NextAttempt: now.Add(-time.Minute)},
+		{Status: hookPending, NextAttempt: now.Add(time.Hour)},
+		{Status: hookDelivered, UpdatedAt: now.Add(-48 * time.Hour)},
+		{Status: hookDead, UpdatedAt: now},
+	}
+	for i := range deliveries {
+		d := &deliveries[i]
+		d.Id = newId()
+		d.UserId = u.Id
+		d.ChannelId = "c1"
+		d.Url = "https://example.com/hook"
+		d.Payload = `{"type":"item"}`
+		d.CreatedAt = now.Add(time.Duration(i) * time.Second)
+		if d.UpdatedAt.IsZero() {
+			d.UpdatedAt = now
+		}
+		if err := db.saveDelivery(d); err != nil {
+			t.Fatalf("saveDelivery() error: %v", err)
+		}
+	}
+
+	due, err := db.dueDeliveries(now)
+	if err != nil {
+		t.Fatalf("dueDeliveries() error: %v", err)
+	}
+	if len(due) != 1 || due[0].Id != deliveries[0].Id || due[0].Payload != `{"type":"item"}` {
+		t.Errorf("dueDeliveries() = %+v", due)
+	}
+
+	// Updates replace the stored delivery.
+	deliveries[0].Status = hookDelivered
+	deliveries[0].Attempts = 2
+	if err := db.saveDelivery(&deliveries[0]); err != nil {
+		t.Fatalf("saveDelivery() error: %v", err)
+	}
+	if due, _ = db.dueDeliveries(now); len(due) != 0 {
+		t.Errorf("dueDeliveries() = %+v, want none", due)
+	}
+
+	if err := db.pruneDeliveries(now.Add(-24 * time.Hour)); err != nil {
+		t.Fatalf("pruneDeliveries() error: %v", err)
+	}
+	log, err := db.findDeliveries(u.Id, 10)
+	if err != nil {
+		t.Fatalf("findDeliveries() error: %v", err)
+	}
+	if len(log) != 3 || log[0].Id != deliveries[3].Id || log[2].Id != deliveries[0].Id || log[2].Attempts != 2 {
+		t.Errorf("findDeliveries() = %+v", log)
+	}
+	if log, _ = db.findDeliveries(u.Id, 1); len(log) != 1 {
+		t.Errorf("findDeliveries() = %+v, want 1 delivery", log)
+	}
+}
+
+func testStoreTokens(t *testing.T, db Store) {
+	u := addUser(t, db, "a@example.com", Rule{Name: defaultRule, Settings: Settings{Score: 300}})
+
+	read, readToken := newAPIToken("read", []string{scopeReadSettings})
+	write, _ := newAPIToken("write", []string{scopeWriteSettings, scopeChannels})
+	for _, at := range []APIToken{read, write} {
+		if err := db.saveAPIToken(u.Id, at); err != nil {
+			t.Fatalf("saveAPIToken() error: %v", err)
+		}
+	}
+
+	got, found := db.findTokenUser(hashToken(readToken))
+	if !found || got.Id != u.Id || len(got.Tokens) != 2 {
+		t.Fatalf("findTokenUser() = %+v, %v", got, found)
+	}
+	if tk := got.apiToken(write.Id); tk == nil || tk.Name != "write" || !tk.allows(scopeChannels) || !tk.LastUsed.IsZero() {
+		t.Errorf("findTokenUser() tokens = %+v", got.Tokens)
+	}
+	if _, found := db.findTokenUser(hashToken("hnn_unknown")); found {
+		t.Error("findTokenUser() found an unknown token")
+	}
+
+	used := time.Now().UTC().Truncate(time.Second)
+	if err := db.touchAPIToken(u.Id, read.Id, used); err != nil {
+		t.Fatalf("touchAPIToken() error: %v", err)
+	}
+	if err := db.deleteAPIToken(u.Id, write.Id); err != nil {
+		t.Fatalf("deleteAPIToken() error: %v", err)
+	}
+	got, _ = db.findUser("a@example.com")
+	if len(got.Tokens) != 1 || got.Tokens[0].Id != read.Id || !got.Tokens[0].LastUsed.Equal(used) {
+		t.Errorf("findUser() tokens = %+v", got.Tokens)
+	}
+}
+
+func testStoreRuns(t *testing.T, db Store) {
+	if _, found := db.lastRun("notifier"); found {
+		t.Error("lastRun() found a run of a new job")
+	}
+
+	start := time.Now().Truncate(time.Second)
+	runs := []*Run{
+		{Id: newId(), Job: "notifier", Start: start.Add(-time.Hour), End: start.Add(-time.Hour + time.Minute), Status: runOK},
+		{Id: newId(), Job: "digests", Start: start.Add(time.Hour), Status: runRunning},
+		{Id: newId(), Job: "notifier", Start: start, Status: runRunning},
+	}
+	for _, r := range runs {
+		if err := db.saveRun(r); err != nil {
+			t.Fatalf("saveRun() error: %v", err)
+		}
+	}
+
+	last, found := db.lastRun("notifier")
+	if !found || last.Id != runs[2].Id || last.Status != runRunning || !last.Start.Equal(start) || !last.End.IsZero() {
+		t.Fatalf("lastRun() = %+v, %v", last, found)
+	}
+
+	// Finished runs are updated in place.
+	runs[2].End = start.Add(time.Minute)
+	runs[2].Status = runFailed
+	runs[2].Error = "boom"
+	if err := db.saveRun(runs[2]); err != nil {
+		t.Fatalf("saveRun() error: %v", err)
+	}
+	last, _ = db.lastRun("notifier")
+	if last.Id != runs[2].Id || last.Status != runFailed || last.Error != "boom" || !last.End.Equal(runs[2].End) {
+		t.Errorf("lastRun() = %+v", last)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ichinaski/hnnotifications/hnapi"
+)
+
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 5 * time.Minute
+)
+
+const (
+	topStoriesPath = "/topstories.json"
+	updatesPath    = "/updates.json"
+)
+
+var (
+	live *liveStream // Set up in main() when the stream fetcher is enabled.
+)
+
+// liveStream follows the Firebase Live Data event streams (Server-Sent Events) of
+// the top stories list and the item updates, pushing changed items into the
+// matching pipeline as they happen. See https://github.com/HackerNews/API#live-data
+// and https://firebase.google.com/docs/reference/rest/database#section-streaming.
+type liveStream struct {
+	ids chan int // Ids of the items to be fetched and processed.
+
+	mu        sync.Mutex
+	top       []int           // Current top stories.
+	connected map[string]bool // Connection status of each stream.
+}
+
+// newLiveStream creates a liveStream. Call start() to begin streaming.
+func newLiveStream() *liveStream {
+	return &liveStream{
+		ids:       make(chan int, maxTopStories),
+		connected: make(map[string]bool),
+	}
+}
+
+// start connects to the event streams, and starts processing items in the background, until ctx is done.
+// The processing is waited on by jobs, like the scheduled jobs.
+func (ls *liveStream) start(ctx context.Context) {
+	go ls.follow(ctx, topStoriesPath, ls.onTopStories)
+	go ls.follow(ctx, updatesPath, ls.onUpdates)
+	jobs.Add(1)
+	go func() {
+		defer jobs.Done()
+		ls.process(ctx)
+	}()
+}
+
+// healthy reports whether both streams are connected. Otherwise the poller takes over.
+func (ls *liveStream) healthy() bool {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return ls.connected[topStoriesPath] && ls.connected[updatesPath]
+}
+
+// setConnected updates the connection status of the given stream.
+func (ls *liveStream) setConnected(path string, ok bool) {
+	ls.mu.Lock()
+	ls.connected[path] = ok
+	ls.mu.Unlock()
+}
+
+// follow keeps a stream connected, reconnecting with exponential backoff upon failure.
+func (ls *liveStream) follow(ctx context.Context, path string, fn func(ctx context.Context, e *hnapi.Event) error) {
+	delay := minReconnectDelay
+	for {
+		t0 := time.Now()
+		err := ls.subscribe(ctx, path, fn)
+		ls.setConnected(path, false)
+		Logger.Printf("Stream %s disconnected: %v\n", path, err)
+
+		if time.Since(t0) > maxReconnectDelay {
+			delay = minReconnectDelay // The connection was fine for a while.
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// subscribe connects to the given stream, and feeds fn with the events read,
+// until the connection is closed or fn returns an error.
+func (ls *liveStream) subscribe(ctx context.Context, path string, fn func(ctx context.Context, e *hnapi.Event) error) error {
+	connected := false
+	return hn.Stream(ctx, path, func(e *hnapi.Event) error {
+		if !connected { // The first event tells the stream is up.
+			Logger.Printf("Stream %s connected\n", path)
+			ls.setConnected(path, true)
+			connected = true
+		}
+		return fn(ctx, e)
+	})
+}
+
+// onTopStories handles the events of the top stories stream, queueing the
+// stories that have just entered the top list.
+func (ls *liveStream) onTopStories(ctx context.Context, e *hnapi.Event) error {
+	ls.mu.Lock()
+	old := ls.topSet()
+	switch {
+	case e.Name == "put" && e.Path == "/":
+		ls.top = nil
+		if err := json.Unmarshal(e.Data, &ls.top); err != nil {
+			ls.mu.Unlock()
+			return err
+		}
+	case e.Name == "put":
+		var id int
+		if err := json.Unmarshal(e.Data, &id); err != nil {
+			ls.mu.Unlock()
+			return err
+		}
+		ls.set(strings.TrimPrefix(e.Path, "/"), id)
+	case e.Name == "patch":
+		patch := make(map[string]int)
+		if err := json.Unmarshal(e.Data, &patch); err != nil {
+			ls.mu.Unlock()
+			return err
+		}
+		for k, id := range patch {
+			ls.set(k, id)
+		}
+	}
+
+	var added []int
+	for id := range ls.topSet() {
+		if !old[id] {
+			added = append(added, id)
+		}
+	}
+	ls.mu.Unlock()
+
+	for _, id := range added {
+		if err := ls.queue(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// set updates the top stories list position given by key. The lock must be held.
+func (ls *liveStream) set(key string, id int) {
+	i, err := strconv.Atoi(key)
+	if err != nil || i < 0 {
+		return
+	}
+	for len(ls.top) <= i {
+		ls.top = append(ls.top, 0)
+	}
+	ls.top[i] = id
+}
+
+// topSet returns the set of current top stories. The lock must be held.
+func (ls *liveStream) topSet() map[int]bool {
+	set := make(map[int]bool)
+	for i, id := range ls.top {
+		if i == maxTopStories {
+			break
+		}
+		if id != 0 {
+			set[id] = true
+		}
+	}
+	return set
+}
+
+// onUpdates handles the events of the updates stream, queueing the changed top stories.
+// Other story lists are not streamed; they are only watched by the poller.
+func (ls *liveStream) onUpdates(ctx context.Context, e *hnapi.Event) error {
+	var updates struct {
+		Items []int `json:"items"`
+	}
+	var err error
+	if e.Path == "/items" {
+		err = json.Unmarshal(e.Data, &updates.Items)
+	} else {
+		err = json.Unmarshal(e.Data, &updates)
+	}
+	if err != nil {
+		return err
+	}
+
+	ls.mu.Lock()
+	top := ls.topSet()
+	ls.mu.Unlock()
+
+	for _, id := range updates.Items {
+		if !top[id] {
+			continue
+		}
+		if err := ls.queue(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queue hands the item over to process, unless ctx is done first.
+func (ls *liveStream) queue(ctx context.Context, id int) error {
+	select {
+	case ls.ids <- id:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// process fetches the queued items, one at a time, and runs them through the matching pipeline.
+func (ls *liveStream) process(ctx context.Context) {
+	for {
+		var id int
+		select {
+		case id = <-ls.ids:
+		case <-ctx.Done():
+			return
+		}
+
+		item, err := hn.Item(ctx, id)
+		if err != nil {
+			Logger.Println(err)
+			continue
+		}
+
+		s := &story{Item: *item, Feeds: []string{hnapi.Top}}
+		enrich(ctx, s)
+
+		db := openStore()
+		now := time.Now()
+		if err := db.saveItem(item, now); err != nil {
+			Logger.Println("Error: saveItem() - ", err)
+		}
+		s.Velocity = velocity(db, item, now)
+		process(db, s)
+		db.close()
+	}
+}
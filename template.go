@@ -15,7 +15,16 @@ var (
 func init() {
 	templates["info"] = template.Must(template.ParseFiles("templates/info.html"))
 	templates["item_email"] = template.Must(template.ParseFiles("templates/item_email.html"))
+	templates["comment_email"] = template.Must(template.ParseFiles("templates/comment_email.html"))
+	templates["digest_email"] = template.Must(template.ParseFiles("templates/digest_email.html"))
 	templates["activate_email"] = template.Must(template.ParseFiles("templates/activate_email.html"))
+	templates["verify_channel_email"] = template.Must(template.ParseFiles("templates/verify_channel_email.html"))
+	templates["webhooks"] = template.Must(template.ParseFiles("templates/webhooks.html"))
+	templates["webhooks_email"] = template.Must(template.ParseFiles("templates/webhooks_email.html"))
+	templates["tokens"] = template.Must(template.ParseFiles("templates/tokens.html"))
+	templates["tokens_email"] = template.Must(template.ParseFiles("templates/tokens_email.html"))
+	templates["feeds"] = template.Must(template.ParseFiles("templates/feeds.html"))
+	templates["feeds_email"] = template.Must(template.ParseFiles("templates/feeds_email.html"))
 	templates["unsubscribe_email"] = template.Must(template.ParseFiles("templates/unsubscribe_email.html"))
 }
 
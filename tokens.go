@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	maxTokens      = 10          // API tokens per user.
+	maxTokenName   = 50          // Characters.
+	apiTokenPrefix = "hnn_"      // Prefix of the API tokens, making them easy to recognize.
+	touchInterval  = time.Minute // Minimum interval between the last-used updates of an API token.
+)
+
+// API token scopes.
+const (
+	scopeReadSettings  = "settings:read"   // Read the subscription settings and API tokens.
+	scopeWriteSettings = "settings:write"  // Change the rules, revoke API tokens and unsubscribe.
+	scopeReadHistory   = "history:read"    // List the matched items.
+	scopeChannels      = "channels:manage" // List, add and delete notification channels.
+)
+
+// scopes lists all the API token scopes.
+var scopes = []string{scopeReadSettings, scopeWriteSettings, scopeReadHistory, scopeChannels}
+
+// APIToken is a personal API token of a user. The token itself is only shown once,
+// upon creation: just its hash is stored.
+type APIToken struct {
+	Id        string    `bson:"id"` // Random public identifier.
+	Name      string    `bson:"name"`
+	Hash      string    `bson:"hash"` // See hashToken.
+	Scopes    []string  `bson:"scopes"`
+	CreatedAt time.Time `bson:"createdAt"`
+	LastUsed  time.Time `bson:"lastUsed"` // Zero if never used.
+}
+
+// newAPIToken creates a named API token with the given scopes, returning it along
+// with the token to hand over to the user.
+func newAPIToken(name string, scopes []string) (APIToken, string) {
+	token := apiTokenPrefix + newToken()
+	return APIToken{
+		Id:        newToken(),
+		Name:      name,
+		Hash:      hashToken(token),
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+	}, token
+}
+
+// hashToken returns the hex encoded SHA-256 of the API token. Tokens are random,
+// so there is no need for a salted, slow hash.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// allows reports whether the token grants the scope.
+func (t *APIToken) allows(scope string) bool {
+	return contains(t.Scopes, scope)
+}
+
+// apiToken returns the user API token with the given id, or nil if there is none.
+func (u *User) apiToken(id string) *APIToken {
+	for i := range u.Tokens {
+		if u.Tokens[i].Id == id {
+			return &u.Tokens[i]
+		}
+	}
+	return nil
+}
+
+// apiAuth is the authenticated caller of the API.
+type apiAuth struct {
+	user  *User
+	token *APIToken
+}
+
+// authKey is the request context key of the apiAuth.
+type authKey struct{}
+
+// requireScope authenticates the API requests before handing them over to next,
+// typically wrapped by apiHandler. The bearer token is a personal API token granting
+// the scope. The caller is passed on through the request context, ending up in the
+// handler Context.
+func requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := openStore()
+		a, err := authenticate(db, r.Header.Get("Authorization"), scope, time.Now())
+		db.close()
+		if err != nil {
+			Logger.Printf("%s %s: %v\n", r.Method, r.URL.Path, err)
+			writeAPIError(err, w)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), authKey{}, a)))
+	}
+}
+
+// authenticate returns the caller owning the bearer token of the Authorization
+// header, if granted the scope. API tokens get their last-used time recorded.
+func authenticate(db Store, header, scope string, now time.Time) (*apiAuth, error) {
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil, errMessage{errUnauthorized}
+	}
+	token := strings.TrimPrefix(header, "Bearer ")
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return nil, errMessage{errUnauthorized} // Feed tokens are not accepted.
+	}
+
+	hash := hashToken(token)
+	u, found := db.findTokenUser(hash)
+	if !found {
+		return nil, errMessage{errUnauthorized}
+	}
+	var t *APIToken
+	for i := range u.Tokens {
+		if u.Tokens[i].Hash == hash {
+			t = &u.Tokens[i]
+		}
+	}
+	if t == nil {
+		return nil, errMessage{errUnauthorized}
+	}
+	if !t.allows(scope) {
+		return nil, errMessage{errForbidden}
+	}
+	if now.Sub(t.LastUsed) > touchInterval {
+		t.LastUsed = now
+		if err := db.touchAPIToken(u.Id, t.Id, now); err != nil {
+			Logger.Println("Error: touchAPIToken() - ", err)
+		}
+	}
+	return &apiAuth{user: u, token: t}, nil
+}
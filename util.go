@@ -18,3 +18,23 @@ func newToken() string {
 
 	return base64.URLEncoding.EncodeToString(b)
 }
+
+// contains reports whether s is in the list.
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// containsInt reports whether n is in the list.
+func containsInt(list []int, n int) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ichinaski/hnnotifications/hnapi"
+)
+
+const (
+	maxWatched    = 50                 // Watched stories per user.
+	watchDuration = 7 * 24 * time.Hour // Time a story is watched for.
+	watchInterval = 10 * time.Minute   // Interval at which the watch job checks the watched stories.
+	frontPageSize = 30                 // Top stories shown on the HN front page.
+
+	reasonWatch = "watched story" // Shown in place of the rule name.
+)
+
+var (
+	scoreMilestones   = []int{100, 250, 500, 1000}
+	commentMilestones = []int{50, 100, 250, 500}
+)
+
+// WatchedItem is a story watched by a user, along with the milestones already sent.
+type WatchedItem struct {
+	Id        int       `bson:"id"`
+	Title     string    `bson:"title"`
+	Score     int       `bson:"score"`     // Highest score milestone passed.
+	Comments  int       `bson:"comments"`  // Highest comment count milestone passed.
+	FrontPage bool      `bson:"frontPage"` // Whether the story was on the front page, as of the last check.
+	Since     time.Time `bson:"since"`     // Time the story was watched. It is dropped after watchDuration.
+}
+
+// newWatchedItem creates the watch of the item at the given time. The milestones
+// already passed, and the front page status, are not sent.
+func newWatchedItem(item *hnapi.Item, front []int, now time.Time) *WatchedItem {
+	return &WatchedItem{
+		Id:        item.Id,
+		Title:     item.Title,
+		Score:     milestone(scoreMilestones, item.Score),
+		Comments:  milestone(commentMilestones, item.Descendants),
+		FrontPage: containsInt(front, item.Id),
+		Since:     now,
+	}
+}
+
+// milestone returns the highest of the milestones reached by n, or zero.
+func milestone(milestones []int, n int) int {
+	reached := 0
+	for _, m := range milestones {
+		if n >= m {
+			reached = m
+		}
+	}
+	return reached
+}
+
+// expired reports whether the story is no longer watched at the given time.
+func (w *WatchedItem) expired(now time.Time) bool {
+	return now.Sub(w.Since) > watchDuration
+}
+
+// update returns the events of the story since the last check, along with the
+// updated watch. Front page changes are only looked for if front is known.
+func (w WatchedItem) update(item *hnapi.Item, front []int, known bool) ([]string, WatchedItem) {
+	var events []string
+	if m := milestone(scoreMilestones, item.Score); m > w.Score {
+		events = append(events, fmt.Sprintf("passed %d points", m))
+		w.Score = m
+	}
+	if m := milestone(commentMilestones, item.Descendants); m > w.Comments {
+		events = append(events, fmt.Sprintf("passed %d comments", m))
+		w.Comments = m
+	}
+	if on := containsInt(front, item.Id); known && on != w.FrontPage {
+		if on {
+			events = append(events, "reached the front page")
+		} else {
+			events = append(events, "fell off the front page")
+		}
+		w.FrontPage = on
+	}
+	w.Title = item.Title
+	return events, w
+}
+
+// watchMessage creates the follow-up of the watched story, upon the given events.
+func watchMessage(item *hnapi.Item, events []string) *Message {
+	qi := newQueuedItem(&story{Item: *item}, reasonWatch)
+	qi.Title = fmt.Sprintf("\"%s\" %s", item.Title, strings.Join(events, ", "))
+	return &Message{Kind: msgItem, Subject: qi.Title, Items: []QueuedItem{qi}}
+}
+
+// watched returns the user watch of the given story, or nil if not watched.
+func (u *User) watched(id int) *WatchedItem {
+	for i := range u.Watched {
+		if u.Watched[i].Id == id {
+			return &u.Watched[i]
+		}
+	}
+	return nil
+}
+
+// watchKey returns the key of the links watching the story, keyed with the user
+// feed token. Regenerating the feed token revokes the links.
+func watchKey(u *User, id int) string {
+	key, _ := sign(u.FeedToken, []byte("watch:"+strconv.Itoa(id))) // Empty without a feed token.
+	return key
+}
+
+// validWatchKey reports whether key is the user key of the links watching the story.
+func validWatchKey(u *User, id int, key string) bool {
+	return u.FeedToken != "" && hmac.Equal([]byte(key), []byte(watchKey(u, id)))
+}
+
+// watchLink returns the link (un)watching the story, sent along with the item
+// emails. Users created before the feeds get their feed token by a migration.
+func watchLink(u *User, id int, unwatch bool) string {
+	if u == nil || u.FeedToken == "" {
+		return ""
+	}
+	q := url.Values{}
+	q.Set("email", u.Email)
+	q.Set("item", strconv.Itoa(id))
+	q.Set("key", watchKey(u, id))
+	if unwatch {
+		q.Set("delete", "1")
+	}
+	return config.Url + "/watch?" + q.Encode()
+}
+
+// frontPage reads the ids of the stories on the HN front page.
+func frontPage(ctx context.Context) ([]int, error) {
+	top, err := hn.Stories(ctx, hnapi.Top)
+	if len(top) > frontPageSize {
+		top = top[:frontPageSize]
+	}
+	return top, err
+}
+
+// runWatched checks the stories watched by the users, sending them a follow-up
+// when the stories pass a milestone, or reach or fall off the front page. Stories
+// are dropped once watched for watchDuration.
+func runWatched(ctx context.Context) error {
+	db := openStore()
+	defer db.close()
+
+	users, err := db.findWatching()
+	if err != nil {
+		return err
+	}
+	if len(users) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	var ids []int
+	for i := range users {
+		u := &users[i]
+		for _, w := range u.Watched {
+			if w.expired(now) {
+				if err := db.deleteWatchedItem(u.Id, w.Id); err != nil {
+					Logger.Println("Error: deleteWatchedItem() - ", err)
+				}
+			} else if !containsInt(ids, w.Id) {
+				ids = append(ids, w.Id)
+			}
+		}
+	}
+	front, err := frontPage(ctx)
+	if err != nil {
+		Logger.Println("Error reading the front page: ", err)
+	}
+	known := err == nil
+
+	items, failed := fetchLogged(ctx, ids, config.Workers)
+	for item := range items {
+		if ctx.Err() != nil {
+			continue
+		}
+		for i := range users {
+			u := &users[i]
+			w := u.watched(item.Id)
+			if w == nil || w.expired(now) {
+				continue
+			}
+			events, next := w.update(&item, front, known)
+			if len(events) > 0 {
+				notifyAlert(db, u, watchMessage(&item, events), now)
+			}
+			if next != *w {
+				if err := db.saveWatchedItem(u.Id, next); err != nil {
+					Logger.Println("Error: saveWatchedItem() - ", err)
+				}
+			}
+		}
+	}
+	if n := <-failed; n > 0 {
+		Logger.Printf("Failed to fetch %d/%d watched items\n", n, len(ids))
+	}
+	return ctx.Err()
+}
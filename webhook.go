@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Webhook delivery states.
+const (
+	hookPending   = "pending"   // Failed so far, waiting for a retry.
+	hookDelivered = "delivered" // Accepted by the receiver.
+	hookDead      = "dead"      // Given up after maxHookAttempts.
+)
+
+const (
+	maxHookAttempts = 8                  // Attempts before a delivery is given up.
+	hookBackoff     = time.Minute        // Delay before the first retry, doubled after each attempt.
+	maxHookBackoff  = 6 * time.Hour      // Maximum delay between retries.
+	hookInterval    = time.Minute        // Interval at which the webhooks job retries the due deliveries.
+	hookLogAge      = 7 * 24 * time.Hour // Age of the finished deliveries dropped from the log.
+	hookLogSize     = 50                 // Deliveries shown in the delivery log.
+
+	signatureHeader = "X-HNN-Signature" // HMAC-SHA256 of the body, keyed with the user webhook secret.
+	deliveryHeader  = "X-HNN-Delivery"  // Delivery id, the same across retries.
+)
+
+var errNoSecret = errors.New("missing webhook secret")
+
+// WebhookDelivery is a message POSTed to a webhook channel. Deliveries are kept
+// for a while once finished, making up the user's delivery log.
+type WebhookDelivery struct {
+	Id          Id        `bson:"_id"`
+	UserId      Id        `bson:"userId"`
+	ChannelId   string    `bson:"channelId"`
+	Url         string    `bson:"url"`
+	Payload     string    `bson:"payload"`   // JSON document, sent as is on every attempt.
+	Signature   string    `bson:"signature"` // Value of the signatureHeader.
+	Status      string    `bson:"status"`    // One of the hook* states.
+	Attempts    int       `bson:"attempts"`
+	LastError   string    `bson:"lastError"`
+	CreatedAt   time.Time `bson:"createdAt"`
+	UpdatedAt   time.Time `bson:"updatedAt"`   // Time of the last attempt.
+	NextAttempt time.Time `bson:"nextAttempt"` // Time of the next retry, while pending.
+}
+
+// sign returns the signature of the body, as sent in the signatureHeader. Bodies
+// are never signed with an empty secret.
+func sign(secret string, body []byte) (string, error) {
+	if secret == "" {
+		return "", errNoSecret
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// newWebhookDelivery creates the pending delivery of the message to the user channel.
+func newWebhookDelivery(u *User, c *Channel, m *Message) (*WebhookDelivery, error) {
+	now := time.Now()
+	p := m.payload()
+	p.Subscriber = u.Id.Hex()
+	p.CreatedAt = now
+	body, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := sign(u.WebhookSecret, body)
+	if err != nil {
+		return nil, err
+	}
+	return &WebhookDelivery{
+		Id:          newId(),
+		UserId:      u.Id,
+		ChannelId:   c.Id,
+		Url:         c.Target,
+		Payload:     string(body),
+		Signature:   signature,
+		Status:      hookPending,
+		CreatedAt:   now,
+		NextAttempt: now,
+	}, nil
+}
+
+// attempt POSTs the delivery, updating its state: failed deliveries are retried
+// with exponential backoff, until maxHookAttempts is reached.
+func (d *WebhookDelivery) attempt(now time.Time) error {
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set(signatureHeader, d.Signature)
+	header.Set(deliveryHeader, d.Id.Hex())
+	err := send("POST", d.Url, []byte(d.Payload), header)
+
+	d.Attempts++
+	d.UpdatedAt = now
+	switch {
+	case err == nil:
+		d.Status = hookDelivered
+		d.LastError = ""
+	case d.Attempts >= maxHookAttempts:
+		d.Status = hookDead
+		d.LastError = err.Error()
+	default:
+		d.Status = hookPending
+		d.LastError = err.Error()
+		d.NextAttempt = now.Add(retryDelay(d.Attempts))
+	}
+	return err
+}
+
+// retryDelay returns the delay before the retry following the given number of attempts.
+func retryDelay(attempts int) time.Duration {
+	delay := hookBackoff
+	for i := 1; i < attempts && delay < maxHookBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxHookBackoff {
+		delay = maxHookBackoff
+	}
+	return delay
+}
+
+// deliverWebhook makes the first attempt to deliver the message to the webhook
+// channel, logging the delivery. Failed deliveries are queued for retry, and
+// count as delivered as long as they are stored.
+func deliverWebhook(db Store, u *User, c *Channel, m *Message) error {
+	d, err := newWebhookDelivery(u, c, m)
+	if err != nil {
+		return err
+	}
+	sendErr := d.attempt(time.Now())
+	if err := db.saveDelivery(d); err != nil {
+		if sendErr == nil {
+			Logger.Println("Error: saveDelivery() - ", err)
+			return nil
+		}
+		return err
+	}
+	if sendErr != nil {
+		Logger.Printf("Webhook delivery %s to user %s failed, will retry: %v\n", d.Id.Hex(), u.Email, sendErr)
+	}
+	return nil
+}
+
+// runWebhooks retries the due webhook deliveries, and drops the old ones from the log.
+func runWebhooks(ctx context.Context) error {
+	db := openStore()
+	defer db.close()
+
+	now := time.Now()
+	deliveries, err := db.dueDeliveries(now)
+	if err != nil {
+		return err
+	}
+	for i := range deliveries {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		d := &deliveries[i]
+		if err := d.attempt(now); err != nil && d.Status == hookDead {
+			Logger.Printf("Webhook delivery %s given up after %d attempts: %v\n", d.Id.Hex(), d.Attempts, err)
+		}
+		if err := db.saveDelivery(d); err != nil {
+			Logger.Println("Error: saveDelivery() - ", err)
+		}
+	}
+	return db.pruneDeliveries(now.Add(-hookLogAge))
+}